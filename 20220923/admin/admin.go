@@ -0,0 +1,283 @@
+package admin
+
+import (
+	"20220923/internal/metrics"
+	"20220923/internal/model"
+	"20220923/server"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Options 管理接口配置
+type Options struct {
+	Token   string            `comment:"请求须携带 Authorization: Bearer <Token>，为空表示不校验，此时只能监听本机地址"`
+	Level   *zap.AtomicLevel  `comment:"运行时可修改的日志级别，为 nil 时不提供 /loglevel"`
+	Metrics *metrics.Registry `comment:"不为 nil 时在 /metrics 输出 Prometheus 指标"`
+	Logger  *zap.SugaredLogger
+}
+
+// Admin 服务端的 HTTP 管理接口：
+//
+//	GET  /healthz                 进程存活
+//	GET  /readyz                  服务端正在接受连接时返回 200，否则 503
+//	GET  /sessions                在线会话列表
+//	POST /sessions/{username}/kick 断开某个用户的会话
+//	POST /broadcast               {"text": "..."} 广播 AdminMessage 给所有在线会话
+//	GET  /loglevel                {"level": "info"}，PUT 同样格式的请求体修改日志级别
+//	GET  /metrics                 Prometheus 指标
+type Admin struct {
+	srv  *server.Server
+	opts Options
+	log  *zap.SugaredLogger
+	mux  *http.ServeMux
+}
+
+func New(srv *server.Server, opts Options) *Admin {
+	a := &Admin{srv: srv, opts: opts, log: opts.Logger, mux: http.NewServeMux()}
+	if a.log == nil {
+		a.log = zap.S()
+	}
+	a.mux.HandleFunc("/healthz", a.healthz)
+	a.mux.HandleFunc("/readyz", a.readyz)
+	a.mux.HandleFunc("/sessions", a.sessions)
+	a.mux.HandleFunc("/sessions/", a.kick)
+	a.mux.HandleFunc("/broadcast", a.broadcast)
+	if opts.Level != nil {
+		a.mux.Handle("/loglevel", a.logLevel(opts.Level))
+	}
+	if opts.Metrics != nil {
+		a.mux.Handle("/metrics", opts.Metrics.Handler())
+	}
+	return a
+}
+
+// Handler 所有管理接口，健康检查之外的接口须通过 Token 校验
+func (a *Admin) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" && r.URL.Path != "/readyz" && !a.authorized(r) {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		a.mux.ServeHTTP(w, r)
+	})
+}
+
+// ErrNoToken 未配置 Token 时只允许监听本机地址
+var ErrNoToken = errors.New("admin: token required for a non-loopback address")
+
+// ListenAndServe 在 addr 上提供管理接口。ctx 结束时关闭并返回 nil；未配置 Token 且 addr 不是本机地址时返回 ErrNoToken
+func (a *Admin) ListenAndServe(ctx context.Context, addr string) error {
+	if a.opts.Token == "" && !isLoopback(addr) {
+		return ErrNoToken
+	}
+	hs := &http.Server{
+		Addr:              addr,
+		Handler:           a.Handler(),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = hs.Close()
+		case <-stop:
+		}
+	}()
+	if err := hs.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// isLoopback addr 的主机部分是否为本机地址，主机为空(监听所有地址)时返回 false
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	if a.opts.Token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.opts.Token)) == 1
+}
+
+func (a *Admin) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (a *Admin) readyz(w http.ResponseWriter, r *http.Request) {
+	if !a.srv.Ready() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// Session 会话在管理接口中的 JSON 表示，时长为 time.Duration 的字符串形式(如 1.5ms)
+type Session struct {
+	Username      string    `json:"username"`
+	RemoteAddr    string    `json:"remote_addr"`
+	LoginTime     time.Time `json:"login_time"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	MsgIn         uint64    `json:"msg_in"`
+	MsgOut        uint64    `json:"msg_out"`
+	NextSeq       uint32    `json:"next_seq" comment:"默认通道下一条业务消息的序号"`
+	AckSeq        uint32    `json:"ack_seq" comment:"默认通道已处理的客户端业务消息的最大序号"`
+	QueueLen      int       `json:"queue_len"`
+	QueueCap      int       `json:"queue_cap"`
+	Dropped       uint64    `json:"dropped"`
+	Unacked       int       `json:"unacked"`
+	Channels      []Channel `json:"channels"`
+	LatencyP50    string    `json:"latency_p50"`
+	LatencyP99    string    `json:"latency_p99"`
+	RTT           string    `json:"rtt"`
+	ClockOffset   string    `json:"clock_offset"`
+}
+
+// Channel 逻辑通道在管理接口中的 JSON 表示
+type Channel struct {
+	ID       uint8  `json:"id"`
+	Name     string `json:"name"`
+	NextSeq  uint32 `json:"next_seq"`
+	AckSeq   uint32 `json:"ack_seq"`
+	QueueLen int    `json:"queue_len"`
+	Unacked  int    `json:"unacked"`
+}
+
+func newSession(info server.SessionInfo) Session {
+	s := Session{
+		Username:      info.Username,
+		RemoteAddr:    info.RemoteAddr,
+		LoginTime:     info.LoginTime,
+		LastHeartbeat: info.LastHeartbeat,
+		MsgIn:         info.MsgIn,
+		MsgOut:        info.MsgOut,
+		NextSeq:       info.NextSeq,
+		AckSeq:        info.AckSeq,
+		QueueLen:      info.QueueLen,
+		QueueCap:      info.QueueCap,
+		Dropped:       info.Dropped,
+		Unacked:       info.Unacked,
+		Channels:      make([]Channel, 0, len(info.Channels)),
+		LatencyP50:    info.Latency.Quantile(0.5).String(),
+		LatencyP99:    info.Latency.Quantile(0.99).String(),
+		RTT:           info.RTT.String(),
+		ClockOffset:   info.ClockOffset.String(),
+	}
+	for _, c := range info.Channels {
+		s.Channels = append(s.Channels, Channel(c))
+	}
+	return s
+}
+
+func (a *Admin) sessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	infos := a.srv.Sessions()
+	ss := make([]Session, 0, len(infos))
+	for _, info := range infos {
+		ss = append(ss, newSession(info))
+	}
+	writeJSON(w, http.StatusOK, ss)
+}
+
+// kick POST /sessions/{username}/kick
+func (a *Admin) kick(w http.ResponseWriter, r *http.Request) {
+	username := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/kick")
+	if username == "" || strings.Contains(username, "/") || !strings.HasSuffix(r.URL.Path, "/kick") {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if err := a.srv.Kick(username); err != nil {
+		if errors.Is(err, server.ErrNotConnected) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.log.Warnf("admin kick. username=[%s], admin_addr=[%s]", username, r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]string{"kicked": username})
+}
+
+// broadcastRequest POST /broadcast 的请求体
+type broadcastRequest struct {
+	Text string `json:"text"`
+}
+
+func (a *Admin) broadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var req broadcastRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, model.MaxAdminTextSize*2)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Text == "" {
+		writeError(w, http.StatusBadRequest, errors.New("empty text"))
+		return
+	}
+	if len(req.Text) > model.MaxAdminTextSize {
+		writeError(w, http.StatusBadRequest, errors.New("text too long"))
+		return
+	}
+	m := model.NewAdminMessage()
+	m.SetText(req.Text)
+	n, err := a.srv.Broadcast(r.Context(), m)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.log.Infof("admin broadcast. sessions=[%d], admin_addr=[%s], text=[%s]", n, r.RemoteAddr, req.Text)
+	writeJSON(w, http.StatusOK, map[string]int{"sessions": n})
+}
+
+// logLevel zap.AtomicLevel 自带 GET/PUT 的处理，修改时记录日志
+func (a *Admin) logLevel(level *zap.AtomicLevel) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		old := level.Level()
+		level.ServeHTTP(w, r)
+		if cur := level.Level(); cur != old {
+			a.log.Warnf("log level changed. from=[%s], to=[%s], admin_addr=[%s]", old, cur, r.RemoteAddr)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,141 @@
+package admin
+
+import (
+	"20220923/client"
+	"20220923/internal/enum"
+	"20220923/internal/model"
+	"20220923/server"
+	"context"
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	srv := server.New(
+		server.WithAddr("127.0.0.1:0"),
+		server.WithAuthenticator(server.StaticUsers(map[string]string{"mayee": "mayee"})),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	hs := httptest.NewServer(New(srv, Options{Token: "secret", Level: &level}).Handler())
+	defer hs.Close()
+	do := func(method, path, body string, out any) int {
+		t.Helper()
+		req, err := http.NewRequest(method, hs.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	// 健康检查不需要 Token，Serve 之前未就绪
+	if resp, err := http.Get(hs.URL + "/healthz"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("healthz = %v, %v", resp, err)
+	}
+	if code := do(http.MethodGet, "/readyz", "", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz before Serve = %d", code)
+	}
+	if resp, err := http.Get(hs.URL + "/sessions"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("sessions without token = %v, %v", resp, err)
+	}
+	// 裸 Token 缺少 Bearer 前缀
+	req, _ := http.NewRequest(http.MethodGet, hs.URL+"/sessions", nil)
+	req.Header.Set("Authorization", "secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("sessions without Bearer = %v, %v", resp, err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+	deadline := time.Now().Add(time.Second * 3)
+	for do(http.MethodGet, "/readyz", "", nil) != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("not ready")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := client.Dial(ctx, client.Options{Addr: srv.Addr().String(), Username: "mayee", Password: "mayee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got := make(chan string, 1)
+	c.Subscribe(enum.MsgTypeAdminMessage, func(m model.Message) { got <- m.(*model.AdminMessage).Text })
+
+	var ss []Session
+	if code := do(http.MethodGet, "/sessions", "", &ss); code != http.StatusOK || len(ss) != 1 || ss[0].Username != "mayee" || ss[0].QueueCap == 0 {
+		t.Fatalf("sessions = %d, %+v", code, ss)
+	}
+
+	var br map[string]int
+	if code := do(http.MethodPost, "/broadcast", `{"text":"维护通知"}`, &br); code != http.StatusOK || br["sessions"] != 1 {
+		t.Fatalf("broadcast = %d, %v", code, br)
+	}
+	select {
+	case text := <-got:
+		if text != "维护通知" {
+			t.Fatalf("admin message = %q", text)
+		}
+	case <-ctx.Done():
+		t.Fatal("no admin message")
+	}
+	if code := do(http.MethodPost, "/broadcast", `{"text":""}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("empty broadcast = %d", code)
+	}
+
+	var lv struct {
+		Level string `json:"level"`
+	}
+	if code := do(http.MethodPut, "/loglevel", `{"level":"debug"}`, &lv); code != http.StatusOK || level.Level() != zapcore.DebugLevel {
+		t.Fatalf("set log level = %d, %v", code, level.Level())
+	}
+
+	if code := do(http.MethodPost, "/sessions/nobody/kick", "", nil); code != http.StatusNotFound {
+		t.Fatalf("kick unknown user = %d", code)
+	}
+	if code := do(http.MethodPost, "/sessions/mayee/kick", "", nil); code != http.StatusOK {
+		t.Fatalf("kick = %d", code)
+	}
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatal("session not kicked")
+	}
+}
+
+func TestListenNoToken(t *testing.T) {
+	a := New(server.New(), Options{})
+	for _, addr := range []string{":0", "0.0.0.0:0", "192.0.2.1:0"} {
+		if err := a.ListenAndServe(context.Background(), addr); !errors.Is(err, ErrNoToken) {
+			t.Fatalf("ListenAndServe(%q) = %v, want ErrNoToken", addr, err)
+		}
+	}
+	// 本机地址不需要 Token
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := a.ListenAndServe(ctx, "127.0.0.1:0"); err != nil {
+		t.Fatalf("ListenAndServe on loopback = %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff 指数退避，每次等待时间翻倍直到 max，并加入随机抖动避免大量客户端同时重连
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+	rnd     *rand.Rand
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{
+		min: min,
+		max: max,
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next 返回下一次等待时间，取值范围为 [d/2, d)，d = min * 2^attempt
+func (b *backoff) next() time.Duration {
+	d := b.min << b.attempt
+	if d > b.max || d <= 0 {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	half := d / 2
+	return half + time.Duration(b.rnd.Int63n(int64(half)+1))
+}
+
+// reset 下一次等待时间从 min 开始
+func (b *backoff) reset() {
+	b.attempt = 0
+}
@@ -1,113 +1,585 @@
-package main
+package client
 
 import (
 	"20220923/internal/enum"
-	_ "20220923/internal/log"
+	"20220923/internal/heartbeat"
+	"20220923/internal/metrics"
 	"20220923/internal/model"
 	"20220923/internal/packet"
+	"20220923/internal/retransmit"
+	"20220923/internal/transfer"
 	"context"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func main() {
-	// 指定使用本地的哪个 ip 发起连接
-	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
-	// 指定连接到哪个 ip 和 端口
-	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 30001}
-	// 这么做的意义在于：当客户机有多块网卡，其中一个网卡的 ip 在服务端的白名单中，如果客户端未指定 ip，则可能会用到另一个非白名单的 ip 发起连接，导致被服务端拒绝
-	// 测试方法：客户机电脑同时连上网线和WLAN，这样就有两个网卡地址。然后分别用这两个地址发起 tcp 连接，在服务端观察打印出来的客户端地址
-	conn, err := net.DialTCP("tcp", local, remote)
+// ErrClosed 客户端已关闭
+var ErrClosed = errors.New("client: closed")
+
+const (
+	defaultHeartbeatInterval = time.Second * 5
+	defaultBackoffMin        = time.Millisecond * 500
+	defaultBackoffMax        = time.Second * 30
+	defaultAckInterval       = time.Second
+	defaultRetransmitSize    = 4096
+	loginTimeout             = time.Second * 10
+)
+
+// State 连接状态
+type State int
+
+const (
+	StateConnecting   State = iota // 正在连接(包括重连)
+	StateLoggedIn                  // 已登录
+	StateDisconnected              // 连接断开，等待重连
+	StateClosed                    // 已关闭，不再重连
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateLoggedIn:
+		return "logged-in"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Options 客户端配置
+type Options struct {
+	Network      string                                                            `comment:"网络类型，tcp(默认)、tcp4、tcp6 或 unix。unix 时 Addr 为套接字文件路径"`
+	Addr         string                                                            `comment:"服务端地址，如 127.0.0.1:30001"`
+	Addrs        []string                                                          `comment:"备用服务端地址，连接失败时依次尝试"`
+	LocalAddr    string                                                            `comment:"指定使用本地的哪个 ip 发起连接，为空则由系统选择，只对 tcp 有效"`
+	Interface    string                                                            `comment:"使用该网卡(如 eth0)的地址发起连接，网卡未启用时连接失败。LocalAddr 为空时有效"`
+	LocalCIDR    string                                                            `comment:"使用本机第一个属于该网段(如 10.1.0.0/16)的地址发起连接。LocalAddr、Interface 为空时有效"`
+	Dial         func(ctx context.Context, network, addr string) (net.Conn, error) `comment:"自定义建立连接(如 pipe.Listener.DialContext)，设置后忽略 LocalAddr、Interface、LocalCIDR"`
+	Username     string
+	Password     string
+	ForwardedFor net.IP `comment:"网关代替客户端登录时填写客户端的 IP，服务端只接受来自可信网关的该 IP"`
+
+	HeartbeatInterval  time.Duration      `comment:"登录时请求的心跳间隔，默认 5 秒，实际使用服务端协商后的值"`
+	HeartbeatMaxMissed int                `comment:"连续多少个心跳间隔收不到服务端消息判定为超时，默认 3"`
+	Logger             *zap.SugaredLogger `comment:"默认使用 zap 的全局日志"`
+
+	Reconnect     bool                         `comment:"断线后自动重连并重新登录"`
+	BackoffMin    time.Duration                `comment:"重连的最小等待时间，默认 500 毫秒"`
+	BackoffMax    time.Duration                `comment:"重连的最大等待时间，默认 30 秒，小于 BackoffMin 时等于 BackoffMin"`
+	LastSeq       uint32                       `comment:"上次已处理的最大消息序号，用于进程重启后续传"`
+	OnStateChange func(state State, err error) `comment:"连接状态变化的回调，err 为断开原因"`
+
+	AckInterval    time.Duration `comment:"确认已处理的服务端消息的间隔，默认 1 秒"`
+	RetransmitSize int           `comment:"最多保存的未确认数据包个数，默认 4096，小于 0 表示不限制"`
+
+	TransferLimits transfer.Limits `comment:"接收服务端分片传输的大小、内存和超时限制"`
+
+	OnMessage   func(m model.Message) `comment:"在连接之前注册的 OnMessage 回调，不会错过登录后立即收到的消息"`
+	Passthrough bool                  `comment:"分片传输和组播补发的消息不在客户端处理，与业务消息一样交给回调，用于网关转发"`
+
+	Socket  packet.SocketOptions `comment:"套接字选项和读写缓冲区大小，如低延迟或广域网的调优"`
+	Metrics *metrics.Registry    `comment:"注册登录、数据包和心跳的指标，通过 Metrics.Handler() 以 Prometheus 格式输出"`
+}
+
+// LoginError 服务端拒绝登录
+type LoginError struct {
+	Status uint8
+}
+
+func (e *LoginError) Error() string {
+	return fmt.Sprintf("login response %d", e.Status)
+}
+
+// EndOfSessionError 服务端发送 EndOfSession 结束了会话
+type EndOfSessionError struct {
+	Reason uint8
+}
+
+func (e *EndOfSessionError) Error() string {
+	return fmt.Sprintf("end of session, reason %d", e.Reason)
+}
+
+// Client TCP 客户端，负责登录、心跳和断线重连，业务消息通过回调交给应用
+type Client struct {
+	opts  Options
+	addrs []string
+	log   *zap.SugaredLogger
+	out   chan *packet.Buffer
+
+	mu           sync.RWMutex
+	onMessage    []func(model.Message)
+	onChannel    []func(ch uint8, m model.Message)
+	onTransfer   []func(t *transfer.Transfer)
+	onRetransmit []func(resp *model.RetransmitResponse, ms []model.Message)
+	subs         map[uint16][]func(model.Message)
+	topics       map[topicKey]struct{} `comment:"已订阅的主题，重连后重新订阅"`
+
+	pmu     sync.Mutex
+	pending map[uint32]chan callResult `comment:"等待响应的请求，key 为关联 ID"`
+	corrID  uint32                     // 最近分配的关联 ID，使用 atomic 读写
+
+	smu   sync.Mutex
+	s     *packet.Session `comment:"当前连接，断开时为 nil"`
+	state State
+
+	lastSeq  uint32        // 默认通道已处理的最大消息序号，使用 atomic 读写
+	interval time.Duration // 登录时协商的心跳间隔
+	echo     bool          // 服务端支持 HeartBeatEcho，登录时设置
+	nextSeq  uint32        // 默认通道下一条发送的业务消息的序号，使用 atomic 读写
+	unacked  *retransmit.Buffer
+
+	cmu   sync.Mutex
+	chans map[uint8]*channelSeq `comment:"非默认逻辑通道的序号，不续传，每次连接从 1 开始"`
+
+	transfers *transfer.Assembler `comment:"重组服务端的分片传输，重连续传后继续接收"`
+	senders   *transfer.Senders   `comment:"发给服务端的分片传输，服务端取消时中止"`
+	backoff   *backoff            `comment:"重连的等待时间，连续失败时增长，登录成功后重置。只在 connect 和 loop 中使用"`
+
+	metrics *clientMetrics
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// Dial 连接服务端并登录，登录成功后才返回。开启 Reconnect 时会按退避策略重试直到 ctx 结束
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if opts.BackoffMin <= 0 {
+		opts.BackoffMin = defaultBackoffMin
+	}
+	if opts.BackoffMax <= 0 {
+		opts.BackoffMax = defaultBackoffMax
+	}
+	if opts.BackoffMax < opts.BackoffMin {
+		opts.BackoffMax = opts.BackoffMin
+	}
+	if opts.AckInterval <= 0 {
+		opts.AckInterval = defaultAckInterval
+	}
+	if opts.RetransmitSize == 0 {
+		opts.RetransmitSize = defaultRetransmitSize
+	}
+	c := &Client{
+		opts:      opts,
+		log:       opts.Logger,
+		out:       make(chan *packet.Buffer),
+		subs:      make(map[uint16][]func(model.Message)),
+		topics:    make(map[topicKey]struct{}),
+		pending:   make(map[uint32]chan callResult),
+		lastSeq:   opts.LastSeq,
+		nextSeq:   1,
+		unacked:   retransmit.New(opts.RetransmitSize),
+		transfers: transfer.NewAssembler(opts.TransferLimits),
+		senders:   transfer.NewSenders(),
+		backoff:   newBackoff(opts.BackoffMin, opts.BackoffMax),
+		metrics:   newClientMetrics(opts.Metrics),
+		done:      make(chan struct{}),
+	}
+	if c.log == nil {
+		c.log = zap.S()
+	}
+	if opts.OnMessage != nil {
+		c.onMessage = append(c.onMessage, opts.OnMessage)
+	}
+	if opts.Addr != "" {
+		c.addrs = append(c.addrs, opts.Addr)
+	}
+	c.addrs = append(c.addrs, opts.Addrs...)
+	if len(c.addrs) == 0 {
+		return nil, errors.New("client: no server address")
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	s, err := c.connect(ctx)
 	if err != nil {
-		panic(err)
+		c.cancel()
+		c.setState(StateClosed, err)
+		return nil, err
 	}
-	s := packet.NewSession(conn)
-	defer func() {
-		if exp := recover(); exp != nil {
-			zap.S().Errorf("[recovered] panic: %v\n", exp)
+	go c.loop(s)
+	return c, nil
+}
+
+// connect 依次尝试各个地址，所有地址都失败后按退避策略等待，再从头尝试。登录成功后重置退避
+func (c *Client) connect(ctx context.Context) (*packet.Session, error) {
+	for i := 0; ; i++ {
+		addr := c.addrs[i%len(c.addrs)]
+		c.setState(StateConnecting, nil)
+		s, err := c.dial(ctx, addr)
+		if err == nil {
+			c.backoff.reset()
+			return s, nil
 		}
-		_ = s.Close()
-		zap.S().Warn("disconnect with server")
-	}()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+		c.log.Warnf("connect failed. server_addr=[%s], err=[%v]", addr, err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// 账号或 IP 无效，重试也不会成功
+		var le *LoginError
+		if errors.As(err, &le) && le.Status == enum.SessionStatusInvalid {
+			return nil, err
+		}
+		if (i+1)%len(c.addrs) != 0 {
+			continue
+		}
+		if !c.opts.Reconnect {
+			return nil, err
+		}
+		if err = sleep(ctx, c.backoff.next()); err != nil {
+			return nil, err
+		}
+	}
+}
 
-	// 登录
-	login := model.NewLogin()
-	login.Username.Set([]byte("mayee"))
-	login.Password.Set([]byte("mayee"))
-	loginPkt := new(packet.Buffer)
-	err = loginPkt.WriteMessage(login)
+// dial 建立连接并登录
+func (c *Client) dial(ctx context.Context, addr string) (*packet.Session, error) {
+	network := c.opts.Network
+	if network == "" {
+		network = "tcp"
+	}
+	dial := c.opts.Dial
+	if dial == nil {
+		var d net.Dialer
+		// 这么做的意义在于：当客户机有多块网卡，其中一个网卡的 ip 在服务端的白名单中，如果客户端未指定 ip，则可能会用到另一个非白名单的 ip 发起连接，导致被服务端拒绝
+		if strings.HasPrefix(network, "tcp") {
+			ip, err := c.opts.localIP(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if ip != nil {
+				d.LocalAddr = &net.TCPAddr{IP: ip}
+			}
+		}
+		dial = d.DialContext
+	}
+	ctx, cancel := context.WithTimeout(ctx, loginTimeout)
+	defer cancel()
+	conn, err := dial(ctx, network, addr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	err = s.WritePacket(ctx, loginPkt)
+	s, err := packet.NewSessionWith(conn, c.opts.Socket)
 	if err != nil {
-		panic(err)
+		_ = conn.Close()
+		return nil, err
+	}
+	s.SetMetrics(c.metrics.packets)
+	if err = c.login(ctx, s); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *Client) login(ctx context.Context, s *packet.Session) error {
+	login := model.NewLogin()
+	login.Username.Set([]byte(c.opts.Username))
+	login.Password.Set([]byte(c.opts.Password))
+	// 从上次处理到的位置续传
+	last := atomic.LoadUint32(&c.lastSeq)
+	if last > 0 {
+		login.SeqNum = last + 1
+	}
+	login.HeartBtInt = uint32(c.opts.HeartbeatInterval.Milliseconds())
+	p := new(packet.Buffer)
+	if c.opts.ForwardedFor != nil {
+		fwd := model.NewForwardedFor()
+		fwd.SetIP(c.opts.ForwardedFor)
+		if err := p.WriteMessage(fwd); err != nil {
+			return err
+		}
+	}
+	if err := p.WriteMessage(login); err != nil {
+		return err
+	}
+	if err := s.WritePacket(ctx, p); err != nil {
+		return err
 	}
-	loginRespPkt, err := s.ReadPacket(ctx)
+	p, err := s.ReadPacket(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	message, err := loginRespPkt.ReadMessage()
+	m, err := p.ReadMessage()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	if message.Type() != enum.MsgTypeLoginResponse {
-		panic("login response type error")
+	if m.Type() != enum.MsgTypeLoginResponse {
+		return fmt.Errorf("login response type error: MsgType(%d)", m.Type())
 	}
-	response := message.(*model.LoginResponse)
-	if response.SessionStatus != 0 {
-		panic(fmt.Errorf("lgoin response %d", response.SessionStatus))
+	resp := m.(*model.LoginResponse)
+	c.metrics.logins.With(strconv.Itoa(int(resp.SessionStatus))).Inc()
+	if resp.SessionStatus != enum.SessionStatusActive {
+		return &LoginError{Status: resp.SessionStatus}
 	}
+	if last > 0 && resp.SeqNum > last+1 {
+		c.log.Warnf("sequence gap on resume. expected_seq=[%d], next_seq=[%d]", last+1, resp.SeqNum)
+	}
+	c.interval = c.opts.HeartbeatInterval
+	c.echo = resp.Features&enum.FeatureHeartBeatEcho != 0
+	if resp.HeartBtInt > 0 {
+		c.interval = time.Duration(resp.HeartBtInt) * time.Millisecond
+	}
+	// 服务端已处理 AckSeqNum 及之前的消息。客户端重启后没有未确认的消息，序号从服务端已处理的位置继续
+	c.unacked.Ack(resp.AckSeqNum)
+	if c.unacked.Len() == 0 && atomic.LoadUint32(&c.nextSeq) <= resp.AckSeqNum {
+		atomic.StoreUint32(&c.nextSeq, resp.AckSeqNum+1)
+	}
+	c.log.Infof("login. server_addr=[%s], username=[%s], next_seq=[%d], ack_seq=[%d], heartbeat=[%s]", s.RemoteAddr().String(), c.opts.Username, resp.SeqNum, resp.AckSeqNum, c.interval)
+	if err = c.resubscribe(ctx, s); err != nil {
+		return err
+	}
+	return c.retransmit(ctx, s, resp.AckSeqNum+1)
+}
 
-	eg, ctx := errgroup.WithContext(ctx)
-	ch := make(chan *packet.Buffer)
+// retransmit 重发服务端未处理的消息
+func (c *Client) retransmit(ctx context.Context, s *packet.Session, seq uint32) error {
+	ps := c.unacked.Since(seq)
+	for _, p := range ps {
+		if err := s.WritePacket(ctx, p); err != nil {
+			return err
+		}
+	}
+	if len(ps) > 0 {
+		c.log.Infof("retransmitted. from_seq=[%d], packets=[%d]", seq, len(ps))
+	}
+	return nil
+}
+
+// resubscribe 重新订阅之前订阅过的主题
+func (c *Client) resubscribe(ctx context.Context, s *packet.Session) error {
+	c.mu.RLock()
+	ps := make([]*packet.Buffer, 0, len(c.topics))
+	for k := range c.topics {
+		m := model.NewSubscribe()
+		m.Topic.Set([]byte(k.topic))
+		p := new(packet.Buffer)
+		if err := p.WriteMessage(m); err != nil {
+			c.mu.RUnlock()
+			return err
+		}
+		p.Channel = k.channel
+		ps = append(ps, p)
+	}
+	c.mu.RUnlock()
+	for _, p := range ps {
+		if err := s.WritePacket(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loop 维持连接，断线后按配置重连
+func (c *Client) loop(s *packet.Session) {
+	defer close(c.done)
+	for {
+		c.setSession(s)
+		c.setState(StateLoggedIn, nil)
+		err := c.serve(s)
+		c.setSession(nil)
+		_ = s.Close()
+		c.logLatency(s)
+		// 断开的连接上不会再收到响应
+		c.failPending(err)
+		// 主动关闭
+		if c.ctx.Err() != nil {
+			c.log.Info("disconnect with server")
+			c.setState(StateClosed, nil)
+			return
+		}
+		c.log.Warnf("disconnect with server: %v", err)
+		c.setState(StateDisconnected, err)
+		if !c.opts.Reconnect {
+			c.err = err
+			c.setState(StateClosed, err)
+			return
+		}
+		// 稍等片刻再重连，避免服务端刚接受就断开时反复重连
+		if err = sleep(c.ctx, c.backoff.next()); err == nil {
+			s, err = c.connect(c.ctx)
+		}
+		if err != nil {
+			if c.ctx.Err() == nil {
+				c.err = err
+			}
+			c.setState(StateClosed, c.err)
+			return
+		}
+	}
+}
+
+// serve 在一个连接上收发消息，直到连接断开
+func (c *Client) serve(s *packet.Session) error {
+	// errgroup 中任一个 goroutine 返回 error，ctx 会被取消
+	eg, ctx := errgroup.WithContext(c.ctx)
+	hb := heartbeat.New(c.interval, c.opts.HeartbeatMaxMissed)
+	// 服务端在新的会话中为非默认通道重新分配序号
+	c.cmu.Lock()
+	c.chans = make(map[uint8]*channelSeq)
+	c.cmu.Unlock()
 
 	// 接收消息
 	eg.Go(func() error {
 		for {
-			pkt, err := s.ReadPacket(ctx)
+			p, err := s.ReadPacket(ctx)
 			if err != nil {
 				return err
 			}
-			m, err := pkt.ReadMessage()
-			if err != nil {
-				return err
+			// 收到任何消息都说明服务端存活
+			hb.Beat()
+			lastSeq := &c.lastSeq
+			if p.Channel != 0 {
+				lastSeq = &c.channel(p.Channel).lastSeq
+			}
+			// 服务端重发的消息中可能有已经处理过的
+			if last := atomic.LoadUint32(lastSeq); p.SeqNum != 0 && p.MsgCount > 0 && p.SeqNum+uint32(p.MsgCount)-1 <= last {
+				c.log.Debugf("duplicate message dropped. channel=[%d], seq=[%d], last_seq=[%d]", p.Channel, p.SeqNum, last)
+				continue
+			}
+			var end *model.EndOfSession
+			for {
+				m, err := p.ReadMessage()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				// 数据包内容损坏，之后的数据也不可信，断开连接(开启重连时从已处理的序号续传)
+				if err != nil {
+					c.log.Errorf("decode message failed. channel=[%d], seq=[%d], err=[%v]", p.Channel, p.SeqNum, err)
+					return fmt.Errorf("decode message: %w", err)
+				}
+				if m.Type() == enum.MsgTypeEndOfSession {
+					end = m.(*model.EndOfSession)
+				}
+				if hb, ok := m.(*model.HeartBeatEcho); ok {
+					if cs, ok := s.ObserveEcho(hb, p); ok {
+						c.log.Debugf("clock sample. rtt=[%s], offset=[%s]", cs.RTT, cs.Offset)
+					}
+				}
+				// 补发的组播消息与响应在同一个数据包中，一并交给回调
+				if resp, ok := m.(*model.RetransmitResponse); ok && !c.opts.Passthrough {
+					if err = c.retransmitted(resp, p); err != nil {
+						return err
+					}
+					break
+				}
+				if transfer.IsTransfer(m) && !c.opts.Passthrough {
+					if err = c.receiveTransfer(ctx, s, m); err != nil {
+						return err
+					}
+					continue
+				}
+				c.dispatch(p.Channel, m)
+			}
+			// 记录已处理的序号，心跳等协议消息的序号为 0
+			if p.SeqNum != 0 && p.MsgCount > 0 {
+				if last := atomic.LoadUint32(lastSeq); last > 0 && p.SeqNum > last+1 {
+					c.log.Warnf("sequence gap. channel=[%d], expected_seq=[%d], received_seq=[%d]", p.Channel, last+1, p.SeqNum)
+				}
+				atomic.StoreUint32(lastSeq, p.SeqNum+uint32(p.MsgCount)-1)
 			}
-			switch m.Type() {
-			case enum.MsgTypeHeartBeat:
-				zap.S().Debug("receive server heartBeat")
-				// 响应心跳
-				// 必须要重新写入一次 message, 因为 p.ReadMessage 后，p.num 为 0 了。若此时发送 p 后，服务端调用 p.ReadMessage, 发现 p.num 为 0 则手动抛出 io.EOF
-				_ = pkt.WriteMessage(m)
-				ch <- pkt
-			case enum.MsgTypeServerDemo:
-				demo := m.(*model.ServerDemo)
-				zap.S().Info(demo.String())
+			// 服务端随后会关闭连接
+			if end != nil {
+				return &EndOfSessionError{Reason: end.Reason}
 			}
 		}
 	})
 
-	// 发送消息
+	// 发送心跳，并检测服务端是否失联
 	eg.Go(func() error {
-		demo := model.NewClientDemo()
-		t := time.NewTicker(time.Second * 2)
+		// 旧版本的服务端不认识 HeartBeatEcho
+		var m model.Message = model.NewHeartBeat()
+		echo := model.NewHeartBeatEcho()
+		if c.echo {
+			m = echo
+		}
+		err := hb.Run(ctx, func() error {
+			if c.echo {
+				s.Echo(echo)
+			}
+			p := new(packet.Buffer)
+			_ = p.WriteMessage(m)
+			return s.WritePacket(ctx, p)
+		})
+		if errors.Is(err, heartbeat.ErrTimeout) {
+			c.metrics.heartbeatTimeouts.Inc()
+			return errors.New("server heart timeout")
+		}
+		return err
+	})
+
+	// 定时确认各通道已处理的消息，服务端据此释放重发缓冲区和流量控制窗口
+	eg.Go(func() error {
+		ticker := time.NewTicker(c.opts.AckInterval)
+		defer ticker.Stop()
+		acked := map[uint8]uint32{0: atomic.LoadUint32(&c.lastSeq)}
 		for {
 			select {
-			case <-t.C:
+			case <-ticker.C:
+				seqs := c.channelSeqs()
+				seqs[0] = atomic.LoadUint32(&c.lastSeq)
 				p := new(packet.Buffer)
-				_ = p.WriteMessage(demo)
-				err = s.WritePacket(ctx, p)
-				if err != nil {
-					panic(err)
+				for ch, seq := range seqs {
+					if seq == acked[ch] {
+						continue
+					}
+					m := model.NewAck()
+					m.SeqNum = seq
+					m.Channel = ch
+					_ = p.WriteMessage(m)
+					acked[ch] = seq
 				}
-			case p := <-ch:
-				err = s.WritePacket(ctx, p)
-				if err != nil {
+				if p.NumMessages() == 0 {
+					continue
+				}
+				if err := s.WritePacket(ctx, p); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	// 发送消息。业务消息在各自的通道内按顺序分配序号，默认通道的确认之前保存在重发缓冲区中
+	eg.Go(func() error {
+		for {
+			select {
+			case p := <-c.out:
+				n := p.NumMessages()
+				if p.Channel != 0 {
+					p.SeqNum = atomic.AddUint32(&c.channel(p.Channel).nextSeq, uint32(n)) - uint32(n)
+					if err := s.WritePacket(ctx, p); err != nil {
+						return err
+					}
+					continue
+				}
+				shared := p.Share()
+				seq := atomic.LoadUint32(&c.nextSeq)
+				if c.unacked.Add(seq, n, shared) {
+					c.log.Debug("retransmit buffer full, oldest packet dropped")
+				}
+				atomic.AddUint32(&c.nextSeq, uint32(n))
+				p = shared.Packet()
+				p.SeqNum = seq
+				if err := s.WritePacket(ctx, p); err != nil {
 					return err
 				}
 			case <-ctx.Done():
@@ -116,24 +588,405 @@ func main() {
 		}
 	})
 
-	if err = eg.Wait(); err != nil {
-		panic(err)
+	return eg.Wait()
+}
+
+// OnMessage 注册回调，接收所有业务消息。回调在读取 goroutine 中依次执行，不应阻塞
+func (c *Client) OnMessage(fn func(model.Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onMessage = append(c.onMessage, fn)
+}
+
+// OnChannelMessage 注册回调，接收所有业务消息以及消息所在的逻辑通道
+func (c *Client) OnChannelMessage(fn func(ch uint8, m model.Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChannel = append(c.onChannel, fn)
+}
+
+// Subscribe 注册回调，只接收指定类型的消息
+func (c *Client) Subscribe(msgType uint16, fn func(model.Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subs[msgType] = append(c.subs[msgType], fn)
+}
+
+// OnTransfer 注册回调，接收服务端完整的分片传输。回调在读取 goroutine 中依次执行，不应阻塞
+func (c *Client) OnTransfer(fn func(t *transfer.Transfer)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onTransfer = append(c.onTransfer, fn)
+}
+
+// SendTransfer 把超过一个数据包大小的数据拆分为分片在默认通道上发送给服务端，ctx 结束时通知服务端取消。
+// 服务端取消时返回 *transfer.CancelError
+func (c *Client) SendTransfer(ctx context.Context, name string, data []byte) error {
+	return c.senders.Send(ctx, name, data, func(ctx context.Context, m model.Message) error {
+		return c.Send(ctx, m)
+	})
+}
+
+// receiveTransfer 重组分片，接收失败时通知服务端取消
+func (c *Client) receiveTransfer(ctx context.Context, s *packet.Session, m model.Message) error {
+	if m, ok := m.(*model.TransferCancel); ok && m.Origin == enum.TransferOriginReceiver {
+		// 服务端拒绝了客户端发出的传输
+		c.log.Warnf("transfer rejected by server. transfer_id=[%d], reason=[%d], active=[%t]", m.TransferID, m.Reason, c.senders.Cancelled(m))
+		return nil
+	}
+	t, err := c.transfers.Handle(m)
+	var ce *transfer.CancelError
+	if errors.As(err, &ce) {
+		c.log.Warnf("transfer cancelled. transfer_id=[%d], reason=[%d], err=[%v]", ce.ID, ce.Reason, ce.Err)
+		p := new(packet.Buffer)
+		_ = p.WriteMessage(ce.Cancel())
+		return s.WritePacket(ctx, p)
+	}
+	if t == nil {
+		return nil
+	}
+	c.mu.RLock()
+	fns := c.onTransfer
+	c.mu.RUnlock()
+	for _, fn := range fns {
+		fn(t)
+	}
+	return nil
+}
+
+// OnRetransmit 注册回调，接收服务端通过 TCP 补发的 UDP 组播消息，通常为 multicast.Subscriber 的 Fill
+func (c *Client) OnRetransmit(fn func(resp *model.RetransmitResponse, ms []model.Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onRetransmit = append(c.onRetransmit, fn)
+}
+
+// RequestRetransmit 请求服务端补发 UDP 组播会话 session 中 [seq, seq+count) 的消息
+func (c *Client) RequestRetransmit(ctx context.Context, session string, seq uint64, count uint32) error {
+	m := model.NewRetransmitRequest()
+	m.Session.Set([]byte(session))
+	m.SeqNum = seq
+	m.Count = count
+	return c.Send(ctx, m)
+}
+
+func (c *Client) retransmitted(resp *model.RetransmitResponse, p *packet.Buffer) error {
+	var ms []model.Message
+	for {
+		m, err := p.ReadMessage()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			c.log.Errorf("decode retransmitted message failed. session=[%s], seq=[%d], err=[%v]", resp.Session.String(), resp.SeqNum, err)
+			return fmt.Errorf("decode retransmitted message: %w", err)
+		}
+		ms = append(ms, m)
+	}
+	c.mu.RLock()
+	fns := c.onRetransmit
+	c.mu.RUnlock()
+	for _, fn := range fns {
+		fn(resp, ms)
+	}
+	return nil
+}
+
+// SubscribeTopic 在默认通道上订阅服务端的主题，断线重连后会自动重新订阅。收到的消息通过 OnMessage、Subscribe 注册的回调处理
+func (c *Client) SubscribeTopic(ctx context.Context, topic string) error {
+	return c.SubscribeTopicChannel(ctx, 0, topic)
+}
+
+// SubscribeTopicChannel 订阅服务端的主题，服务端把该主题的消息发布到逻辑通道 ch
+func (c *Client) SubscribeTopicChannel(ctx context.Context, ch uint8, topic string) error {
+	c.mu.Lock()
+	for k := range c.topics {
+		if k.topic == topic {
+			delete(c.topics, k)
+		}
+	}
+	c.topics[topicKey{channel: ch, topic: topic}] = struct{}{}
+	c.mu.Unlock()
+	m := model.NewSubscribe()
+	m.Topic.Set([]byte(topic))
+	return c.SendChannel(ctx, ch, m)
+}
+
+// UnsubscribeTopic 取消订阅服务端的主题
+func (c *Client) UnsubscribeTopic(ctx context.Context, topic string) error {
+	c.mu.Lock()
+	for k := range c.topics {
+		if k.topic == topic {
+			delete(c.topics, k)
+		}
+	}
+	c.mu.Unlock()
+	m := model.NewUnsubscribe()
+	m.Topic.Set([]byte(topic))
+	return c.Send(ctx, m)
+}
+
+// Send 在默认通道上发送消息给服务端。断线重连期间会阻塞，直到重连成功或 ctx 结束
+func (c *Client) Send(ctx context.Context, ms ...model.Message) error {
+	return c.SendChannel(ctx, 0, ms...)
+}
+
+// SendChannel 在逻辑通道 ch 上发送消息给服务端，服务端未配置该通道时会丢弃。
+// 只有默认通道的消息在断线重连后重发
+func (c *Client) SendChannel(ctx context.Context, ch uint8, ms ...model.Message) error {
+	p := new(packet.Buffer)
+	for _, m := range ms {
+		if err := p.WriteMessage(m); err != nil {
+			return err
+		}
+	}
+	p.Channel = ch
+	select {
+	case c.out <- p:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type callResult struct {
+	m   model.Message
+	err error
+}
+
+// Call 发送请求并等待关联 ID 相同的响应，响应可以乱序到达。
+// 关联 ID 由 Call 分配，会覆盖 req 中原有的值。ctx 结束或连接断开时返回 error，之后到达的响应交给回调处理
+func (c *Client) Call(ctx context.Context, req model.Correlated) (model.Message, error) {
+	id := atomic.AddUint32(&c.corrID, 1)
+	if id == 0 {
+		// 0 表示不关联，回绕时跳过
+		id = atomic.AddUint32(&c.corrID, 1)
+	}
+	req.SetCorrelationID(id)
+	ch := make(chan callResult, 1)
+	c.pmu.Lock()
+	c.pending[id] = ch
+	c.pmu.Unlock()
+	defer func() {
+		c.pmu.Lock()
+		delete(c.pending, id)
+		c.pmu.Unlock()
+	}()
+
+	if err := c.Send(ctx, req); err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-ch:
+		return r.m, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reply 把响应交给等待中的 Call，没有对应的 Call 时返回 false
+func (c *Client) reply(m model.Message) bool {
+	cm, ok := m.(model.Correlated)
+	if !ok || cm.CorrelationID() == 0 {
+		return false
+	}
+	c.pmu.Lock()
+	ch, ok := c.pending[cm.CorrelationID()]
+	delete(c.pending, cm.CorrelationID())
+	c.pmu.Unlock()
+	if !ok {
+		return false
+	}
+	ch <- callResult{m: m}
+	return true
+}
+
+// failPending 连接断开时结束所有等待中的 Call
+func (c *Client) failPending(err error) {
+	if err == nil {
+		err = ErrClosed
 	}
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	for id, ch := range c.pending {
+		ch <- callResult{err: fmt.Errorf("client: connection lost: %w", err)}
+		delete(c.pending, id)
+	}
+}
+
+// State 当前连接状态
+func (c *Client) State() State {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	return c.state
+}
+
+// LastSeq 已处理的最大消息序号，可以持久化后通过 Options.LastSeq 续传
+func (c *Client) LastSeq() uint32 {
+	return atomic.LoadUint32(&c.lastSeq)
+}
+
+// Stats 当前连接的延迟统计
+type Stats struct {
+	Latency     metrics.HistogramSnapshot `comment:"服务端数据包的单向延迟分布，包含时钟偏差"`
+	RTT         time.Duration             `comment:"心跳的往返时间，未测量时为 0"`
+	ClockOffset time.Duration             `comment:"服务端时钟减去客户端时钟，未测量时为 0"`
+}
+
+// Stats 当前连接的统计，重连后重新统计，未连接时返回零值
+func (c *Client) Stats() Stats {
+	s := c.session()
+	if s == nil {
+		return Stats{}
+	}
+	return sessionStats(s)
+}
+
+func sessionStats(s *packet.Session) Stats {
+	st := Stats{Latency: s.Latency()}
+	if cs, ok := s.Clock(); ok {
+		st.RTT = cs.RTT
+		st.ClockOffset = cs.Offset
+	}
+	return st
+}
+
+// logLatency 连接断开时输出该连接的延迟统计
+func (c *Client) logLatency(s *packet.Session) {
+	st := sessionStats(s)
+	c.log.Infof("session latency. latency=[%s], rtt=[%s], clock_offset=[%s]", st.Latency, st.RTT, st.ClockOffset)
+}
+
+// Done 客户端关闭后(主动关闭或无法重连)关闭
+func (c *Client) Done() <-chan struct{} {
+	return c.done
 }
 
-func netDemo() {
-	// Linux 可以使用`ip a`命令查看网卡索引和名称；Windows 可以使用`netsh int ipv4 show interfaces`查看网卡索引和名称
-	// 列出所有的网卡
-	itfs, _ := net.Interfaces()
-	for _, itf := range itfs {
-		// 有了索引和名称可以通过 net.InterfaceByIndex() 或 net.InterfaceByName() 获取指定网卡
-		fmt.Printf("网卡索引=[%d], 网卡名称=[%s]\n", itf.Index, itf.Name)
-		addrs, _ := itf.Addrs()
-		for _, addr := range addrs {
-			if ip := addr.(*net.IPNet).IP.To4(); ip != nil {
-				fmt.Printf("ip 地址: %s", ip.String())
-				break
+// Err 客户端关闭的原因，主动 Close 时为 nil
+func (c *Client) Err() error {
+	<-c.done
+	return c.err
+}
+
+// Close 发送登出消息后断开连接，不再重连
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		if s := c.session(); s != nil {
+			// Writer 内部有锁，可以直接写出，不经过 c.out
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			// 确认已处理的消息后登出
+			ack := model.NewAck()
+			ack.SeqNum = atomic.LoadUint32(&c.lastSeq)
+			p := new(packet.Buffer)
+			_ = p.WriteMessage(ack)
+			_ = p.WriteMessage(model.NewLogout())
+			if err := s.WritePacket(ctx, p); err != nil {
+				c.log.Warnf("send logout failed: %v", err)
 			}
 		}
+		c.cancel()
+		if s := c.session(); s != nil {
+			_ = s.Close()
+		}
+	})
+	<-c.done
+	return nil
+}
+
+func (c *Client) session() *packet.Session {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	return c.s
+}
+
+func (c *Client) setSession(s *packet.Session) {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	c.s = s
+}
+
+func (c *Client) setState(state State, err error) {
+	c.smu.Lock()
+	c.state = state
+	c.smu.Unlock()
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(state, err)
+	}
+}
+
+func (c *Client) dispatch(ch uint8, m model.Message) {
+	switch m.Type() {
+	case enum.MsgTypeHeartBeat, enum.MsgTypeHeartBeatEcho:
+		c.log.Debug("receive server heartBeat")
+		return
+	case enum.MsgTypeAck:
+		// 只有默认通道的消息保存在重发缓冲区中
+		if ack := m.(*model.Ack); ack.Channel == 0 {
+			c.unacked.Ack(ack.SeqNum)
+		}
+		return
+	}
+	if c.reply(m) {
+		return
+	}
+	c.mu.RLock()
+	fns := append(c.onMessage[:len(c.onMessage):len(c.onMessage)], c.subs[m.Type()]...)
+	chFns := c.onChannel
+	c.mu.RUnlock()
+	for _, fn := range fns {
+		fn(m)
+	}
+	for _, fn := range chFns {
+		fn(ch, m)
+	}
+}
+
+// topicKey 订阅的主题以及接收该主题的逻辑通道
+type topicKey struct {
+	channel uint8
+	topic   string
+}
+
+// channelSeq 非默认逻辑通道的序号，使用 atomic 读写
+type channelSeq struct {
+	lastSeq uint32 // 已处理的最大消息序号
+	nextSeq uint32 // 下一条发送的业务消息的序号
+}
+
+// channel 取出当前连接上逻辑通道 ch 的序号，不存在时创建
+func (c *Client) channel(ch uint8) *channelSeq {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	cs, ok := c.chans[ch]
+	if !ok {
+		cs = &channelSeq{nextSeq: 1}
+		c.chans[ch] = cs
+	}
+	return cs
+}
+
+// channelSeqs 当前连接上各非默认通道已处理的最大消息序号
+func (c *Client) channelSeqs() map[uint8]uint32 {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	seqs := make(map[uint8]uint32, len(c.chans)+1)
+	for ch, cs := range c.chans {
+		seqs[ch] = atomic.LoadUint32(&cs.lastSeq)
+	}
+	return seqs
+}
+
+// sleep 等待 d 或 ctx 结束
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
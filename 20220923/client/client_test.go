@@ -0,0 +1,671 @@
+package client
+
+import (
+	"20220923/internal/enum"
+	"20220923/internal/model"
+	"20220923/internal/multicast"
+	"20220923/internal/packet"
+	"20220923/internal/pipe"
+	"20220923/internal/transfer"
+	"20220923/server"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/sync/errgroup"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newServer 监听本机随机端口、以 mayee 登录、响应 ClientDemo 的服务端，opts 可以覆盖这些设置
+func newServer(t *testing.T, opts ...server.Option) *server.Server {
+	t.Helper()
+	mux := server.NewMux()
+	mux.HandleRequest(enum.MsgTypeClientDemo, func(context.Context, *server.Session, model.Message) (model.Message, error) {
+		return model.NewServerDemo(), nil
+	})
+	srv := server.New(append([]server.Option{
+		server.WithAddr("127.0.0.1:0"),
+		server.WithAuthenticator(server.StaticUsers(map[string]string{"mayee": "mayee"})),
+		server.WithHandler(mux),
+	}, opts...)...)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	srv := newServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err := Dial(ctx, Options{Addr: srv.Addr().String(), Username: "mayee", Password: "wrong"})
+	var le *LoginError
+	if !errors.As(err, &le) || le.Status != enum.SessionStatusInvalid {
+		t.Fatalf("Dial with wrong password = %v", err)
+	}
+
+	c, err := Dial(ctx, Options{Addr: srv.Addr().String(), Username: "mayee", Password: "mayee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan model.Message, 1)
+	c.Subscribe(enum.MsgTypeServerDemo, func(m model.Message) { got <- m })
+	if err = c.Send(ctx, model.NewClientDemo()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-got:
+	case <-ctx.Done():
+		t.Fatal("no response")
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Err(); err != nil {
+		t.Fatalf("Err after Close = %v", err)
+	}
+	// 登出后会话应从服务端注销
+	for len(srv.Sessions()) != 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("session not unregistered after logout")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := newServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	states := make(chan State, 16)
+	c, err := Dial(ctx, Options{
+		// 第一个地址不可用，应切换到备用地址
+		Addr:          "127.0.0.1:1",
+		Addrs:         []string{srv.Addr().String()},
+		Username:      "mayee",
+		Password:      "mayee",
+		Reconnect:     true,
+		BackoffMin:    time.Millisecond * 10,
+		BackoffMax:    time.Millisecond * 50,
+		OnStateChange: func(state State, _ error) { states <- state },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got := make(chan struct{}, 1)
+	c.Subscribe(enum.MsgTypeServerDemo, func(model.Message) { got <- struct{}{} })
+	request := func() {
+		t.Helper()
+		if err := c.Send(ctx, model.NewClientDemo()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-got:
+		case <-ctx.Done():
+			t.Fatal("no response")
+		}
+	}
+	// 序号在回调执行完之后才更新
+	waitSeq := func(want uint32) {
+		t.Helper()
+		for c.LastSeq() != want {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("LastSeq = %d, want %d", c.LastSeq(), want)
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+	request()
+	request()
+	waitSeq(2)
+
+	// 服务端踢掉会话后，客户端应重连并从序号 3 续传
+	for len(states) > 0 {
+		<-states
+	}
+	if err = srv.Kick("mayee"); err != nil {
+		t.Fatal(err)
+	}
+	want := []State{StateDisconnected, StateConnecting}
+	for _, w := range want {
+		if s := <-states; s != w {
+			t.Fatalf("state = %s, want %s", s, w)
+		}
+	}
+	for s := range states {
+		if s == StateLoggedIn {
+			break
+		}
+	}
+	request()
+	waitSeq(3)
+}
+
+func TestBackoff(t *testing.T) {
+	srv := newServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	// 只设置了 BackoffMax，且小于默认的 BackoffMin
+	c, err := Dial(ctx, Options{Addr: srv.Addr().String(), Username: "mayee", Password: "mayee", BackoffMax: time.Millisecond * 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.opts.BackoffMax != c.opts.BackoffMin {
+		t.Fatalf("BackoffMax = %s, BackoffMin = %s", c.opts.BackoffMax, c.opts.BackoffMin)
+	}
+
+	// 连续失败时等待时间增长，重置后从 min 开始
+	b := newBackoff(time.Millisecond*10, time.Second)
+	for i := 0; i < 4; i++ {
+		b.next()
+	}
+	if d := b.next(); d < time.Millisecond*80 {
+		t.Fatalf("5th backoff = %s", d)
+	}
+	b.reset()
+	if d := b.next(); d >= time.Millisecond*10 {
+		t.Fatalf("backoff after reset = %s", d)
+	}
+}
+
+// loginResponseV1 旧版本服务端的登录响应，只有 SessionStatus，没有序号、心跳间隔和 Features
+type loginResponseV1 struct {
+	model.MetaMessage
+	SessionStatus uint8
+	_             [3]byte
+}
+
+// fakeServer 只回复旧版本的登录响应的服务端，之后交给 fn 处理，fn 返回后断开连接。
+// 旧版本不协商心跳间隔，客户端使用 Options.HeartbeatInterval
+func fakeServer(t *testing.T, fn func(ctx context.Context, s *packet.Session)) net.Listener {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := packet.NewSession(conn)
+		ctx := context.Background()
+		if _, err = s.ReadPacket(ctx); err != nil {
+			return
+		}
+		resp := &loginResponseV1{MetaMessage: model.MetaMessage{MsgSize: 8, MsgType: enum.MsgTypeLoginResponse}}
+		p := new(packet.Buffer)
+		_ = p.WriteMessage(resp)
+		if err = s.WritePacket(ctx, p); err != nil {
+			return
+		}
+		fn(ctx, s)
+	}()
+	return lis
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	// 登录之后不再发送任何消息
+	lis := fakeServer(t, func(ctx context.Context, s *packet.Session) {
+		for {
+			if _, err := s.ReadPacket(ctx); err != nil {
+				return
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: lis.Addr().String(), Username: "mayee", Password: "mayee", HeartbeatInterval: time.Millisecond * 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Done():
+		if err = c.Err(); err == nil {
+			t.Fatal("Err = nil, want heart timeout")
+		}
+	case <-ctx.Done():
+		t.Fatal("server timeout not detected")
+	}
+}
+
+func TestOldServerHeartbeat(t *testing.T) {
+	// 旧版本服务端的 LoginResponse 没有 Features，客户端只发 4 字节的 HeartBeat
+	got := make(chan model.MetaMessage, 1)
+	lis := fakeServer(t, func(ctx context.Context, s *packet.Session) {
+		for {
+			p, err := s.ReadPacket(ctx)
+			if err != nil {
+				return
+			}
+			m, err := p.ReadMessage()
+			if err != nil {
+				return
+			}
+			if m.Type() == enum.MsgTypeHeartBeat || m.Type() == enum.MsgTypeHeartBeatEcho {
+				select {
+				case got <- model.MetaMessage{MsgSize: m.Size(), MsgType: m.Type()}:
+				default:
+				}
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: lis.Addr().String(), Username: "mayee", Password: "mayee", HeartbeatInterval: time.Millisecond * 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case meta := <-got:
+		if meta.MsgType != enum.MsgTypeHeartBeat || int(meta.MsgSize) != model.MetaMessageSize {
+			t.Fatalf("heartbeat = %+v", meta)
+		}
+	case <-ctx.Done():
+		t.Fatal("no heartbeat")
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	// 登录之后发送无法解码的消息
+	lis := fakeServer(t, func(ctx context.Context, s *packet.Session) {
+		p := new(packet.Buffer)
+		_ = p.WriteMessage(&model.MetaMessage{MsgSize: 4, MsgType: 999})
+		_ = s.WritePacket(ctx, p)
+		for {
+			if _, err := s.ReadPacket(ctx); err != nil {
+				return
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: lis.Addr().String(), Username: "mayee", Password: "mayee", HeartbeatInterval: time.Millisecond * 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Done():
+		if err = c.Err(); err == nil || !strings.Contains(err.Error(), "decode message") {
+			t.Fatalf("Err = %v, want decode error", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("decode error not detected")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv := newServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: srv.Addr().String(), Username: "mayee", Password: "mayee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatal("client not closed after server shutdown")
+	}
+	var ee *EndOfSessionError
+	if !errors.As(c.Err(), &ee) || ee.Reason != enum.EndOfSessionShutdown {
+		t.Fatalf("Err = %v, want end of session", c.Err())
+	}
+}
+
+func TestServeCancel(t *testing.T) {
+	// Serve 的 ctx 取消时与 Shutdown 一样先通知会话结束，而不是直接断开连接
+	srv := server.New(
+		server.WithAddr("127.0.0.1:0"),
+		server.WithAuthenticator(server.StaticUsers(map[string]string{"mayee": "mayee"})),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	serveCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(serveCtx) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: srv.Addr().String(), Username: "mayee", Password: "mayee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatal("client not closed after Serve ctx cancelled")
+	}
+	var ee *EndOfSessionError
+	if !errors.As(c.Err(), &ee) || ee.Reason != enum.EndOfSessionShutdown {
+		t.Fatalf("Err = %v, want end of session", c.Err())
+	}
+	if err = <-served; !errors.Is(err, server.ErrServerClosed) {
+		t.Fatalf("Serve = %v, want ErrServerClosed", err)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	srv := newServer(t, server.WithAuthenticator(server.AuthenticatorFunc(func(_, _ string) bool { return true })))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	got := make(chan string, 4)
+	var cs []*Client
+	for _, u := range []string{"a", "b"} {
+		u := u
+		c, err := Dial(ctx, Options{Addr: srv.Addr().String(), Username: u, Password: u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Subscribe(enum.MsgTypeServerDemo, func(model.Message) { got <- u })
+		if err = c.SubscribeTopic(ctx, "quotes"); err != nil {
+			t.Fatal(err)
+		}
+		cs = append(cs, c)
+	}
+	// 订阅是异步的，先发布心跳(客户端不会回调)探测，等服务端处理完订阅再发布业务消息
+	publish := func(want int) {
+		t.Helper()
+		for {
+			n, err := srv.Publish(context.Background(), "quotes", model.NewHeartBeat())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == want {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("Publish = %d, want %d", n, want)
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+		if n, err := srv.Publish(context.Background(), "quotes", model.NewServerDemo()); err != nil || n != want {
+			t.Fatalf("Publish = %d, %v, want %d", n, err, want)
+		}
+	}
+	publish(2)
+	if a, b := <-got, <-got; a == b {
+		t.Fatalf("received by %s twice", a)
+	}
+
+	if err := cs[0].UnsubscribeTopic(ctx, "quotes"); err != nil {
+		t.Fatal(err)
+	}
+	publish(1)
+	if u := <-got; u != "b" {
+		t.Fatalf("received by %s after unsubscribe", u)
+	}
+}
+
+func TestCall(t *testing.T) {
+	mux := server.NewMux()
+	// 异步响应，奇数关联 ID 的请求延迟响应，使响应乱序到达
+	mux.Handle(enum.MsgTypeClientDemo, func(ctx context.Context, s *server.Session, m model.Message) error {
+		id := m.(*model.ClientDemo).CorrID
+		go func() {
+			if id%2 == 1 {
+				time.Sleep(time.Millisecond * 50)
+			}
+			resp := model.NewServerDemo()
+			resp.CorrID = id
+			_ = s.Write(context.Background(), resp)
+		}()
+		return nil
+	})
+	srv := newServer(t, server.WithHandler(mux))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: srv.Addr().String(), Username: "mayee", Password: "mayee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Call 收到的响应不会交给回调，超时之后到达的响应才会
+	late := make(chan uint32, 4)
+	c.Subscribe(enum.MsgTypeServerDemo, func(m model.Message) {
+		late <- m.(*model.ServerDemo).CorrID
+	})
+
+	order := make(chan uint32, 2)
+	eg, ectx := errgroup.WithContext(ctx)
+	for i := 0; i < 2; i++ {
+		eg.Go(func() error {
+			req := model.NewClientDemo()
+			resp, err := c.Call(ectx, req)
+			if err != nil {
+				return err
+			}
+			if id := resp.(*model.ServerDemo).CorrID; id != req.CorrID {
+				return fmt.Errorf("response CorrID = %d, want %d", id, req.CorrID)
+			}
+			order <- req.CorrID
+			return nil
+		})
+	}
+	if err = eg.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if first := <-order; first%2 != 0 {
+		t.Fatalf("delayed response %d arrived first", first)
+	}
+
+	// 关联 ID 为 3 的请求延迟响应，Call 先超时
+	tctx, tcancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer tcancel()
+	if _, err = c.Call(tctx, model.NewClientDemo()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Call = %v, want deadline exceeded", err)
+	}
+	select {
+	case id := <-late:
+		if id != 3 {
+			t.Fatalf("late response CorrID = %d, want 3", id)
+		}
+	case <-ctx.Done():
+		t.Fatal("late response not dispatched")
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	var lo string
+	itfs, _ := net.Interfaces()
+	for _, itf := range itfs {
+		if itf.Flags&net.FlagLoopback != 0 && itf.Flags&net.FlagUp != 0 {
+			lo = itf.Name
+			break
+		}
+	}
+	if lo == "" {
+		t.Skip("no loopback interface")
+	}
+	srv := newServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: srv.Addr().String(), Interface: lo, Username: "mayee", Password: "mayee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ss := srv.Sessions(); len(ss) != 1 || !strings.HasPrefix(ss[0].RemoteAddr, "127.") {
+		t.Fatalf("sessions = %v", ss)
+	}
+
+	ip, err := (&Options{LocalCIDR: "127.0.0.0/8"}).localIP("tcp", "127.0.0.1:30001")
+	if err != nil || !ip.IsLoopback() {
+		t.Fatalf("LocalCIDR: ip = %v, err = %v", ip, err)
+	}
+	if _, err = (&Options{LocalCIDR: "0.0.0.0/32"}).localIP("tcp", "127.0.0.1:30001"); err == nil {
+		t.Fatal("LocalCIDR without matching address: no error")
+	}
+	if _, err = (&Options{Interface: "nonexistent0"}).localIP("tcp", "127.0.0.1:30001"); err == nil {
+		t.Fatal("unknown interface: no error")
+	}
+}
+
+func TestLatency(t *testing.T) {
+	srv := newServer(t, server.WithHeartbeatLimits(time.Millisecond*10, time.Second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: srv.Addr().String(), Username: "mayee", Password: "mayee", HeartbeatInterval: time.Millisecond * 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// 双方互发几次心跳之后都有延迟统计，同一台机器的时钟偏差接近 0
+	for {
+		ss := srv.Sessions()
+		if len(ss) == 1 && ss[0].Latency.Count >= 3 && c.Stats().Latency.Count >= 3 {
+			if off := ss[0].ClockOffset; off < -time.Millisecond*5 || off > time.Millisecond*5 {
+				t.Fatalf("server clock offset = %s", off)
+			}
+			if off := c.Stats().ClockOffset; off < -time.Millisecond*5 || off > time.Millisecond*5 {
+				t.Fatalf("client clock offset = %s", off)
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("no latency samples")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+func TestPipe(t *testing.T) {
+	lis := pipe.Listen("server")
+	srv := newServer(t, server.WithListener(lis))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: "server", Dial: lis.DialContext, Username: "mayee", Password: "mayee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Call(ctx, model.NewClientDemo()); err != nil {
+		t.Fatal(err)
+	}
+	if ss := srv.Sessions(); len(ss) != 1 || ss[0].RemoteAddr != "pipe" {
+		t.Fatalf("sessions = %v", ss)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	// 服务端把收到的数据原样发回
+	srv := newServer(t, server.WithHooks(server.Hooks{OnTransfer: func(s *server.Session, tr *transfer.Transfer) {
+		go func() { _ = s.SendTransfer(context.Background(), tr.Name, tr.Data) }()
+	}}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: srv.Addr().String(), Username: "mayee", Password: "mayee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got := make(chan *transfer.Transfer, 1)
+	c.OnTransfer(func(tr *transfer.Transfer) { got <- tr })
+
+	data := make([]byte, model.MaxChunkSize*3+1)
+	rand.Read(data)
+	if err = c.SendTransfer(ctx, "snapshot", data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case tr := <-got:
+		if tr.Name != "snapshot" || !bytes.Equal(tr.Data, data) {
+			t.Fatalf("echo = %s, %d bytes", tr.Name, len(tr.Data))
+		}
+	case <-ctx.Done():
+		t.Fatal("no echo")
+	}
+}
+
+func TestMulticastGapFill(t *testing.T) {
+	// 用本机的 UDP 单播代替组播
+	rconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rconn.Close()
+	wconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wconn.Close()
+	pub, err := multicast.NewPublisher(wconn, rconn.LocalAddr(), "DEMO", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(t, server.WithMulticast(pub))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	c, err := Dial(ctx, Options{Addr: srv.Addr().String(), Username: "mayee", Password: "mayee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got := make(chan uint64, 4)
+	sub := multicast.NewSubscriber(multicast.SubscriberOptions{
+		Session: "DEMO",
+		NextSeq: 1,
+		Request: func(seq uint64, count uint32) error {
+			return c.RequestRetransmit(ctx, "DEMO", seq, count)
+		},
+		OnMessage: func(seq uint64, _ model.Message) { got <- seq },
+	})
+	c.OnRetransmit(sub.Fill)
+
+	// 第 1 个数据报在订阅者读取之前被取走，收到第 2 个后通过 TCP 补发
+	for i := 0; i < 3; i++ {
+		if _, err = pub.Publish(model.NewServerDemo()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = rconn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = rconn.ReadFrom(make([]byte, 1<<16)); err != nil {
+		t.Fatal(err)
+	}
+	_ = rconn.SetReadDeadline(time.Time{})
+	go func() { _ = sub.Serve(ctx, rconn) }()
+	for want := uint64(1); want <= 3; want++ {
+		select {
+		case seq := <-got:
+			if seq != want {
+				t.Fatalf("delivered seq %d, want %d", seq, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("seq %d not delivered", want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"fmt"
+	"net"
+)
+
+// localIP 按 LocalAddr、Interface、LocalCIDR 的顺序确定发起连接的本地 ip，都为空时返回 nil 由系统选择。
+// addr 为要连接的服务端地址，用于选择网卡上 IPv4 还是 IPv6 的地址
+func (o *Options) localIP(network, addr string) (net.IP, error) {
+	switch {
+	case o.LocalAddr != "":
+		ip := net.ParseIP(o.LocalAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local address %q", o.LocalAddr)
+		}
+		return ip, nil
+	case o.Interface != "":
+		return interfaceIP(o.Interface, wantIPv6(network, addr))
+	case o.LocalCIDR != "":
+		return cidrIP(o.LocalCIDR)
+	default:
+		return nil, nil
+	}
+}
+
+// wantIPv6 服务端地址为 IPv6 字面量或 network 为 tcp6 时使用 IPv6 的本地地址，否则优先 IPv4
+func wantIPv6(network, addr string) bool {
+	if network == "tcp6" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// interfaceIP 网卡上的第一个 IPv4(v6 为 true 时为 IPv6)地址，没有时退而使用另一个协议族的地址
+func interfaceIP(name string, v6 bool) (net.IP, error) {
+	itf, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", name, err)
+	}
+	if itf.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %s is down", name)
+	}
+	addrs, err := itf.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", name, err)
+	}
+	var other net.IP
+	for _, a := range addrs {
+		ip := addrIP(a)
+		if ip == nil || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if (ip.To4() == nil) == v6 {
+			return ip, nil
+		}
+		if other == nil {
+			other = ip
+		}
+	}
+	if other == nil {
+		return nil, fmt.Errorf("interface %s has no ip address", name)
+	}
+	return other, nil
+}
+
+// cidrIP 本机已启用的网卡中第一个属于该网段的地址
+func cidrIP(cidr string) (net.IP, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	itfs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var down []string
+	for _, itf := range itfs {
+		addrs, err := itf.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ip := addrIP(a)
+			if ip == nil || !n.Contains(ip) {
+				continue
+			}
+			if itf.Flags&net.FlagUp == 0 {
+				down = append(down, itf.Name)
+				break
+			}
+			return ip, nil
+		}
+	}
+	if len(down) > 0 {
+		return nil, fmt.Errorf("no local address in %s, interface %v is down", cidr, down)
+	}
+	return nil, fmt.Errorf("no local address in %s", cidr)
+}
+
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.IPNet:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
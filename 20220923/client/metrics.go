@@ -0,0 +1,25 @@
+package client
+
+import (
+	"20220923/internal/metrics"
+	"20220923/internal/packet"
+)
+
+// clientMetrics 客户端的登录和心跳指标，数据包的读写由 packet.Metrics 统计
+type clientMetrics struct {
+	packets           *packet.Metrics
+	logins            *metrics.CounterVec
+	heartbeatTimeouts *metrics.Counter
+}
+
+// newClientMetrics r 为 nil 时注册到一个不对外输出的 Registry
+func newClientMetrics(r *metrics.Registry) *clientMetrics {
+	if r == nil {
+		r = metrics.NewRegistry()
+	}
+	return &clientMetrics{
+		packets:           packet.NewMetrics(r, "client"),
+		logins:            r.Counter("client_logins_total", "Login attempts by login response status.", "status"),
+		heartbeatTimeouts: r.Counter("client_heartbeat_timeouts_total", "Connections closed because the server stopped sending.").With(),
+	}
+}
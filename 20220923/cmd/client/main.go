@@ -0,0 +1,172 @@
+package main
+
+import (
+	"20220923/client"
+	"20220923/internal/enum"
+	_ "20220923/internal/log"
+	"20220923/internal/metrics"
+	"20220923/internal/model"
+	"20220923/internal/multicast"
+	"20220923/internal/packet"
+	"context"
+	"errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// 套接字选项
+	var socket packet.SocketOptions
+	if err := viper.UnmarshalKey("client.socket", &socket); err != nil {
+		panic(err)
+	}
+	// Prometheus 指标
+	reg := metrics.NewRegistry()
+	if addr := viper.GetString("client.metrics.addr"); addr != "" {
+		go func() {
+			zap.S().Infof("metrics listening. addr=[%s]", addr)
+			if err := reg.ListenAndServe(ctx, addr, viper.GetString("client.metrics.path")); err != nil {
+				zap.S().Errorf("metrics server failed. addr=[%s], err=[%v]", addr, err)
+			}
+		}()
+	}
+	// 测试方法：客户机电脑同时连上网线和WLAN，这样就有两个网卡地址。然后分别用 local_addr、interface 或 local_cidr 指定其中一个发起 tcp 连接，在服务端观察打印出来的客户端地址。
+	// Linux 可以使用`ip a`命令查看网卡名称；Windows 可以使用`netsh int ipv4 show interfaces`查看网卡名称
+	c, err := client.Dial(ctx, client.Options{
+		Network:   viper.GetString("client.network"),
+		Addr:      viper.GetString("client.addr"),
+		LocalAddr: viper.GetString("client.local_addr"),
+		Interface: viper.GetString("client.interface"),
+		LocalCIDR: viper.GetString("client.local_cidr"),
+		Username:  viper.GetString("client.username"),
+		Password:  viper.GetString("client.password"),
+		Addrs:     viper.GetStringSlice("client.failover_addrs"),
+		Reconnect: viper.GetBool("client.reconnect"),
+
+		HeartbeatInterval:  viper.GetDuration("client.heartbeat_interval"),
+		HeartbeatMaxMissed: viper.GetInt("client.heartbeat_max_missed"),
+		AckInterval:        viper.GetDuration("client.ack_interval"),
+		RetransmitSize:     viper.GetInt("client.retransmit_size"),
+		Socket:             socket,
+		Metrics:            reg,
+		OnStateChange: func(state client.State, err error) {
+			zap.S().Infof("client state changed. state=[%s], err=[%v]", state, err)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	c.Subscribe(enum.MsgTypeServerDemo, func(m model.Message) {
+		zap.S().Info(m.(*model.ServerDemo).String())
+	})
+	topicChannel := uint8(viper.GetUint("client.topic_channel"))
+	for _, topic := range viper.GetStringSlice("client.topics") {
+		if err = c.SubscribeTopicChannel(ctx, topicChannel, topic); err != nil {
+			panic(err)
+		}
+	}
+
+	if group := viper.GetString("client.multicast.group"); group != "" {
+		if err = subscribeMulticast(ctx, c, group); err != nil {
+			panic(err)
+		}
+	}
+
+	// 定时发送示例请求并等待响应
+	t := time.NewTicker(time.Second * 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			callCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+			resp, err := c.Call(callCtx, model.NewClientDemo())
+			cancel()
+			if err != nil {
+				zap.S().Warnf("call failed: %v", err)
+				continue
+			}
+			zap.S().Infof("call response: %s", resp.(*model.ServerDemo).String())
+		case <-c.Done():
+			zap.S().Warnf("disconnect with server: %v", c.Err())
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// subscribeMulticast 接收 UDP 组播，丢失的消息通过 TCP 会话补发
+func subscribeMulticast(ctx context.Context, c *client.Client, group string) error {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return err
+	}
+	var ifi *net.Interface
+	if name := viper.GetString("client.multicast.interface"); name != "" {
+		if ifi, err = net.InterfaceByName(name); err != nil {
+			return err
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp", ifi, addr)
+	if err != nil {
+		return err
+	}
+	session := viper.GetString("client.multicast.session")
+	// 补发请求由单独的 goroutine 发送：Fill 在客户端的读 goroutine 中调用，断线重连期间发送会阻塞读 goroutine。
+	// 队列已满时放弃本次请求，Subscriber 超过 RequestTimeout 后会重新请求
+	requests := make(chan retransmitRequest, 16)
+	go sendRetransmits(ctx, c, session, requests)
+	sub := multicast.NewSubscriber(multicast.SubscriberOptions{
+		Session: session,
+		Request: func(seq uint64, count uint32) error {
+			select {
+			case requests <- retransmitRequest{seq: seq, count: count}:
+				return nil
+			default:
+				return errors.New("retransmit request queue full")
+			}
+		},
+		OnMessage: func(seq uint64, m model.Message) {
+			zap.S().Infof("multicast message. session=[%s], seq=[%d], type=[%d]", session, seq, m.Type())
+		},
+	})
+	c.OnRetransmit(sub.Fill)
+	go func() {
+		defer conn.Close()
+		if err := sub.Serve(ctx, conn); err != nil && ctx.Err() == nil {
+			zap.S().Warnf("multicast receive failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// retransmitRequest 待发送的组播补发请求
+type retransmitRequest struct {
+	seq   uint64
+	count uint32
+}
+
+// sendRetransmits 逐个发送补发请求，每个请求最多等待 1 秒
+func sendRetransmits(ctx context.Context, c *client.Client, session string, requests <-chan retransmitRequest) {
+	for {
+		select {
+		case r := <-requests:
+			rctx, cancel := context.WithTimeout(ctx, time.Second)
+			if err := c.RequestRetransmit(rctx, session, r.seq, r.count); err != nil {
+				zap.S().Warnf("send retransmit request failed. session=[%s], seq=[%d], count=[%d], err=[%v]", session, r.seq, r.count, err)
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
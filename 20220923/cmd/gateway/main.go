@@ -0,0 +1,50 @@
+package main
+
+import (
+	"20220923/client"
+	"20220923/gateway"
+	_ "20220923/internal/log"
+	"context"
+	"errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	g := gateway.New(gateway.Options{
+		Client: client.Options{
+			Addr:               viper.GetString("gateway.server_addr"),
+			HeartbeatInterval:  viper.GetDuration("client.heartbeat_interval"),
+			HeartbeatMaxMissed: viper.GetInt("client.heartbeat_max_missed"),
+			AckInterval:        viper.GetDuration("client.ack_interval"),
+		},
+		Origins:      viper.GetStringSlice("gateway.origins"),
+		LoginTimeout: viper.GetDuration("gateway.login_timeout"),
+	})
+	mux := http.NewServeMux()
+	mux.Handle(viper.GetString("gateway.path"), g.Handler())
+	hs := &http.Server{
+		Addr:              viper.GetString("gateway.addr"),
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		if err := hs.Shutdown(shutdownCtx); err != nil {
+			zap.S().Warnf("shutdown: %v", err)
+		}
+	}()
+	zap.S().Infof("gateway listening. addr=[%s], path=[%s]", hs.Addr, viper.GetString("gateway.path"))
+	if err := hs.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
+}
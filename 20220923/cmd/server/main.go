@@ -0,0 +1,267 @@
+package main
+
+import (
+	"20220923/admin"
+	"20220923/internal/acl"
+	"20220923/internal/enum"
+	"20220923/internal/log"
+	"20220923/internal/metrics"
+	"20220923/internal/model"
+	"20220923/internal/multicast"
+	"20220923/internal/packet"
+	"20220923/internal/transfer"
+	"20220923/server"
+	"context"
+	"errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+)
+
+func main() {
+	mux := server.NewMux()
+	mux.Use(newMiddlewares()...)
+	mux.HandleRequest(enum.MsgTypeClientDemo, clientDemo)
+
+	// 来源 IP 访问控制
+	var aclCfg acl.Config
+	if err := viper.UnmarshalKey("server.acl", &aclCfg); err != nil {
+		panic(err)
+	}
+	a, err := acl.New(aclCfg)
+	if err != nil {
+		panic(err)
+	}
+	// 登录账号
+	var accounts []struct {
+		Username string `mapstructure:"username"`
+		Password string `mapstructure:"password"`
+	}
+	if err := viper.UnmarshalKey("server.users", &accounts); err != nil {
+		panic(err)
+	}
+	users := make(map[string]string, len(accounts))
+	for _, u := range accounts {
+		users[u.Username] = u.Password
+	}
+	// 同一用户重复登录的策略
+	policy, err := server.ParseDuplicatePolicy(viper.GetString("server.session.duplicate"))
+	if err != nil {
+		panic(err)
+	}
+	// 逻辑通道
+	var channels []struct {
+		ID       uint8  `mapstructure:"id"`
+		Name     string `mapstructure:"name"`
+		Priority int    `mapstructure:"priority"`
+		Window   int    `mapstructure:"window"`
+	}
+	if err := viper.UnmarshalKey("server.channels", &channels); err != nil {
+		panic(err)
+	}
+	chCfgs := make([]server.ChannelConfig, 0, len(channels))
+	for _, c := range channels {
+		chCfgs = append(chCfgs, server.ChannelConfig{ID: c.ID, Name: c.Name, Priority: c.Priority, Window: c.Window})
+	}
+	// 套接字选项
+	var socket packet.SocketOptions
+	if err = viper.UnmarshalKey("server.socket", &socket); err != nil {
+		panic(err)
+	}
+	// 发送队列已满时的策略
+	overflow, err := server.ParseOverflowPolicy(viper.GetString("server.session.overflow"))
+	if err != nil {
+		panic(err)
+	}
+
+	// UDP 组播
+	var pub *multicast.Publisher
+	if group := viper.GetString("server.multicast.group"); group != "" {
+		if pub, err = newPublisher(group); err != nil {
+			panic(err)
+		}
+	}
+	// 监听地址，兼容只配置了 server.addr 的旧配置文件
+	addrs := viper.GetStringSlice("server.addrs")
+	if len(addrs) == 0 {
+		if addr := viper.GetString("server.addr"); addr != "" {
+			zap.S().Warnf("server.addr is deprecated, use server.addrs instead. addr=[%s]", addr)
+			addrs = []string{addr}
+		}
+	}
+	reg := metrics.NewRegistry()
+	opts := []server.Option{
+		server.WithMetrics(reg),
+		server.WithNetwork(viper.GetString("server.network")),
+		server.WithAddr(addrs...),
+		server.WithSocket(socket),
+		server.WithAuthenticator(server.StaticUsers(users)),
+		server.WithHandler(mux),
+		server.WithACL(a),
+		server.WithDuplicatePolicy(policy),
+		server.WithQueue(server.QueueConfig{
+			Size:     viper.GetInt("server.session.queue_size"),
+			Overflow: overflow,
+			Timeout:  viper.GetDuration("server.session.overflow_timeout"),
+		}),
+		server.WithAck(viper.GetDuration("server.session.ack_interval"), viper.GetInt("server.session.retransmit_size")),
+		server.WithResumeTTL(viper.GetDuration("server.session.resume_ttl")),
+		server.WithChannels(chCfgs...),
+		server.WithTransfer(transfer.Limits{
+			MaxSize:   viper.GetUint64("server.transfer.max_size"),
+			MaxMemory: viper.GetUint64("server.transfer.max_memory"),
+			MaxActive: viper.GetInt("server.transfer.max_active"),
+			Timeout:   viper.GetDuration("server.transfer.timeout"),
+		}),
+		server.WithHeartbeat(viper.GetDuration("server.heartbeat.interval"), viper.GetInt("server.heartbeat.max_missed")),
+		server.WithHeartbeatLimits(viper.GetDuration("server.heartbeat.min"), viper.GetDuration("server.heartbeat.max")),
+		server.WithLimits(server.Limits{
+			LoginTimeout:  viper.GetDuration("server.limits.login_timeout"),
+			MaxPending:    viper.GetInt("server.limits.max_pending"),
+			ConnRate:      rate.Limit(viper.GetFloat64("server.limits.conn_rate")),
+			ConnBurst:     viper.GetInt("server.limits.conn_burst"),
+			MaxFailures:   viper.GetInt("server.limits.max_failures"),
+			FailureWindow: viper.GetDuration("server.limits.failure_window"),
+			LockoutPeriod: viper.GetDuration("server.limits.lockout"),
+		}),
+	}
+	if pub != nil {
+		opts = append(opts, server.WithMulticast(pub))
+	}
+	srv := server.New(opts...)
+	// 先监听，地址被占用等错误在启动时暴露
+	if err := srv.Listen(); err != nil {
+		panic(err)
+	}
+
+	// 监听 os.Interrupt 信号，收到信号后 ctx 被取消
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	// Prometheus 指标
+	if addr := viper.GetString("server.metrics.addr"); addr != "" {
+		go func() {
+			zap.S().Infof("metrics listening. addr=[%s]", addr)
+			if err := reg.ListenAndServe(ctx, addr, viper.GetString("server.metrics.path")); err != nil {
+				zap.S().Errorf("metrics server failed. addr=[%s], err=[%v]", addr, err)
+			}
+		}()
+	}
+	// 管理接口
+	if addr := viper.GetString("server.admin.addr"); addr != "" {
+		adm := admin.New(srv, admin.Options{
+			Token:   viper.GetString("server.admin.token"),
+			Level:   &log.Level,
+			Metrics: reg,
+		})
+		go func() {
+			zap.S().Infof("admin listening. addr=[%s]", addr)
+			if err := adm.ListenAndServe(ctx, addr); err != nil {
+				zap.S().Errorf("admin server failed. addr=[%s], err=[%v]", addr, err)
+			}
+		}()
+	}
+	if topic := viper.GetString("server.publish.topic"); topic != "" || pub != nil {
+		go publishDemo(ctx, srv, pub, topic, viper.GetDuration("server.publish.interval"))
+	}
+	if pub != nil {
+		go func() { _ = pub.Run(ctx, viper.GetDuration("server.multicast.heartbeat")) }()
+	}
+	// 收到信号后通知会话结束并等待发送完毕，最多等待 10 秒。Serve 不使用 ctx，否则会话没有时间限制
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			zap.S().Warnf("shutdown: %v", err)
+		}
+	}()
+	if err := srv.Serve(context.Background()); err != nil && !errors.Is(err, server.ErrServerClosed) {
+		panic(err)
+	}
+	<-shutdown
+}
+
+// newPublisher 创建 UDP 组播的发布者
+func newPublisher(group string) (*multicast.Publisher, error) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return multicast.NewPublisher(conn, addr, viper.GetString("server.multicast.session"), viper.GetInt("server.multicast.history"))
+}
+
+// publishDemo 定时向主题和组播(不为 nil 时)发布示例消息
+func publishDemo(ctx context.Context, srv *server.Server, pub *multicast.Publisher, topic string, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if topic != "" {
+				if _, err := srv.Publish(ctx, topic, model.NewServerDemo()); err != nil {
+					zap.S().Warnf("publish failed. topic=[%s], err=[%v]", topic, err)
+				}
+			}
+			if pub != nil {
+				if _, err := pub.Publish(model.NewServerDemo()); err != nil {
+					zap.S().Warnf("multicast publish failed. session=[%s], err=[%v]", pub.Session(), err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newMiddlewares 按配置创建中间件
+func newMiddlewares() []server.Middleware {
+	mws := []server.Middleware{server.Recovery(), server.Logging(), server.Timing(handlerMetrics)}
+	// 按用户限制消息类型
+	var rules []struct {
+		Username string   `mapstructure:"username"`
+		MsgTypes []uint16 `mapstructure:"msg_types"`
+	}
+	if err := viper.UnmarshalKey("server.authz", &rules); err != nil {
+		panic(err)
+	}
+	if len(rules) > 0 {
+		perms := make(map[string][]uint16, len(rules))
+		for _, r := range rules {
+			perms[r.Username] = r.MsgTypes
+		}
+		mws = append(mws, server.Authorize(perms))
+	}
+	// 每个用户的消息速率限制
+	if r := viper.GetFloat64("server.ratelimit.rate"); r > 0 {
+		mws = append(mws, server.RateLimit(rate.Limit(r), viper.GetInt("server.ratelimit.burst")))
+	}
+	return mws
+}
+
+// handlerMetrics 各消息类型的处理耗时统计
+var handlerMetrics = server.NewHandlerMetrics()
+
+// clientDemo 响应客户端的示例请求
+func clientDemo(_ context.Context, s *server.Session, _ model.Message) (model.Message, error) {
+	m := model.NewServerDemo()
+	m.Addr.Set([]byte("127.0.0.1"))
+	_, port, _ := net.SplitHostPort(s.LocalAddr().String())
+	p, _ := strconv.Atoi(port)
+	m.Port = uint16(p)
+	m.Remark.Set([]byte("server response: ok"))
+	return m, nil
+}
@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"20220923/client"
+	"20220923/internal/enum"
+	"20220923/internal/model"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const defaultLoginTimeout = time.Second * 10
+
+// Options 网关配置
+type Options struct {
+	Client       client.Options     `comment:"连接 TCP 服务端的配置，Username、Password 取自 WebSocket 客户端的登录消息"`
+	Origins      []string           `comment:"允许的 Origin(如 https://dashboard.example.com)，为空表示不限制"`
+	LoginTimeout time.Duration      `comment:"WebSocket 连接后必须在该时间内发送登录消息，默认 10 秒"`
+	Logger       *zap.SugaredLogger `comment:"默认使用 zap 的全局日志"`
+}
+
+// Gateway WebSocket/JSON 网关。每个 WebSocket 连接以自己的账号登录 TCP 服务端，
+// 消息在两端之间按 model.JSONMessage 格式转换，订阅和取消订阅转发给服务端。
+// 服务端的分片传输和组播补发的消息也原样转发，由 WebSocket 客户端处理
+type Gateway struct {
+	opts   Options
+	log    *zap.SugaredLogger
+	active int64 // 当前的 WebSocket 连接数，使用 atomic 读写
+}
+
+func New(opts Options) *Gateway {
+	if opts.LoginTimeout <= 0 {
+		opts.LoginTimeout = defaultLoginTimeout
+	}
+	g := &Gateway{opts: opts, log: opts.Logger}
+	if g.log == nil {
+		g.log = zap.S()
+	}
+	if g.opts.Client.Logger == nil {
+		g.opts.Client.Logger = g.log
+	}
+	return g
+}
+
+// Handler WebSocket 端点
+func (g *Gateway) Handler() http.Handler {
+	return websocket.Server{Handler: g.serve, Handshake: g.handshake}
+}
+
+// Active 当前的 WebSocket 连接数
+func (g *Gateway) Active() int {
+	return int(atomic.LoadInt64(&g.active))
+}
+
+func (g *Gateway) handshake(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	config.Origin = origin
+	if len(g.opts.Origins) == 0 {
+		return nil
+	}
+	if origin == nil {
+		return errors.New("missing origin")
+	}
+	for _, o := range g.opts.Origins {
+		if u, err := url.Parse(o); err == nil && u.Scheme == origin.Scheme && u.Host == origin.Host {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s not allowed", origin)
+}
+
+func (g *Gateway) serve(ws *websocket.Conn) {
+	atomic.AddInt64(&g.active, 1)
+	defer atomic.AddInt64(&g.active, -1)
+	defer ws.Close()
+	addr := ws.Request().RemoteAddr
+
+	// 第一条消息必须是登录
+	_ = ws.SetReadDeadline(time.Now().Add(g.opts.LoginTimeout))
+	m, err := g.receive(ws)
+	if err != nil {
+		g.log.Warnf("gateway login failed. client_addr=[%s], err=[%v]", addr, err)
+		return
+	}
+	login, ok := m.(*model.Login)
+	if !ok {
+		g.sendError(ws, m.Type(), errors.New("login required"))
+		return
+	}
+	_ = ws.SetReadDeadline(time.Time{})
+
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+	opts := g.opts.Client
+	opts.Username = login.Username.String()
+	opts.Password = login.Password.String()
+	opts.LastSeq = 0
+	opts.Passthrough = true
+	// 服务端按 WebSocket 客户端的 IP 执行连接限制、ACL 和失败锁定，须把网关配置为可信的代理
+	opts.ForwardedFor = clientIP(ws.Request())
+	// 登录成功后服务端可能立即推送消息，回调须在连接之前注册，并等登录响应发给 WebSocket 客户端之后再转发
+	loggedIn := make(chan struct{})
+	opts.OnMessage = func(m model.Message) {
+		select {
+		case <-loggedIn:
+		case <-ctx.Done():
+			return
+		}
+		g.send(ws, m)
+	}
+	c, err := client.Dial(ctx, opts)
+	resp := model.NewLoginResponse()
+	if err != nil {
+		var le *client.LoginError
+		if !errors.As(err, &le) {
+			g.log.Warnf("gateway connect failed. client_addr=[%s], username=[%s], err=[%v]", addr, opts.Username, err)
+			g.sendError(ws, enum.MsgTypeLoginResponse, err)
+			return
+		}
+		resp.SessionStatus = le.Status
+		g.send(ws, resp)
+		return
+	}
+	defer c.Close()
+	g.log.Infof("gateway login. client_addr=[%s], username=[%s]", addr, opts.Username)
+	g.send(ws, resp)
+	close(loggedIn)
+	// 与服务端的连接断开后关闭 WebSocket，使下面的读取返回
+	go func() {
+		select {
+		case <-c.Done():
+			_ = ws.Close()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		m, err := g.receive(ws)
+		if err != nil {
+			var je *jsonError
+			if errors.As(err, &je) {
+				g.sendError(ws, je.msgType, je.err)
+				continue
+			}
+			g.log.Infof("gateway disconnect. client_addr=[%s], username=[%s], err=[%v]", addr, opts.Username, err)
+			return
+		}
+		if err = g.forward(ctx, c, m); err != nil {
+			if errors.Is(err, errLogout) {
+				g.log.Infof("gateway logout. client_addr=[%s], username=[%s]", addr, opts.Username)
+				return
+			}
+			g.sendError(ws, m.Type(), err)
+		}
+	}
+}
+
+var errLogout = errors.New("logout")
+
+// clientIP WebSocket 客户端的 IP
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// forward 把 WebSocket 客户端的消息转发给服务端，协议消息由网关处理
+func (g *Gateway) forward(ctx context.Context, c *client.Client, m model.Message) error {
+	switch m := m.(type) {
+	case *model.Logout:
+		return errLogout
+	case *model.Subscribe:
+		return c.SubscribeTopic(ctx, m.Topic.String())
+	case *model.Unsubscribe:
+		return c.UnsubscribeTopic(ctx, m.Topic.String())
+	case *model.HeartBeat, *model.HeartBeatEcho:
+		// 网关与服务端之间有自己的心跳
+		return nil
+	case *model.Login, *model.LoginResponse, *model.EndOfSession, *model.Ack, *model.ForwardedFor:
+		return fmt.Errorf("message type %d not allowed", m.Type())
+	default:
+		return c.Send(ctx, m)
+	}
+}
+
+// jsonError 消息格式错误，连接可以继续使用
+type jsonError struct {
+	msgType uint16
+	err     error
+}
+
+func (e *jsonError) Error() string {
+	return e.err.Error()
+}
+
+func (g *Gateway) receive(ws *websocket.Conn) (model.Message, error) {
+	var jm model.JSONMessage
+	if err := websocket.JSON.Receive(ws, &jm); err != nil {
+		return nil, err
+	}
+	m, err := jm.Message()
+	if err != nil {
+		return nil, &jsonError{msgType: jm.Type, err: err}
+	}
+	return m, nil
+}
+
+func (g *Gateway) send(ws *websocket.Conn, m model.Message) {
+	b, err := model.MarshalJSON(m)
+	if err != nil {
+		g.log.Warnf("gateway encode failed. msg_type=[%d], err=[%v]", m.Type(), err)
+		return
+	}
+	if err = websocket.Message.Send(ws, string(b)); err != nil {
+		g.log.Debugf("gateway send failed. client_addr=[%s], err=[%v]", ws.Request().RemoteAddr, err)
+	}
+}
+
+func (g *Gateway) sendError(ws *websocket.Conn, msgType uint16, err error) {
+	_ = websocket.JSON.Send(ws, model.JSONMessage{Type: msgType, Error: err.Error()})
+}
@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"20220923/client"
+	"20220923/internal/enum"
+	"20220923/internal/model"
+	"20220923/server"
+	"context"
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	mux := server.NewMux()
+	mux.HandleRequest(enum.MsgTypeClientDemo, func(context.Context, *server.Session, model.Message) (model.Message, error) {
+		m := model.NewServerDemo()
+		m.Remark.Set([]byte("ok"))
+		return m, nil
+	})
+	srv := server.New(
+		server.WithAddr("127.0.0.1:0"),
+		server.WithAuthenticator(server.StaticUsers(map[string]string{"mayee": "mayee"})),
+		server.WithHandler(mux),
+		// 登录后立即推送的消息和分片传输也转发给 WebSocket 客户端
+		server.WithHooks(server.Hooks{OnLogin: func(s *server.Session) {
+			_ = s.Write(context.Background(), model.NewServerDemo())
+			_ = s.SendTransfer(context.Background(), "welcome", []byte("hello"))
+		}}),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+
+	g := New(Options{Client: client.Options{Addr: srv.Addr().String()}})
+	hs := httptest.NewServer(g.Handler())
+	defer hs.Close()
+	dial := func() *websocket.Conn {
+		t.Helper()
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(hs.URL, "http"), "", hs.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = ws.SetDeadline(time.Now().Add(time.Second * 3))
+		return ws
+	}
+	send := func(ws *websocket.Conn, s string) {
+		t.Helper()
+		if err := websocket.Message.Send(ws, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(ws *websocket.Conn) model.JSONMessage {
+		t.Helper()
+		var jm model.JSONMessage
+		if err := websocket.JSON.Receive(ws, &jm); err != nil {
+			t.Fatal(err)
+		}
+		return jm
+	}
+
+	// 账号由服务端校验
+	ws := dial()
+	send(ws, `{"type":101,"data":{"Username":"mayee","Password":"wrong"}}`)
+	if jm := receive(ws); jm.Type != enum.MsgTypeLoginResponse || !strings.Contains(string(jm.Data), `"SessionStatus":5`) {
+		t.Fatalf("wrong password: %+v", jm)
+	}
+	ws.Close()
+
+	ws = dial()
+	defer ws.Close()
+	send(ws, `{"type":101,"data":{"Username":"mayee","Password":"mayee"}}`)
+	if jm := receive(ws); jm.Type != enum.MsgTypeLoginResponse || !strings.Contains(string(jm.Data), `"SessionStatus":0`) {
+		t.Fatalf("login: %+v", jm)
+	}
+	pushed := make(map[uint16]bool)
+	for i := 0; i < 4; i++ {
+		pushed[receive(ws).Type] = true
+	}
+	for _, typ := range []uint16{enum.MsgTypeServerDemo, enum.MsgTypeTransferStart, enum.MsgTypeTransferChunk, enum.MsgTypeTransferEnd} {
+		if !pushed[typ] {
+			t.Fatalf("message type %d not forwarded, got %v", typ, pushed)
+		}
+	}
+	// 未知的消息类型返回错误，连接可以继续使用
+	send(ws, `{"type":9999}`)
+	if jm := receive(ws); jm.Type != 9999 || jm.Error == "" {
+		t.Fatalf("unknown type: %+v", jm)
+	}
+	send(ws, `{"type":99,"data":{"CorrID":7}}`)
+	jm := receive(ws)
+	var resp struct {
+		CorrID uint32
+		Remark string
+	}
+	if err := json.Unmarshal(jm.Data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if jm.Type != enum.MsgTypeServerDemo || jm.Name != "ServerDemo" || resp.CorrID != 7 || resp.Remark != "ok" {
+		t.Fatalf("response: %+v, %s", jm, jm.Data)
+	}
+
+	// 订阅转发给服务端
+	send(ws, `{"type":105,"data":{"Topic":"demo"}}`)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	for {
+		n, err := srv.Publish(context.Background(), "demo", model.NewServerDemo())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("subscription not forwarded")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	if jm = receive(ws); jm.Type != enum.MsgTypeServerDemo {
+		t.Fatalf("published: %+v", jm)
+	}
+}
@@ -5,8 +5,10 @@ go 1.18
 require (
 	github.com/spf13/viper v1.13.0
 	go.uber.org/zap v1.23.0
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b
 	golang.org/x/sync v0.0.0-20220907140024-f12130a52804
 	golang.org/x/text v0.3.7
+	golang.org/x/time v0.3.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
 
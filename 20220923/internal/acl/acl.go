@@ -0,0 +1,180 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Rule 一组 CIDR 白名单与黑名单。元素可以是 CIDR(如 10.0.0.0/8、fd00::/8)，也可以是单个 IP
+type Rule struct {
+	Allow []string `mapstructure:"allow" comment:"白名单，为空表示不限制"`
+	Deny  []string `mapstructure:"deny" comment:"黑名单，优先级高于白名单"`
+}
+
+// UserRule 针对某个用户的规则
+type UserRule struct {
+	Username string `mapstructure:"username"`
+	Rule     `mapstructure:",squash"`
+}
+
+// Config 对应配置文件中的 [server.acl]
+type Config struct {
+	Rule    `mapstructure:",squash"`
+	Users   []UserRule `mapstructure:"users"`
+	Proxies []string   `mapstructure:"proxies" comment:"可信的网关地址，来自这些地址的连接可以通过 ForwardedFor 告知客户端的来源 IP"`
+	// 本机连接(Unix 域套接字、内存连接)没有 IP，默认与其他连接一样校验，有规则时被拒绝。
+	// 为 true 时不校验全局规则，由文件权限或进程自身控制访问；设置了规则的用户仍然不能通过本机连接登录
+	TrustLocal bool `mapstructure:"trust_local"`
+}
+
+type list struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// ACL 客户端来源 IP 的访问控制。全局规则在 accept 和登录时都会校验，用户规则只在登录时校验。
+// ip 为 nil 表示没有 IP 的本机连接
+type ACL struct {
+	global     list
+	users      map[string]list
+	proxies    []*net.IPNet
+	trustLocal bool
+}
+
+func New(cfg Config) (*ACL, error) {
+	a := &ACL{users: make(map[string]list), trustLocal: cfg.TrustLocal}
+	var err error
+	if a.global, err = newList(cfg.Rule); err != nil {
+		return nil, err
+	}
+	for _, u := range cfg.Users {
+		l, err := newList(u.Rule)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", u.Username, err)
+		}
+		a.users[u.Username] = l
+	}
+	if a.proxies, err = parseNets(cfg.Proxies); err != nil {
+		return nil, fmt.Errorf("proxies: %w", err)
+	}
+	return a, nil
+}
+
+// Accept 校验全局规则，在 accept 连接后立即调用
+func (a *ACL) Accept(ip net.IP) error {
+	if a == nil || (ip == nil && a.trustLocal) {
+		return nil
+	}
+	return a.global.check(ip)
+}
+
+// Login 校验全局规则以及该用户的规则
+func (a *ACL) Login(username string, ip net.IP) error {
+	if a == nil {
+		return nil
+	}
+	if err := a.Accept(ip); err != nil {
+		return err
+	}
+	if l, ok := a.users[username]; ok {
+		if err := l.check(ip); err != nil {
+			return fmt.Errorf("user %s: %w", username, err)
+		}
+	}
+	return nil
+}
+
+// Proxy ip 是否为可信的网关
+func (a *ACL) Proxy(ip net.IP) bool {
+	if a == nil || ip == nil {
+		return false
+	}
+	for _, n := range a.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l list) check(ip net.IP) error {
+	if len(l.allow) == 0 && len(l.deny) == 0 {
+		return nil
+	}
+	if ip == nil {
+		return fmt.Errorf("unknown ip address")
+	}
+	for _, n := range l.deny {
+		if n.Contains(ip) {
+			return fmt.Errorf("ip %s denied by %s", ip, n)
+		}
+	}
+	if len(l.allow) == 0 {
+		return nil
+	}
+	for _, n := range l.allow {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("ip %s not in allowlist", ip)
+}
+
+func newList(r Rule) (list, error) {
+	var l list
+	var err error
+	if l.allow, err = parseNets(r.Allow); err != nil {
+		return l, err
+	}
+	if l.deny, err = parseNets(r.Deny); err != nil {
+		return l, err
+	}
+	return l, nil
+}
+
+func parseNets(ss []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ss))
+	for _, s := range ss {
+		s = strings.TrimSpace(s)
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+			continue
+		}
+		// 单个 IP 视为 /32 或 /128
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	return nets, nil
+}
+
+// AddrIP 从连接地址中取出 IP，兼容 IPv4 和 IPv6。非 IP 类型的地址(如 unix socket)返回 nil
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
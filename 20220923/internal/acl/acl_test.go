@@ -0,0 +1,100 @@
+package acl
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	a, err := New(Config{
+		Rule: Rule{
+			Allow: []string{"127.0.0.0/8", "10.0.0.0/8", "::1", "fd00::/8"},
+			Deny:  []string{"10.1.0.0/16"},
+		},
+		Users: []UserRule{
+			{Username: "mayee", Rule: Rule{Allow: []string{"127.0.0.1", "fd00::1"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		user   string
+		ip     string
+		accept bool
+		login  bool
+	}{
+		{"mayee", "127.0.0.1", true, true},
+		{"mayee", "127.0.0.2", true, false},
+		{"other", "127.0.0.2", true, true},
+		{"other", "10.1.2.3", false, false},
+		{"other", "192.168.1.1", false, false},
+		{"other", "::1", true, true},
+		{"mayee", "::1", true, false},
+		{"mayee", "fd00::1", true, true},
+		{"mayee", "::ffff:127.0.0.1", true, true}, // IPv4-mapped IPv6
+	}
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		if err := a.Accept(ip); (err == nil) != c.accept {
+			t.Errorf("Accept(%s) = %v, want accept=%v", c.ip, err, c.accept)
+		}
+		if err := a.Login(c.user, ip); (err == nil) != c.login {
+			t.Errorf("Login(%s, %s) = %v, want login=%v", c.user, c.ip, err, c.login)
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	cfg := Config{
+		Rule:  Rule{Allow: []string{"10.0.0.0/8"}},
+		Users: []UserRule{{Username: "mayee", Rule: Rule{Allow: []string{"10.0.0.1"}}}},
+	}
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Accept(nil); err == nil {
+		t.Fatal("local connection accepted without TrustLocal")
+	}
+	cfg.TrustLocal = true
+	if a, err = New(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Login("other", nil); err != nil {
+		t.Fatalf("Login(other, local) = %v", err)
+	}
+	// 用户规则不因 TrustLocal 跳过
+	if err = a.Login("mayee", nil); err == nil {
+		t.Fatal("user rule skipped for local connection")
+	}
+	// 没有规则时不限制
+	if a, err = New(Config{}); err != nil || a.Accept(nil) != nil {
+		t.Fatalf("empty acl: %v", err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	a, err := New(Config{Proxies: []string{"10.0.0.1", "fd00::/64"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{"10.0.0.1": true, "10.0.0.2": false, "fd00::1": true, "fd01::1": false} {
+		if got := a.Proxy(net.ParseIP(ip)); got != want {
+			t.Errorf("Proxy(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if _, err = New(Config{Proxies: []string{"gateway"}}); err == nil {
+		t.Fatal("invalid proxy accepted")
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 30001}
+	if ip := AddrIP(addr); !ip.Equal(net.ParseIP("::1")) {
+		t.Errorf("AddrIP(%s) = %s", addr, ip)
+	}
+	if ip := AddrIP(&net.UnixAddr{Name: "/tmp/s.sock", Net: "unix"}); ip != nil {
+		t.Errorf("AddrIP(unix) = %s, want nil", ip)
+	}
+}
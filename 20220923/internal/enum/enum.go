@@ -1,9 +1,65 @@
 package enum
 
 const (
-	MsgTypeClientDemo    = 99  // 客户端示例请求
-	MsgTypeServerDemo    = 100 // 服务端端示例响应
-	MsgTypeLogin         = 101 // 登录
-	MsgTypeLoginResponse = 102 // 登录响应
-	MsgTypeHeartBeat     = 110 // 心跳
+	MsgTypeClientDemo         = 99  // 客户端示例请求
+	MsgTypeServerDemo         = 100 // 服务端端示例响应
+	MsgTypeLogin              = 101 // 登录
+	MsgTypeLoginResponse      = 102 // 登录响应
+	MsgTypeLogout             = 103 // 客户端登出
+	MsgTypeEndOfSession       = 104 // 服务端结束会话
+	MsgTypeSubscribe          = 105 // 订阅主题
+	MsgTypeUnsubscribe        = 106 // 取消订阅主题
+	MsgTypeAck                = 107 // 确认已处理的业务消息
+	MsgTypeTransferStart      = 108 // 开始分片传输
+	MsgTypeTransferChunk      = 109 // 分片传输的数据
+	MsgTypeHeartBeat          = 110 // 心跳
+	MsgTypeTransferEnd        = 111 // 结束分片传输
+	MsgTypeTransferCancel     = 112 // 取消分片传输
+	MsgTypeRetransmitRequest  = 113 // 请求补发 UDP 组播的消息
+	MsgTypeRetransmitResponse = 114 // 补发 UDP 组播的消息
+	MsgTypeAdminMessage       = 115 // 管理员广播的通知
+	MsgTypeForwardedFor       = 116 // 网关代替客户端登录时转发客户端的来源 IP
+	MsgTypeHeartBeatEcho      = 117 // 回显对端发送时间的心跳，登录时协商后代替 HeartBeat
+)
+
+// 登录响应中的会话状态
+const (
+	SessionStatusActive           = 0   // 会话已建立
+	SessionStatusInvalid          = 5   // 用户名或 IP 地址无效
+	SessionStatusLoginTimeout     = 6   // 未在规定时间内登录
+	SessionStatusBusy             = 7   // 未登录的连接过多
+	SessionStatusRateLimited      = 8   // 同一 IP 连接过于频繁
+	SessionStatusLocked           = 9   // 登录失败次数过多，IP 被暂时锁定
+	SessionStatusAlreadyConnected = 100 // 用户已连接
+)
+
+// 登录响应中服务端支持的功能，按位组合。旧版本的服务端为 0
+const (
+	FeatureHeartBeatEcho = 1 << 0 // 接受 HeartBeatEcho；服务端收到客户端的 HeartBeatEcho 之后也改用它
+)
+
+// 服务端结束会话的原因
+const (
+	EndOfSessionShutdown = 1 // 服务端关闭
+)
+
+// 取消分片传输的原因
+const (
+	TransferCancelSender   = 1 // 发送方取消
+	TransferCancelTooLarge = 2 // 超过接收方的大小或内存限制
+	TransferCancelChecksum = 3 // 校验和不一致
+	TransferCancelInvalid  = 4 // 分片的偏移量或长度错误
+)
+
+// TransferCancel 的发出方，双方的传输 ID 各自分配，须结合发出方判断取消的是哪个方向的传输
+const (
+	TransferOriginSender   = 0 // 发送方取消自己发出的传输
+	TransferOriginReceiver = 1 // 接收方拒绝对方发来的传输
+)
+
+// 补发 UDP 组播消息的结果
+const (
+	RetransmitStatusOK             = 0 // 成功，响应之后是补发的消息
+	RetransmitStatusUnknownSession = 1 // 服务端没有该组播会话
+	RetransmitStatusUnavailable    = 2 // 消息已不在服务端的历史记录中，无法补发
 )
@@ -0,0 +1,100 @@
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTimeout 连续多个心跳间隔都没有收到对端的消息
+var ErrTimeout = errors.New("heartbeat: peer timeout")
+
+const DefaultMaxMissed = 3
+
+// Heartbeat 客户端和服务端共用的心跳：每隔 interval 发送一次心跳，连续 maxMissed 个间隔没有收到对端的消息则判定对端失联
+type Heartbeat struct {
+	interval  time.Duration
+	maxMissed int
+	beat      chan struct{}
+	last      int64 // 最近一次收到对端消息的时间(毫秒级时间戳)，使用 atomic 读写
+}
+
+func New(interval time.Duration, maxMissed int) *Heartbeat {
+	if maxMissed <= 0 {
+		maxMissed = DefaultMaxMissed
+	}
+	return &Heartbeat{
+		interval:  interval,
+		maxMissed: maxMissed,
+		beat:      make(chan struct{}, 1),
+		last:      time.Now().UnixMilli(),
+	}
+}
+
+// Interval 心跳间隔
+func (h *Heartbeat) Interval() time.Duration {
+	return h.interval
+}
+
+// Timeout 判定对端失联的时间
+func (h *Heartbeat) Timeout() time.Duration {
+	return h.interval * time.Duration(h.maxMissed)
+}
+
+// Beat 收到对端的消息时调用，重置超时
+func (h *Heartbeat) Beat() {
+	atomic.StoreInt64(&h.last, time.Now().UnixMilli())
+	select {
+	case h.beat <- struct{}{}:
+	default:
+	}
+}
+
+// LastBeat 最近一次收到对端消息的时间
+func (h *Heartbeat) LastBeat() time.Time {
+	return time.UnixMilli(atomic.LoadInt64(&h.last))
+}
+
+// Run 定时调用 send 发送心跳，直到 ctx 结束(返回 nil)、send 返回错误或对端超时(返回 ErrTimeout)
+func (h *Heartbeat) Run(ctx context.Context, send func() error) error {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	timer := time.NewTimer(h.Timeout())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := send(); err != nil {
+				return err
+			}
+		case <-h.beat:
+			// 重置心跳超时
+			if !timer.Stop() {
+				select {
+				case <-timer.C: // 确保定时器中的 channel 被排空
+				default:
+				}
+			}
+			timer.Reset(h.Timeout())
+		case <-timer.C:
+			return ErrTimeout
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Negotiate 按照 [min, max] 修正对端请求的心跳间隔，请求为 0 时使用 def
+func Negotiate(requested, def, min, max time.Duration) time.Duration {
+	if requested <= 0 {
+		return def
+	}
+	if min > 0 && requested < min {
+		return min
+	}
+	if max > 0 && requested > max {
+		return max
+	}
+	return requested
+}
@@ -0,0 +1,65 @@
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	h := New(time.Millisecond*10, 3)
+	var sent int32
+	start := time.Now()
+	err := h.Run(context.Background(), func() error {
+		atomic.AddInt32(&sent, 1)
+		return nil
+	})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Run = %v, want ErrTimeout", err)
+	}
+	if cost := time.Since(start); cost < h.Timeout() {
+		t.Fatalf("timeout after %s, want >= %s", cost, h.Timeout())
+	}
+	if n := atomic.LoadInt32(&sent); n < 2 {
+		t.Fatalf("sent %d heartbeats", n)
+	}
+}
+
+func TestBeat(t *testing.T) {
+	h := New(time.Millisecond*10, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	// 对端持续发送心跳，不应超时
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 10)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.Beat()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if err := h.Run(ctx, func() error { return nil }); err != nil {
+		t.Fatalf("Run = %v", err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	def, min, max := time.Second*5, time.Second, time.Minute
+	cases := map[time.Duration]time.Duration{
+		0:                      def,
+		time.Millisecond * 100: min,
+		time.Second * 10:       time.Second * 10,
+		time.Hour:              max,
+	}
+	for req, want := range cases {
+		if got := Negotiate(req, def, min, max); got != want {
+			t.Errorf("Negotiate(%s) = %s, want %s", req, got, want)
+		}
+	}
+}
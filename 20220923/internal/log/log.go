@@ -11,6 +11,9 @@ import (
 
 const logTimeFmt = "2006-01-02 15:04:05.000"
 
+// Level 全局日志的级别，可以在运行时修改，如通过管理接口的 /loglevel
+var Level = zap.NewAtomicLevel()
+
 // 指定配置文件位置。应该写在各启动服务中，为了简化写在这里
 func init() {
 	initConfig()
@@ -52,6 +55,8 @@ func initLog() {
 		}
 	}
 
+	Level.SetLevel(level)
+
 	ws := make([]zapcore.WriteSyncer, 0)
 	// 日志写入控制台
 	ws = append(ws, zapcore.AddSync(os.Stdout))
@@ -71,7 +76,7 @@ func initLog() {
 	core := zapcore.NewCore(
 		zapcore.NewConsoleEncoder(cfg),
 		zap.CombineWriteSyncers(ws...),
-		zap.NewAtomicLevelAt(level),
+		Level,
 	)
 	defer core.Sync()
 
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// clockSamples 时钟偏差保留的样本个数
+const clockSamples = 8
+
+// Clock 根据心跳的往返估算对端与本端的时钟偏差，算法同 NTP：
+// 本端 t1 发出、对端 t2 收到、对端 t3 回复、本端 t4 收到，往返时间 = (t4-t1) - (t3-t2)，偏差 = ((t2-t1) + (t3-t4)) / 2。
+// 排队等延迟使样本的误差不超过往返时间的一半，所以取最近几个样本中往返时间最小的一个
+type Clock struct {
+	mu      sync.Mutex
+	samples [clockSamples]ClockSample
+	n       int
+	next    int
+}
+
+// ClockSample 一次往返的测量结果
+type ClockSample struct {
+	Offset time.Duration `comment:"对端时钟减去本端时钟，正数表示对端的时钟快"`
+	RTT    time.Duration `comment:"往返时间，不含对端的处理时间"`
+	Time   time.Time     `comment:"测量的时间"`
+}
+
+// Observe 记录一次往返，t1、t4 为本端时钟，t2、t3 为对端时钟
+func (c *Clock) Observe(t1, t2, t3, t4 time.Time) ClockSample {
+	rtt := t4.Sub(t1) - t3.Sub(t2)
+	if rtt < 0 {
+		rtt = 0
+	}
+	s := ClockSample{
+		Offset: (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		RTT:    rtt,
+		Time:   t4,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples[c.next] = s
+	c.next = (c.next + 1) % clockSamples
+	if c.n < clockSamples {
+		c.n++
+	}
+	return s
+}
+
+// Estimate 当前的估计值，没有样本时 ok 为 false
+func (c *Clock) Estimate() (s ClockSample, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < c.n; i++ {
+		if !ok || c.samples[i].RTT < s.RTT {
+			s = c.samples[i]
+			ok = true
+		}
+	}
+	return s, ok
+}
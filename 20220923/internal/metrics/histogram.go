@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBounds 默认的延迟分布桶上界。数据包的发送时间精确到毫秒，更细的桶没有意义
+var DefaultLatencyBounds = []time.Duration{
+	time.Millisecond,
+	time.Millisecond * 2,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 20,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 200,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 2,
+	time.Second * 5,
+}
+
+// Histogram 耗时的分布，桶的上界在创建时固定，并发安全
+type Histogram struct {
+	bounds []time.Duration
+	counts []uint64 // 落在各个桶中的个数，最后一个桶没有上界
+
+	// 以下字段使用 atomic 读写
+	count uint64
+	sum   int64 // 纳秒
+	max   int64 // 纳秒
+}
+
+// NewHistogram bounds 为递增的桶上界，为空时使用 DefaultLatencyBounds
+func NewHistogram(bounds ...time.Duration) *Histogram {
+	if len(bounds) == 0 {
+		bounds = DefaultLatencyBounds
+	}
+	bs := append([]time.Duration(nil), bounds...)
+	sort.Slice(bs, func(i, j int) bool { return bs[i] < bs[j] })
+	return &Histogram{
+		bounds: bs,
+		counts: make([]uint64, len(bs)+1),
+	}
+}
+
+// Observe 记录一个耗时，负数(如两端时钟不一致)按 0 记录
+func (h *Histogram) Observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(d)) {
+			return
+		}
+	}
+}
+
+// Snapshot 当前分布的副本。各字段分别读取，并发写入时彼此之间可能有细微的不一致
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.counts)),
+		Count:  atomic.LoadUint64(&h.count),
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)),
+		Max:    time.Duration(atomic.LoadInt64(&h.max)),
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return s
+}
+
+// HistogramSnapshot 耗时分布的快照
+type HistogramSnapshot struct {
+	Bounds []time.Duration `comment:"各个桶的上界"`
+	Counts []uint64        `comment:"落在各个桶中的个数(非累计)，比 Bounds 多一个没有上界的桶"`
+	Count  uint64
+	Sum    time.Duration
+	Max    time.Duration
+}
+
+// Mean 平均值
+func (s HistogramSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Quantile 分位数(q 为 0~1)的估计值，取所在桶的上界；落在最后一个桶时取最大值
+func (s HistogramSnapshot) Quantile(q float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(s.Count))
+	if rank == 0 {
+		rank = 1
+	}
+	var n uint64
+	for i, c := range s.Counts {
+		n += c
+		if n < rank {
+			continue
+		}
+		if i < len(s.Bounds) && s.Bounds[i] < s.Max {
+			return s.Bounds[i]
+		}
+		return s.Max
+	}
+	return s.Max
+}
+
+// String 便于日志输出
+func (s HistogramSnapshot) String() string {
+	return fmt.Sprintf("count=%d, mean=%s, p50=%s, p99=%s, max=%s", s.Count, s.Mean(), s.Quantile(0.5), s.Quantile(0.99), s.Max)
+}
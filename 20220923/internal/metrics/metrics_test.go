@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(time.Millisecond, time.Millisecond*10, time.Millisecond*100)
+	for i := 0; i < 90; i++ {
+		h.Observe(time.Millisecond * 5)
+	}
+	for i := 0; i < 9; i++ {
+		h.Observe(time.Millisecond * 50)
+	}
+	h.Observe(time.Second)
+	h.Observe(-time.Millisecond)
+
+	s := h.Snapshot()
+	if s.Count != 101 || s.Max != time.Second {
+		t.Fatalf("count = %d, max = %s", s.Count, s.Max)
+	}
+	if want := []uint64{1, 90, 9, 1}; len(s.Counts) != len(want) {
+		t.Fatalf("counts = %v", s.Counts)
+	} else {
+		for i := range want {
+			if s.Counts[i] != want[i] {
+				t.Fatalf("counts = %v, want %v", s.Counts, want)
+			}
+		}
+	}
+	if q := s.Quantile(0.5); q != time.Millisecond*10 {
+		t.Fatalf("p50 = %s", q)
+	}
+	if q := s.Quantile(0.99); q != time.Millisecond*100 {
+		t.Fatalf("p99 = %s", q)
+	}
+	if q := s.Quantile(1); q != time.Second {
+		t.Fatalf("p100 = %s", q)
+	}
+	if m := s.Mean(); m != (time.Millisecond*(90*5+9*50)+time.Second)/101 {
+		t.Fatalf("mean = %s", m)
+	}
+}
+
+func TestClock(t *testing.T) {
+	var c Clock
+	if _, ok := c.Estimate(); ok {
+		t.Fatal("estimate without samples")
+	}
+	// 对端时钟快 1 秒，单程 10 毫秒，对端处理 5 毫秒
+	base := time.Now()
+	offset := time.Second
+	t1 := base
+	t2 := base.Add(time.Millisecond * 10).Add(offset)
+	t3 := t2.Add(time.Millisecond * 5)
+	t4 := base.Add(time.Millisecond * 25)
+	s := c.Observe(t1, t2, t3, t4)
+	if s.Offset != offset || s.RTT != time.Millisecond*20 {
+		t.Fatalf("sample = %+v", s)
+	}
+	// 去程排队 100 毫秒的样本误差大，往返时间也大，不会被选中
+	c.Observe(t1, t2.Add(time.Millisecond*100), t3.Add(time.Millisecond*100), t4.Add(time.Millisecond*100))
+	if est, ok := c.Estimate(); !ok || est.Offset != offset || est.RTT != time.Millisecond*20 {
+		t.Fatalf("estimate = %+v, %v", est, ok)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_messages_total", "Messages.", "direction", "msg_type")
+	c.With("in", "101").Inc()
+	c.With("out", "102").Add(2)
+	// 重复注册返回同一个指标
+	r.Counter("test_messages_total", "Messages.", "direction", "msg_type").With("in", "101").Inc()
+	r.Gauge("test_depth", "Depth.").With().Set(1.5)
+	r.GaugeFunc("test_sessions", "Sessions.", func() float64 { return 3 })
+	h := r.Histogram("test_write_duration_seconds", "Write.", []time.Duration{time.Millisecond, time.Second}).With()
+	h.Observe(time.Millisecond / 2)
+	h.Observe(time.Second * 2)
+	r.Counter("test_escaped_total", "", "name").With("a\"b\\c\n").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	want := `# HELP test_messages_total Messages.
+# TYPE test_messages_total counter
+test_messages_total{direction="in",msg_type="101"} 2
+test_messages_total{direction="out",msg_type="102"} 2
+# HELP test_depth Depth.
+# TYPE test_depth gauge
+test_depth 1.5
+# HELP test_sessions Sessions.
+# TYPE test_sessions gauge
+test_sessions 3
+# HELP test_write_duration_seconds Write.
+# TYPE test_write_duration_seconds histogram
+test_write_duration_seconds_bucket{le="0.001"} 1
+test_write_duration_seconds_bucket{le="1"} 1
+test_write_duration_seconds_bucket{le="+Inf"} 2
+test_write_duration_seconds_sum 2.0005
+test_write_duration_seconds_count 2
+# TYPE test_escaped_total counter
+test_escaped_total{name="a\"b\\c\n"} 1
+`
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type = %s", ct)
+	}
+}
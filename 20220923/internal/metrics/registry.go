@@ -0,0 +1,348 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry 一组指标，按 Prometheus 文本格式输出。同名的指标只注册一次，重复注册返回已有的指标，
+// 所以多个服务端或客户端可以共用一个 Registry
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*entry
+	order   []*entry
+}
+
+type entry struct {
+	name string
+	help string
+	c    collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*entry)}
+}
+
+type collector interface {
+	kind() string
+	write(w *bufio.Writer, name string)
+}
+
+// register 取出已注册的同名指标，类型不一致时 panic
+func (r *Registry) register(name, help string, c collector) collector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.metrics[name]; ok {
+		if old.c.kind() != c.kind() {
+			panic(fmt.Sprintf("metrics: %s registered as %s", name, old.c.kind()))
+		}
+		return old.c
+	}
+	e := &entry{name: name, help: help, c: c}
+	r.metrics[name] = e
+	r.order = append(r.order, e)
+	return c
+}
+
+// Counter 单调递增的计数器，labels 为标签名
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return r.register(name, help, &CounterVec{vec: newVec(labels)}).(*CounterVec)
+}
+
+// Gauge 可增可减的数值
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return r.register(name, help, &GaugeVec{vec: newVec(labels)}).(*GaugeVec)
+}
+
+// GaugeFunc 输出时调用 fn 取值，如队列长度、在线会话数。重复注册时保留第一个 fn
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(name, help, gaugeFunc(fn))
+}
+
+// Histogram 耗时分布，以秒为单位输出。bounds 为空时使用 DefaultLatencyBounds
+func (r *Registry) Histogram(name, help string, bounds []time.Duration, labels ...string) *HistogramVec {
+	return r.register(name, help, &HistogramVec{vec: newVec(labels), bounds: bounds}).(*HistogramVec)
+}
+
+// WritePrometheus 按注册顺序以 Prometheus 文本格式输出所有指标
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	es := append([]*entry(nil), r.order...)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, e := range es {
+		if e.help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", e.name, escapeHelp(e.help))
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", e.name, e.c.kind())
+		e.c.write(bw, e.name)
+	}
+	return bw.Flush()
+}
+
+// Handler 输出指标的 HTTP 处理函数，通常挂在 /metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WritePrometheus(w)
+	})
+}
+
+// ListenAndServe 在 addr 上提供 HTTP 指标接口，path 为空时为 /metrics。ctx 结束时关闭并返回 nil
+func (r *Registry) ListenAndServe(ctx context.Context, addr, path string) error {
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, r.Handler())
+	hs := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = hs.Close()
+		case <-stop:
+		}
+	}()
+	if err := hs.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// vec 按标签值保存子指标
+type vec struct {
+	labels []string
+	mu     sync.RWMutex
+	items  map[string]interface{}
+	keys   []string
+	values map[string][]string
+}
+
+func newVec(labels []string) vec {
+	return vec{
+		labels: labels,
+		items:  make(map[string]interface{}),
+		values: make(map[string][]string),
+	}
+}
+
+// get 取出标签值对应的子指标，没有时用 create 创建。标签值的个数必须与标签名一致
+func (v *vec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %d label values for labels %v", len(values), v.labels))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	item, ok := v.items[key]
+	v.mu.RUnlock()
+	if ok {
+		return item
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if item, ok = v.items[key]; ok {
+		return item
+	}
+	item = create()
+	v.items[key] = item
+	v.keys = append(v.keys, key)
+	v.values[key] = append([]string(nil), values...)
+	return item
+}
+
+// each 按标签值排序遍历子指标
+func (v *vec) each(fn func(labels string, item interface{})) {
+	v.mu.RLock()
+	keys := append([]string(nil), v.keys...)
+	v.mu.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		v.mu.RLock()
+		item, values := v.items[key], v.values[key]
+		v.mu.RUnlock()
+		fn(formatLabels(v.labels, values), item)
+	}
+}
+
+// CounterVec 带标签的计数器
+type CounterVec struct {
+	vec
+}
+
+// Counter 计数器，并发安全
+type Counter struct {
+	n uint64
+}
+
+// With 标签值对应的计数器
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.get(values, func() interface{} { return new(Counter) }).(*Counter)
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.n, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+func (c *CounterVec) kind() string { return "counter" }
+
+func (c *CounterVec) write(w *bufio.Writer, name string) {
+	c.each(func(labels string, item interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", name, labels, item.(*Counter).Value())
+	})
+}
+
+// GaugeVec 带标签的数值
+type GaugeVec struct {
+	vec
+}
+
+// Gauge 数值，并发安全
+type Gauge struct {
+	bits uint64
+}
+
+// With 标签值对应的数值
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.get(values, func() interface{} { return new(Gauge) }).(*Gauge)
+}
+
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		v := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&g.bits, old, v) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *GaugeVec) kind() string { return "gauge" }
+
+func (g *GaugeVec) write(w *bufio.Writer, name string) {
+	g.each(func(labels string, item interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(item.(*Gauge).Value()))
+	})
+}
+
+type gaugeFunc func() float64
+
+func (gaugeFunc) kind() string { return "gauge" }
+
+func (f gaugeFunc) write(w *bufio.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(f()))
+}
+
+// HistogramVec 带标签的耗时分布
+type HistogramVec struct {
+	vec
+	bounds []time.Duration
+}
+
+// With 标签值对应的耗时分布
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.get(values, func() interface{} { return NewHistogram(h.bounds...) }).(*Histogram)
+}
+
+func (h *HistogramVec) kind() string { return "histogram" }
+
+func (h *HistogramVec) write(w *bufio.Writer, name string) {
+	h.each(func(labels string, item interface{}) {
+		s := item.(*Histogram).Snapshot()
+		var n uint64
+		for i, c := range s.Counts {
+			n += c
+			le := "+Inf"
+			if i < len(s.Bounds) {
+				le = formatFloat(s.Bounds[i].Seconds())
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, appendLabel(labels, "le", le), n)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(s.Sum.Seconds()))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels, s.Count)
+	})
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// appendLabel 在已格式化的标签后追加一个标签
+func appendLabel(labels, name, value string) string {
+	l := name + `="` + escapeLabel(value) + `"`
+	if labels == "" {
+		return "{" + l + "}"
+	}
+	return labels[:len(labels)-1] + "," + l + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// JSONMessage 消息的 JSON 表示，用于 WebSocket 等无法使用二进制协议的客户端。
+// Data 为消息结构体的导出字段(不含 MsgSize、MsgType)，定长字节数组编码为字符串
+type JSONMessage struct {
+	Type  uint16          `json:"type"`
+	Name  string          `json:"name,omitempty" comment:"消息结构体的名称，解码时忽略"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty" comment:"网关处理失败时的原因"`
+}
+
+// MarshalJSON 把消息编码为 JSONMessage
+func MarshalJSON(m Message) ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(JSONMessage{
+		Type: m.Type(),
+		Name: reflect.TypeOf(m).Elem().Name(),
+		Data: data,
+	})
+}
+
+// UnmarshalJSON 按 JSONMessage 的 Type 创建消息并解码 Data
+func UnmarshalJSON(b []byte) (Message, error) {
+	var jm JSONMessage
+	if err := json.Unmarshal(b, &jm); err != nil {
+		return nil, err
+	}
+	return jm.Message()
+}
+
+// Message 按 Type 创建消息并解码 Data
+func (jm *JSONMessage) Message() (Message, error) {
+	m, err := NewMessage(jm.Type)
+	if err != nil {
+		return nil, err
+	}
+	if len(jm.Data) > 0 {
+		if err = json.Unmarshal(jm.Data, m); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", reflect.TypeOf(m).Elem().Name(), err)
+		}
+	}
+	// 变长消息的大小取决于内容
+	switch v := m.(type) {
+	case *TransferChunk:
+		v.SetData(v.Data)
+	case *AdminMessage:
+		v.SetText(v.Text)
+	}
+	return m, nil
+}
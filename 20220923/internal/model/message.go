@@ -7,6 +7,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
+	"net"
+	"unicode/utf8"
 )
 
 /**
@@ -28,17 +32,65 @@ func NewMessage(msgType uint16) (Message, error) {
 		return NewLogin(), nil
 	case enum.MsgTypeLoginResponse:
 		return NewLoginResponse(), nil
+	case enum.MsgTypeLogout:
+		return NewLogout(), nil
+	case enum.MsgTypeEndOfSession:
+		return NewEndOfSession(), nil
+	case enum.MsgTypeSubscribe:
+		return NewSubscribe(), nil
+	case enum.MsgTypeUnsubscribe:
+		return NewUnsubscribe(), nil
+	case enum.MsgTypeAck:
+		return NewAck(), nil
+	case enum.MsgTypeTransferStart:
+		return NewTransferStart(), nil
+	case enum.MsgTypeTransferChunk:
+		return NewTransferChunk(), nil
+	case enum.MsgTypeTransferEnd:
+		return NewTransferEnd(), nil
+	case enum.MsgTypeTransferCancel:
+		return NewTransferCancel(), nil
+	case enum.MsgTypeRetransmitRequest:
+		return NewRetransmitRequest(), nil
+	case enum.MsgTypeRetransmitResponse:
+		return NewRetransmitResponse(), nil
+	case enum.MsgTypeAdminMessage:
+		return NewAdminMessage(), nil
+	case enum.MsgTypeForwardedFor:
+		return NewForwardedFor(), nil
 	case enum.MsgTypeHeartBeat:
 		return NewHeartBeat(), nil
+	case enum.MsgTypeHeartBeatEcho:
+		return NewHeartBeatEcho(), nil
 	default:
 		return nil, fmt.Errorf("unknown MsgType(%d)", msgType)
 	}
 }
 
+// Correlated 携带关联 ID 的消息，用于把响应和请求对应起来
+type Correlated interface {
+	Message
+	CorrelationID() uint32
+	SetCorrelationID(id uint32)
+}
+
+// Correlation 嵌入到请求和响应消息中，CorrID 为 0 表示不需要关联
+type Correlation struct {
+	CorrID uint32 `comment:"关联 ID，响应中原样返回请求的关联 ID"`
+}
+
+func (c *Correlation) CorrelationID() uint32 {
+	return c.CorrID
+}
+
+func (c *Correlation) SetCorrelationID(id uint32) {
+	c.CorrID = id
+}
+
 // MetaMessage 消息元数据
 type MetaMessage struct {
-	MsgSize uint16 `comment:"消息大小"`
-	MsgType uint16 `comment:"消息类型"`
+	MsgSize uint16 `json:"-" comment:"消息大小"`
+	MsgType uint16 `json:"-" comment:"消息类型"`
 }
 
 var MetaMessageSize = binary.Size(MetaMessage{})
@@ -51,15 +103,32 @@ func (m MetaMessage) Type() uint16 {
 	return m.MsgType
 }
 
+// unmarshalShort 解码 size 字节的消息 v。旧版本的对端发送的消息没有后来追加在末尾的字段，b 不足 size 字节时缺少的字段为 0；
+// b 短于旧版本的长度 min 时返回 io.ErrUnexpectedEOF。v 不能实现 codec.Unmarshaler，否则会递归调用
+func unmarshalShort(b []byte, v any, size, min int) error {
+	if len(b) < min {
+		return io.ErrUnexpectedEOF
+	}
+	if len(b) < size {
+		b = append(append(make([]byte, 0, size), b...), make([]byte, size-len(b))...)
+	}
+	return binary.Read(bytes.NewReader(b[:size]), binary.LittleEndian, v)
+}
+
 type Login struct {
 	MetaMessage
 
-	Username typebase.ByteArrayL12 `comment:"账号(最大支持12位字符)"`
-	Password typebase.ByteArrayL20 `comment:"密码(最大支持20位字符)"`
+	Username   typebase.ByteArrayL12 `comment:"账号(最大支持12位字符)"`
+	Password   typebase.ByteArrayL20 `comment:"密码(最大支持20位字符)"`
+	SeqNum     uint32                `comment:"希望收到的下一条消息的序号，0 表示不续传"`
+	HeartBtInt uint32                `comment:"希望使用的心跳间隔(毫秒)，0 表示使用服务端默认值"`
 }
 
 var loginMsgSize = uint16(binary.Size(Login{}))
 
+// loginV1MsgSize 旧版本的 Login 只有账号和密码
+var loginV1MsgSize = MetaMessageSize + 32
+
 func NewLogin() *Login {
 	m := new(Login)
 	m.MsgSize = loginMsgSize
@@ -67,20 +136,47 @@ func NewLogin() *Login {
 	return m
 }
 
+// Unmarshal 兼容旧版本的 Login，此时 SeqNum 为 0(不续传)，HeartBtInt 为 0(使用服务端默认值)
+func (m *Login) Unmarshal(b []byte) error {
+	type login Login
+	if err := unmarshalShort(b, (*login)(m), int(loginMsgSize), loginV1MsgSize); err != nil {
+		return err
+	}
+	m.MsgSize = loginMsgSize
+	return nil
+}
+
 type LoginResponse struct {
 	MetaMessage
 
 	// Status of the session.
 	// 0   - Session Active
 	// 5   - Invalid username or IP address
+	// 6   - Login timeout
+	// 7   - Server busy (too many pending logins)
+	// 8   - Too many connections from this IP address
+	// 9   - IP address locked after repeated login failures
 	// 100 - User already connected
 	SessionStatus uint8
 
-	_ [3]byte
+	// 服务端支持的功能，见 enum.FeatureHeartBeatEcho 等，旧版本的服务端为 0
+	Features uint8
+
+	_ [2]byte
+
+	// 服务端将要发送的下一条消息的序号
+	SeqNum uint32
+	// 协商后双方使用的心跳间隔(毫秒)
+	HeartBtInt uint32
+	// 服务端已处理的客户端业务消息的最大序号，客户端从下一条开始重发
+	AckSeqNum uint32
 }
 
 var loginResponseMsgSize = uint16(binary.Size(LoginResponse{}))
 
+// loginResponseV1MsgSize 旧版本的 LoginResponse 只有 SessionStatus 和 3 个字节的填充
+var loginResponseV1MsgSize = MetaMessageSize + 1
+
 func NewLoginResponse() *LoginResponse {
 	m := new(LoginResponse)
 	m.MsgSize = loginResponseMsgSize
@@ -88,17 +184,373 @@ func NewLoginResponse() *LoginResponse {
 	return m
 }
 
+// Unmarshal 兼容旧版本的 LoginResponse，此时 Features、SeqNum、HeartBtInt、AckSeqNum 为 0
+func (m *LoginResponse) Unmarshal(b []byte) error {
+	type loginResponse LoginResponse
+	if err := unmarshalShort(b, (*loginResponse)(m), int(loginResponseMsgSize), loginResponseV1MsgSize); err != nil {
+		return err
+	}
+	m.MsgSize = loginResponseMsgSize
+	return nil
+}
+
+// Logout 客户端主动登出，服务端收到后结束会话
+type Logout struct {
+	MetaMessage
+}
+
+func NewLogout() *Logout {
+	m := new(Logout)
+	m.MsgSize = uint16(MetaMessageSize)
+	m.MsgType = enum.MsgTypeLogout
+	return m
+}
+
+// EndOfSession 服务端结束会话，发送之后服务端会关闭连接
+type EndOfSession struct {
+	MetaMessage
+
+	// Reason of the end of session.
+	// 1   - Server shutdown
+	Reason uint8
+
+	_ [3]byte
+}
+
+var endOfSessionMsgSize = uint16(binary.Size(EndOfSession{}))
+
+func NewEndOfSession() *EndOfSession {
+	m := new(EndOfSession)
+	m.MsgSize = endOfSessionMsgSize
+	m.MsgType = enum.MsgTypeEndOfSession
+	return m
+}
+
+// Ack 确认已处理的业务消息，发送方释放序号不大于 SeqNum 的消息，不再重发
+type Ack struct {
+	MetaMessage
+
+	SeqNum  uint32 `comment:"已处理的业务消息的最大序号"`
+	Channel uint8  `comment:"逻辑通道 ID，每个通道的序号各自独立"`
+	_       [3]byte
+}
+
+var ackMsgSize = uint16(binary.Size(Ack{}))
+
+func NewAck() *Ack {
+	m := new(Ack)
+	m.MsgSize = ackMsgSize
+	m.MsgType = enum.MsgTypeAck
+	return m
+}
+
+// Subscribe 订阅主题，之后服务端发布到该主题的消息都会推送给客户端
+type Subscribe struct {
+	MetaMessage
+
+	Topic typebase.ByteArrayL20 `comment:"主题(最大支持20位字符)"`
+}
+
+var subscribeMsgSize = uint16(binary.Size(Subscribe{}))
+
+func NewSubscribe() *Subscribe {
+	m := new(Subscribe)
+	m.MsgSize = subscribeMsgSize
+	m.MsgType = enum.MsgTypeSubscribe
+	return m
+}
+
+// Unsubscribe 取消订阅主题
+type Unsubscribe struct {
+	MetaMessage
+
+	Topic typebase.ByteArrayL20 `comment:"主题(最大支持20位字符)"`
+}
+
+var unsubscribeMsgSize = uint16(binary.Size(Unsubscribe{}))
+
+func NewUnsubscribe() *Unsubscribe {
+	m := new(Unsubscribe)
+	m.MsgSize = unsubscribeMsgSize
+	m.MsgType = enum.MsgTypeUnsubscribe
+	return m
+}
+
+// TransferStart 开始分片传输。单个数据包最大 64KB，更大的数据(快照、文件等)拆分为 TransferChunk 依次发送
+type TransferStart struct {
+	MetaMessage
+
+	TransferID uint32                `comment:"传输 ID，由发送方分配，同一连接上进行中的传输不能重复"`
+	TotalSize  uint64                `comment:"数据的总字节数"`
+	Name       typebase.ByteArrayL20 `comment:"数据的名称(最大支持20位字符)"`
+}
+
+var transferStartMsgSize = uint16(binary.Size(TransferStart{}))
+
+func NewTransferStart() *TransferStart {
+	m := new(TransferStart)
+	m.MsgSize = transferStartMsgSize
+	m.MsgType = enum.MsgTypeTransferStart
+	return m
+}
+
+// TransferChunk 分片传输的一段数据，按偏移量顺序发送。Data 的长度不固定，由 MsgSize 计算
+type TransferChunk struct {
+	MetaMessage
+
+	TransferID uint32
+	Offset     uint64 `comment:"Data 在整个数据中的偏移量"`
+	Data       []byte
+}
+
+var transferChunkHeaderSize = uint16(binary.Size(MetaMessage{}) + 4 + 8)
+
+// MaxChunkSize 一个 TransferChunk 最多携带的数据字节数，使一个分片正好放进一个数据包
+const MaxChunkSize = math.MaxUint16 - 16 - 16
+
+func NewTransferChunk() *TransferChunk {
+	m := new(TransferChunk)
+	m.MsgSize = transferChunkHeaderSize
+	m.MsgType = enum.MsgTypeTransferChunk
+	return m
+}
+
+// SetData 设置数据并更新 MsgSize，超过 MaxChunkSize 的部分被截断
+func (m *TransferChunk) SetData(b []byte) {
+	if len(b) > MaxChunkSize {
+		b = b[:MaxChunkSize]
+	}
+	m.Data = b
+	m.MsgSize = transferChunkHeaderSize + uint16(len(b))
+}
+
+func (m *TransferChunk) Marshal() ([]byte, error) {
+	b := bytes.NewBuffer(make([]byte, 0, m.MsgSize))
+	e := codec.NewEncoder(b)
+	err := e.Encode(m.MsgSize, m.MsgType, m.TransferID, m.Offset, m.Data)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (m *TransferChunk) Unmarshal(b []byte) error {
+	if len(b) < int(transferChunkHeaderSize) {
+		return fmt.Errorf("transfer chunk too short: %d bytes", len(b))
+	}
+	d := codec.NewDecoder(bytes.NewReader(b))
+	err := d.Decode(&m.MsgSize, &m.MsgType, &m.TransferID, &m.Offset)
+	if err != nil {
+		return err
+	}
+	// 复制一份，b 引用的是数据包的缓冲区
+	m.Data = append([]byte(nil), b[transferChunkHeaderSize:]...)
+	return nil
+}
+
+// TransferEnd 结束分片传输，接收方校验总长度和校验和
+type TransferEnd struct {
+	MetaMessage
+
+	TransferID uint32
+	Checksum   uint32 `comment:"整个数据的 CRC-32(IEEE)"`
+}
+
+var transferEndMsgSize = uint16(binary.Size(TransferEnd{}))
+
+func NewTransferEnd() *TransferEnd {
+	m := new(TransferEnd)
+	m.MsgSize = transferEndMsgSize
+	m.MsgType = enum.MsgTypeTransferEnd
+	return m
+}
+
+// TransferCancel 取消分片传输，双方都可以发送。
+// 发送方取消时接收方丢弃已收到的分片，接收方取消时发送方停止发送
+type TransferCancel struct {
+	MetaMessage
+
+	TransferID uint32
+
+	// Reason of the cancellation.
+	// 1 - Cancelled by sender
+	// 2 - Too large
+	// 3 - Checksum mismatch
+	// 4 - Invalid chunk
+	Reason uint8
+
+	// Origin of the cancellation, TransferID belongs to the sender of the transfer.
+	// 0 - Sender of the transfer
+	// 1 - Receiver of the transfer
+	Origin uint8
+
+	_ [2]byte
+}
+
+var transferCancelMsgSize = uint16(binary.Size(TransferCancel{}))
+
+func NewTransferCancel() *TransferCancel {
+	m := new(TransferCancel)
+	m.MsgSize = transferCancelMsgSize
+	m.MsgType = enum.MsgTypeTransferCancel
+	return m
+}
+
+// RetransmitRequest 通过 TCP 请求补发 UDP 组播中丢失的消息
+type RetransmitRequest struct {
+	MetaMessage
+
+	Session typebase.ByteArrayL12 `comment:"组播会话名称"`
+	SeqNum  uint64                `comment:"第一条丢失的消息的序号"`
+	Count   uint32                `comment:"丢失的消息个数"`
+}
+
+var retransmitRequestMsgSize = uint16(binary.Size(RetransmitRequest{}))
+
+func NewRetransmitRequest() *RetransmitRequest {
+	m := new(RetransmitRequest)
+	m.MsgSize = retransmitRequestMsgSize
+	m.MsgType = enum.MsgTypeRetransmitRequest
+	return m
+}
+
+// RetransmitResponse 补发 UDP 组播的消息。与补发的消息放在同一个数据包中，Count 条消息紧随其后
+type RetransmitResponse struct {
+	MetaMessage
+
+	Session typebase.ByteArrayL12 `comment:"组播会话名称"`
+	SeqNum  uint64                `comment:"随后第一条消息的序号"`
+	Count   uint32                `comment:"随后的消息个数，Status 非 0 时为无法补发的消息个数"`
+
+	// Status of the retransmission.
+	// 0 - OK
+	// 1 - Unknown session
+	// 2 - Messages no longer available
+	Status uint8
+
+	_ [3]byte
+}
+
+var retransmitResponseMsgSize = uint16(binary.Size(RetransmitResponse{}))
+
+func NewRetransmitResponse() *RetransmitResponse {
+	m := new(RetransmitResponse)
+	m.MsgSize = retransmitResponseMsgSize
+	m.MsgType = enum.MsgTypeRetransmitResponse
+	return m
+}
+
+// AdminMessage 管理员广播给在线会话的通知，作为业务消息写到默认通道。Text 的长度不固定，由 MsgSize 计算
+type AdminMessage struct {
+	MetaMessage
+
+	Text string `comment:"通知内容(UTF-8)"`
+}
+
+var adminMessageHeaderSize = uint16(binary.Size(MetaMessage{}))
+
+// MaxAdminTextSize 一个 AdminMessage 最多携带的文本字节数，与 TransferChunk 一样正好放进一个数据包
+const MaxAdminTextSize = MaxChunkSize
+
+func NewAdminMessage() *AdminMessage {
+	m := new(AdminMessage)
+	m.MsgSize = adminMessageHeaderSize
+	m.MsgType = enum.MsgTypeAdminMessage
+	return m
+}
+
+// SetText 设置文本并更新 MsgSize，超过 MaxAdminTextSize 的部分在字符边界处截断
+func (m *AdminMessage) SetText(s string) {
+	if len(s) > MaxAdminTextSize {
+		n := MaxAdminTextSize
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n]
+	}
+	m.Text = s
+	m.MsgSize = adminMessageHeaderSize + uint16(len(s))
+}
+
+func (m *AdminMessage) Marshal() ([]byte, error) {
+	b := bytes.NewBuffer(make([]byte, 0, m.MsgSize))
+	e := codec.NewEncoder(b)
+	err := e.Encode(m.MsgSize, m.MsgType, []byte(m.Text))
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (m *AdminMessage) Unmarshal(b []byte) error {
+	if len(b) < int(adminMessageHeaderSize) {
+		return fmt.Errorf("admin message too short: %d bytes", len(b))
+	}
+	d := codec.NewDecoder(bytes.NewReader(b))
+	err := d.Decode(&m.MsgSize, &m.MsgType)
+	if err != nil {
+		return err
+	}
+	m.Text = string(b[adminMessageHeaderSize:])
+	return nil
+}
+
+// ForwardedFor 网关代替客户端登录时，在登录数据包中放在 Login 之前，告知服务端客户端的来源 IP。
+// 服务端只接受来自可信网关的该消息，其他连接发送的会被忽略
+type ForwardedFor struct {
+	MetaMessage
+
+	IP [16]byte `comment:"客户端的 IP，IPv4 以 IPv4-mapped IPv6 形式存放"`
+}
+
+var forwardedForMsgSize = uint16(binary.Size(ForwardedFor{}))
+
+func NewForwardedFor() *ForwardedFor {
+	m := new(ForwardedFor)
+	m.MsgSize = forwardedForMsgSize
+	m.MsgType = enum.MsgTypeForwardedFor
+	return m
+}
+
+// SetIP ip 为 nil 或格式错误时清空
+func (m *ForwardedFor) SetIP(ip net.IP) {
+	m.IP = [16]byte{}
+	copy(m.IP[:], ip.To16())
+}
+
+// ClientIP 未设置时返回 nil
+func (m *ForwardedFor) ClientIP() net.IP {
+	if m.IP == [16]byte{} {
+		return nil
+	}
+	return net.IP(append([]byte(nil), m.IP[:]...))
+}
+
 type ClientDemo struct {
 	MetaMessage
+	Correlation
 }
 
+var clientDemoMsgSize = uint16(binary.Size(ClientDemo{}))
+
 func NewClientDemo() *ClientDemo {
 	m := new(ClientDemo)
-	m.MsgSize = uint16(MetaMessageSize)
+	m.MsgSize = clientDemoMsgSize
 	m.MsgType = enum.MsgTypeClientDemo
 	return m
 }
 
+// Unmarshal 兼容旧版本没有 CorrID 的 ClientDemo
+func (m *ClientDemo) Unmarshal(b []byte) error {
+	type clientDemo ClientDemo
+	if err := unmarshalShort(b, (*clientDemo)(m), int(clientDemoMsgSize), MetaMessageSize); err != nil {
+		return err
+	}
+	m.MsgSize = clientDemoMsgSize
+	return nil
+}
+
+// ServerDemo CorrID 追加在末尾，旧版本的消息没有 CorrID
 type ServerDemo struct {
 	MetaMessage
 	_      [1]byte
@@ -106,6 +558,7 @@ type ServerDemo struct {
 	Port   uint16
 	_      [2]byte
 	Remark typebase.ByteArrayL20
+	Correlation
 }
 
 var serverDemoMsgSize = uint16(binary.Size(ServerDemo{}))
@@ -120,7 +573,7 @@ func NewServerDemo() *ServerDemo {
 func (m *ServerDemo) Marshal() ([]byte, error) {
 	b := bytes.NewBuffer(make([]byte, 0, serverDemoMsgSize))
 	e := codec.NewEncoder(b)
-	err := e.Encode(m.MsgSize, m.MsgType, [1]byte{}, m.Addr, m.Port, [2]byte{}, m.Remark)
+	err := e.Encode(m.MsgSize, m.MsgType, [1]byte{}, m.Addr, m.Port, [2]byte{}, m.Remark, m.CorrID)
 	if err != nil {
 		return nil, err
 	}
@@ -128,17 +581,25 @@ func (m *ServerDemo) Marshal() ([]byte, error) {
 }
 
 func (m *ServerDemo) Unmarshal(b []byte) error {
-	d := codec.NewDecoder(bytes.NewReader(b))
+	r := bytes.NewReader(b)
+	d := codec.NewDecoder(r)
 	err := d.Decode(&m.MsgSize, &m.MsgType, &[1]byte{}, &m.Addr, &m.Port, &[2]byte{}, &m.Remark)
 	if err != nil {
 		return err
 	}
+	m.CorrID = 0
+	if r.Len() > 0 {
+		if err = d.Decode(&m.CorrID); err != nil {
+			return err
+		}
+	}
+	m.MsgSize = serverDemoMsgSize
 	return nil
 }
 
 func (m *ServerDemo) String() string {
-	str := `{"MsgSize":%d,"MsgType":%d,"Addr":%s,"Port":%d,"Remark":%s}`
-	return fmt.Sprintf(str, m.MsgSize, m.MsgType, m.Addr.String(), m.Port, m.Remark.String())
+	str := `{"MsgSize":%d,"MsgType":%d,"CorrID":%d,"Addr":%s,"Port":%d,"Remark":%s}`
+	return fmt.Sprintf(str, m.MsgSize, m.MsgType, m.CorrID, m.Addr.String(), m.Port, m.Remark.String())
 }
 
 type HeartBeat struct {
@@ -151,3 +612,27 @@ func NewHeartBeat() *HeartBeat {
 	m.MsgType = enum.MsgTypeHeartBeat
 	return m
 }
+
+// HeartBeatEcho 回显对端发送时间的心跳，用于测量往返时间和时钟偏差。
+// 服务端在登录响应中声明支持后客户端才发送，服务端收到之后才向该客户端发送，与旧版本的对端仍使用 HeartBeat
+type HeartBeatEcho struct {
+	MetaMessage
+
+	// SendTime of the latest packet received from the peer (milliseconds since epoch), 0 if none.
+	EchoTime uint64
+
+	// Milliseconds between receiving that packet and sending this heartbeat.
+	// The peer uses EchoTime and EchoDelay to measure round trip time and clock offset.
+	EchoDelay uint32
+
+	_ [4]byte
+}
+
+var heartBeatEchoMsgSize = uint16(binary.Size(HeartBeatEcho{}))
+
+func NewHeartBeatEcho() *HeartBeatEcho {
+	m := new(HeartBeatEcho)
+	m.MsgSize = heartBeatEchoMsgSize
+	m.MsgType = enum.MsgTypeHeartBeatEcho
+	return m
+}
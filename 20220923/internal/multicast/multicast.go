@@ -0,0 +1,480 @@
+package multicast
+
+import (
+	"20220923/internal/codec"
+	"20220923/internal/model"
+	"20220923/internal/packet"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+数据报的格式参考 MoldUDP64：数据报头之后是包体，包体与 TCP 数据包的包体相同(若干条自带 MsgSize 的消息)。
+每条消息占用一个序号，数据报头中的序号为第一条消息的序号；消息个数为 0 的数据报是心跳，序号为下一条消息的序号，接收方据此发现末尾的丢失。
+丢失的消息通过 TCP 会话发送 RetransmitRequest 请求补发
+*/
+
+// binary_size = 10 + 8 + 2 = 20
+type header struct {
+	Session  [10]byte `comment:"会话名称"`
+	SeqNum   uint64   `comment:"数据报中第一条消息的序号，从 1 开始"`
+	MsgCount uint16   `comment:"数据报中消息的个数，0 表示心跳"`
+}
+
+var headerSize = binary.Size(header{})
+
+const (
+	// MaxPayloadSize 包体的最大字节数，使数据报不超过以太网的 MTU
+	MaxPayloadSize = 1472 - 20
+	// MaxSessionLen 会话名称的最大长度
+	MaxSessionLen = 10
+
+	defaultHistorySize    = 65536
+	defaultMaxPending     = 1024
+	defaultRequestTimeout = time.Second
+	defaultHeartbeat      = time.Second
+)
+
+// ErrPayloadTooLarge 消息编码后超过 MaxPayloadSize
+var ErrPayloadTooLarge = errors.New("multicast: payload too large")
+
+// datagram 已发送的数据报，用于补发
+type datagram struct {
+	seq  uint64
+	n    int
+	body []byte
+}
+
+func (d datagram) messages() ([]model.Message, error) {
+	p := packet.NewBuffer(d.body, uint8(d.n))
+	ms := make([]model.Message, 0, d.n)
+	for {
+		m, err := p.ReadMessage()
+		if errors.Is(err, io.EOF) {
+			return ms, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+}
+
+// Publisher 向组播地址发布消息，并保存最近的数据报用于补发
+type Publisher struct {
+	conn    net.PacketConn
+	addr    net.Addr
+	name    string
+	session [10]byte
+	max     int
+
+	mu       sync.Mutex
+	nextSeq  uint64
+	history  []datagram
+	lastSend time.Time
+}
+
+// NewPublisher conn 为发送用的 UDP 连接，addr 为组播地址(测试时也可以是单播地址)。
+// historySize 为最多保存的数据报个数，默认 65536
+func NewPublisher(conn net.PacketConn, addr net.Addr, session string, historySize int) (*Publisher, error) {
+	if session == "" || len(session) > MaxSessionLen {
+		return nil, fmt.Errorf("invalid multicast session name %q", session)
+	}
+	if historySize <= 0 {
+		historySize = defaultHistorySize
+	}
+	p := &Publisher{
+		conn:    conn,
+		addr:    addr,
+		name:    session,
+		max:     historySize,
+		nextSeq: 1,
+	}
+	copy(p.session[:], session)
+	return p, nil
+}
+
+// Session 会话名称
+func (p *Publisher) Session() string {
+	return p.name
+}
+
+// NextSeq 下一条消息的序号
+func (p *Publisher) NextSeq() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.nextSeq
+}
+
+// Publish 把 ms 打包为一个数据报发布，返回第一条消息的序号。
+// 发送失败时序号仍然被占用，接收方会通过补发拿到这些消息
+func (p *Publisher) Publish(ms ...model.Message) (uint64, error) {
+	// 补发时与 RetransmitResponse 放在同一个数据包中，需要留出一个位置
+	if len(ms) == 0 || len(ms) >= math.MaxUint8 {
+		return 0, fmt.Errorf("multicast: invalid message count %d", len(ms))
+	}
+	b := new(packet.Buffer)
+	for _, m := range ms {
+		if err := b.WriteMessage(m); err != nil {
+			return 0, err
+		}
+	}
+	shared := b.Share()
+	if len(shared.Bytes()) > MaxPayloadSize {
+		return 0, ErrPayloadTooLarge
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d := datagram{seq: p.nextSeq, n: shared.NumMessages(), body: shared.Bytes()}
+	p.nextSeq += uint64(d.n)
+	if len(p.history) >= p.max {
+		p.history[0] = datagram{}
+		p.history = p.history[1:]
+	}
+	p.history = append(p.history, d)
+	return d.seq, p.write(d.seq, d.n, d.body)
+}
+
+// Heartbeat 发送心跳，接收方据此发现末尾的消息丢失
+func (p *Publisher) Heartbeat() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.write(p.nextSeq, 0, nil)
+}
+
+// Run 每隔 interval(默认 1 秒)检查一次，期间没有发布消息则发送心跳，直到 ctx 结束
+func (p *Publisher) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		interval = defaultHeartbeat
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.mu.Lock()
+			idle := time.Since(p.lastSend) >= interval
+			p.mu.Unlock()
+			if !idle {
+				continue
+			}
+			if err := p.Heartbeat(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// write 调用方持有锁
+func (p *Publisher) write(seq uint64, n int, body []byte) error {
+	h := header{Session: p.session, SeqNum: seq, MsgCount: uint16(n)}
+	b, err := codec.Marshal(h)
+	if err != nil {
+		return err
+	}
+	p.lastSend = time.Now()
+	_, err = p.conn.WriteTo(append(b, body...), p.addr)
+	return err
+}
+
+// Replay 依次把 [seq, seq+count) 范围内的消息交给 fn，每次一个数据报(可能包含范围之外的消息，接收方会去重)。
+// 已不在历史记录中的部分用 ms 为 nil 表示
+func (p *Publisher) Replay(seq uint64, count uint32, fn func(seq uint64, count uint32, ms []model.Message) error) error {
+	end := seq + uint64(count)
+	p.mu.Lock()
+	first := p.nextSeq
+	if len(p.history) > 0 {
+		first = p.history[0].seq
+	}
+	var ds []datagram
+	for _, d := range p.history {
+		if d.seq+uint64(d.n) <= seq {
+			continue
+		}
+		if d.seq >= end {
+			break
+		}
+		ds = append(ds, d)
+	}
+	p.mu.Unlock()
+
+	if seq < first {
+		if err := fn(seq, uint32(min64(first, end)-seq), nil); err != nil {
+			return err
+		}
+	}
+	for _, d := range ds {
+		ms, err := d.messages()
+		if err != nil {
+			return err
+		}
+		if err = fn(d.seq, uint32(len(ms)), ms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubscriberOptions 接收方的配置
+type SubscriberOptions struct {
+	Session        string                               `comment:"只接收该会话的数据报"`
+	NextSeq        uint64                               `comment:"希望收到的第一条消息的序号，之前的消息请求补发；0 表示从收到的第一个数据报开始"`
+	Request        func(seq uint64, count uint32) error `comment:"请求补发 [seq, seq+count) 的消息，通常通过 TCP 会话发送 RetransmitRequest。会在 Fill 中调用，不应阻塞"`
+	OnMessage      func(seq uint64, m model.Message)    `comment:"按序号顺序交付消息，不应阻塞"`
+	MaxPending     int                                  `comment:"等待补发期间最多缓存的数据报个数，默认 1024，超出时放弃补发"`
+	RequestTimeout time.Duration                        `comment:"补发未完成时重新请求的间隔，默认 1 秒"`
+	Logger         *zap.SugaredLogger                   `comment:"默认使用 zap 的全局日志"`
+}
+
+// Subscriber 接收组播数据报，按序号顺序交付消息，发现丢失时请求补发
+type Subscriber struct {
+	opts SubscriberOptions
+	log  *zap.SugaredLogger
+
+	mu          sync.Mutex
+	nextSeq     uint64
+	pending     map[uint64][]model.Message `comment:"序号不连续、等待补发的消息，key 为第一条消息的序号"`
+	requestedTo uint64                     // 已请求补发到的序号(不含)
+	requestedAt time.Time
+}
+
+func NewSubscriber(opts SubscriberOptions) *Subscriber {
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = defaultMaxPending
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+	s := &Subscriber{
+		opts:    opts,
+		log:     opts.Logger,
+		nextSeq: opts.NextSeq,
+		pending: make(map[uint64][]model.Message),
+	}
+	if s.log == nil {
+		s.log = zap.S()
+	}
+	return s
+}
+
+// NextSeq 下一条待交付的消息的序号
+func (s *Subscriber) NextSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextSeq
+}
+
+// Serve 从 conn 读取数据报直到 ctx 结束或 conn 出错
+func (s *Subscriber) Serve(ctx context.Context, conn net.PacketConn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// 使阻塞中的读取立即返回
+			_ = conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	b := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err = s.receive(b[:n]); err != nil {
+			s.log.Warnf("invalid multicast datagram: %v", err)
+		}
+	}
+}
+
+func (s *Subscriber) receive(b []byte) error {
+	if len(b) < headerSize {
+		return fmt.Errorf("datagram too short: %d bytes", len(b))
+	}
+	var h header
+	if err := codec.Unmarshal(b[:headerSize], &h); err != nil {
+		return err
+	}
+	var session [10]byte
+	copy(session[:], s.opts.Session)
+	if h.Session != session {
+		return nil
+	}
+	if h.MsgCount == 0 {
+		s.request(s.heartbeat(h.SeqNum))
+		return nil
+	}
+	ms, err := datagram{seq: h.SeqNum, n: int(h.MsgCount), body: b[headerSize:]}.messages()
+	if err != nil {
+		return err
+	}
+	s.request(s.handle(h.SeqNum, ms))
+	return nil
+}
+
+// Fill 处理 TCP 会话收到的补发，见 model.RetransmitResponse
+func (s *Subscriber) Fill(resp *model.RetransmitResponse, ms []model.Message) {
+	if resp.Session.String() != s.opts.Session {
+		return
+	}
+	if resp.Status != 0 {
+		s.request(s.skip(resp.SeqNum, resp.Count, resp.Status))
+		return
+	}
+	s.request(s.handle(resp.SeqNum, ms))
+}
+
+func (s *Subscriber) request(seq uint64, count uint32) {
+	if count == 0 || s.opts.Request == nil {
+		return
+	}
+	s.log.Infof("multicast gap, requesting retransmission. session=[%s], seq=[%d], count=[%d]", s.opts.Session, seq, count)
+	if err := s.opts.Request(seq, count); err != nil {
+		s.log.Warnf("request retransmission failed. session=[%s], err=[%v]", s.opts.Session, err)
+	}
+}
+
+// heartbeat 心跳中的序号为发送方的下一条消息的序号，返回需要补发的范围
+func (s *Subscriber) heartbeat(seq uint64) (uint64, uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nextSeq == 0 {
+		s.nextSeq = seq
+		return 0, 0
+	}
+	return s.gap(seq)
+}
+
+// handle 处理从 seq 开始的一段消息，返回需要补发的范围
+func (s *Subscriber) handle(seq uint64, ms []model.Message) (uint64, uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nextSeq == 0 {
+		s.nextSeq = seq
+	}
+	end := seq + uint64(len(ms))
+	if end <= s.nextSeq {
+		// 重复
+		return 0, 0
+	}
+	if seq > s.nextSeq {
+		if len(s.pending) >= s.opts.MaxPending {
+			// 补发太慢，放弃缺口中的消息
+			first := s.firstPending()
+			s.log.Warnf("multicast messages lost. session=[%s], seq=[%d], count=[%d]", s.opts.Session, s.nextSeq, first-s.nextSeq)
+			s.nextSeq = first
+			s.flush()
+			if end <= s.nextSeq {
+				// 缓存中的消息已经覆盖了这一段
+				return 0, 0
+			}
+		}
+		if seq > s.nextSeq {
+			s.pending[seq] = ms
+			return s.gap(seq)
+		}
+	}
+	s.deliver(seq, ms)
+	s.flush()
+	if len(s.pending) > 0 {
+		return s.gap(s.firstPending())
+	}
+	return 0, 0
+}
+
+// skip 服务端无法补发 [seq, seq+count)，跳过这些消息
+func (s *Subscriber) skip(seq uint64, count uint32, status uint8) (uint64, uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end := seq + uint64(count)
+	if end <= s.nextSeq {
+		return 0, 0
+	}
+	s.log.Warnf("multicast messages lost. session=[%s], seq=[%d], count=[%d], status=[%d]", s.opts.Session, s.nextSeq, end-s.nextSeq, status)
+	s.nextSeq = end
+	s.flush()
+	if len(s.pending) > 0 {
+		return s.gap(s.firstPending())
+	}
+	return 0, 0
+}
+
+// deliver 交付从 seq 开始的消息，跳过已交付的部分，nextSeq 只增不减。调用方持有锁
+func (s *Subscriber) deliver(seq uint64, ms []model.Message) {
+	for i, m := range ms {
+		if seq+uint64(i) < s.nextSeq {
+			continue
+		}
+		if s.opts.OnMessage != nil {
+			s.opts.OnMessage(seq+uint64(i), m)
+		}
+	}
+	if end := seq + uint64(len(ms)); end > s.nextSeq {
+		s.nextSeq = end
+	}
+}
+
+// flush 交付缓存中已经连续的消息。调用方持有锁
+func (s *Subscriber) flush() {
+	for len(s.pending) > 0 {
+		first := s.firstPending()
+		if first > s.nextSeq {
+			return
+		}
+		ms := s.pending[first]
+		delete(s.pending, first)
+		if first+uint64(len(ms)) > s.nextSeq {
+			s.deliver(first, ms)
+		}
+	}
+}
+
+func (s *Subscriber) firstPending() uint64 {
+	var first uint64
+	for seq := range s.pending {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	return first
+}
+
+// gap 返回 [nextSeq, to) 中尚未请求、或请求已超时的范围。调用方持有锁
+func (s *Subscriber) gap(to uint64) (uint64, uint32) {
+	if to <= s.nextSeq {
+		return 0, 0
+	}
+	from := s.nextSeq
+	if time.Since(s.requestedAt) < s.opts.RequestTimeout && s.requestedTo > from {
+		from = s.requestedTo
+	}
+	if to <= from {
+		return 0, 0
+	}
+	if to > s.requestedTo {
+		s.requestedTo = to
+	}
+	s.requestedAt = time.Now()
+	return from, uint32(to - from)
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,149 @@
+package multicast
+
+import (
+	"20220923/internal/enum"
+	"20220923/internal/model"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dropConn 丢弃第 drop 个数据报(从 1 开始)，模拟组播丢包
+type dropConn struct {
+	net.PacketConn
+	drop  int32
+	count int32
+}
+
+func (c *dropConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.AddInt32(&c.count, 1) == c.drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func demo(port uint16) model.Message {
+	m := model.NewServerDemo()
+	m.Port = port
+	return m
+}
+
+func TestGapFill(t *testing.T) {
+	// 用本机的 UDP 单播代替组播
+	rconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rconn.Close()
+	wconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wconn.Close()
+	pub, err := NewPublisher(&dropConn{PacketConn: wconn, drop: 2}, rconn.LocalAddr(), "DEMO", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan uint64, 16)
+	var sub *Subscriber
+	sub = NewSubscriber(SubscriberOptions{
+		Session: "DEMO",
+		NextSeq: 1,
+		// 模拟通过 TCP 会话补发
+		Request: func(seq uint64, count uint32) error {
+			go func() {
+				_ = pub.Replay(seq, count, func(seq uint64, count uint32, ms []model.Message) error {
+					resp := model.NewRetransmitResponse()
+					resp.Session.Set([]byte("DEMO"))
+					resp.SeqNum = seq
+					resp.Count = count
+					if ms == nil {
+						resp.Status = enum.RetransmitStatusUnavailable
+					}
+					sub.Fill(resp, ms)
+					return nil
+				})
+			}()
+			return nil
+		},
+		OnMessage: func(seq uint64, m model.Message) {
+			if port := uint64(m.(*model.ServerDemo).Port); port != seq {
+				t.Errorf("message %d delivered as seq %d", port, seq)
+			}
+			got <- seq
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	go func() { _ = sub.Serve(ctx, rconn) }()
+
+	// 序号 1、2-3(丢失)、4，接收方发现缺口后补发 2-3
+	for _, ms := range [][]model.Message{{demo(1)}, {demo(2), demo(3)}, {demo(4)}} {
+		if _, err = pub.Publish(ms...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for want := uint64(1); want <= 4; want++ {
+		select {
+		case seq := <-got:
+			if seq != want {
+				t.Fatalf("delivered seq %d, want %d", seq, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("seq %d not delivered", want)
+		}
+	}
+
+	// 历史记录只保留 2 个数据报，序号 1 已无法补发
+	var lost bool
+	err = pub.Replay(1, 2, func(seq uint64, count uint32, ms []model.Message) error {
+		if ms == nil {
+			lost = seq == 1 && count == 1
+		}
+		return nil
+	})
+	if err != nil || !lost {
+		t.Fatalf("Replay: err = %v, lost = %v", err, lost)
+	}
+
+	// 心跳使接收方发现末尾的丢失
+	_ = pub.Heartbeat()
+	if _, err = pub.Publish(demo(5)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case seq := <-got:
+		if seq != 5 {
+			t.Fatalf("delivered seq %d, want 5", seq)
+		}
+	case <-ctx.Done():
+		t.Fatal("seq 5 not delivered")
+	}
+	if next := sub.NextSeq(); next != 6 {
+		t.Fatalf("NextSeq = %d", next)
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+	var got []uint64
+	sub := NewSubscriber(SubscriberOptions{
+		Session:    "DEMO",
+		NextSeq:    1,
+		MaxPending: 1,
+		OnMessage:  func(seq uint64, m model.Message) { got = append(got, seq) },
+	})
+	sub.handle(3, []model.Message{demo(3), demo(4), demo(5)})
+	// 缓存已满，放弃 1-2 并交付缓存的 3-5，之后到达的 4 是重复的
+	sub.handle(4, []model.Message{demo(4)})
+	if next := sub.NextSeq(); next != 6 {
+		t.Fatalf("NextSeq = %d", next)
+	}
+	sub.handle(6, []model.Message{demo(6)})
+	sub.handle(5, []model.Message{demo(5)})
+	if len(got) != 4 || got[0] != 3 || got[3] != 6 {
+		t.Fatalf("delivered %v", got)
+	}
+}
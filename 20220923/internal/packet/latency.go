@@ -0,0 +1,57 @@
+package packet
+
+import (
+	"20220923/internal/metrics"
+	"20220923/internal/model"
+	"sync/atomic"
+	"time"
+)
+
+// Received 收到数据包的时间，只对 ReadPacket 返回的数据包有效
+func (p *Buffer) Received() time.Time {
+	return p.recv
+}
+
+// received 记录数据包的单向延迟，以及心跳回显所需的发送时间和收到的时间
+func (r *Reader) received(p *Buffer) {
+	now := time.Now()
+	p.recv = now
+	if p.SendTime == 0 {
+		return
+	}
+	r.latency.Observe(now.Sub(time.UnixMilli(int64(p.SendTime))))
+	atomic.StoreInt64(&r.lastSend, int64(p.SendTime))
+	atomic.StoreInt64(&r.lastRecv, now.UnixNano())
+}
+
+// Latency 收到的数据包的单向延迟分布。两端的时钟不一致时包含时钟偏差，可以用 Clock 的估计值修正
+func (r *Reader) Latency() metrics.HistogramSnapshot {
+	return r.latency.Snapshot()
+}
+
+// Clock 与对端的时钟偏差和往返时间的估计值，还没有收到对端回显的心跳时 ok 为 false
+func (r *Reader) Clock() (s metrics.ClockSample, ok bool) {
+	return r.clock.Estimate()
+}
+
+// Echo 发送心跳前调用，回显最近收到的数据包的发送时间以及从收到到现在的间隔
+func (r *Reader) Echo(hb *model.HeartBeatEcho) {
+	sent := atomic.LoadInt64(&r.lastSend)
+	if sent == 0 {
+		hb.EchoTime, hb.EchoDelay = 0, 0
+		return
+	}
+	hb.EchoTime = uint64(sent)
+	hb.EchoDelay = uint32(time.Since(time.Unix(0, atomic.LoadInt64(&r.lastRecv))).Milliseconds())
+}
+
+// ObserveEcho 收到对端回显的心跳时调用，p 为心跳所在的数据包。返回本次测量的结果，心跳没有回显时 ok 为 false
+func (r *Reader) ObserveEcho(hb *model.HeartBeatEcho, p *Buffer) (s metrics.ClockSample, ok bool) {
+	if hb.EchoTime == 0 || p.SendTime == 0 {
+		return s, false
+	}
+	t1 := time.UnixMilli(int64(hb.EchoTime))
+	t3 := time.UnixMilli(int64(p.SendTime))
+	t2 := t3.Add(-time.Duration(hb.EchoDelay) * time.Millisecond)
+	return r.clock.Observe(t1, t2, t3, p.recv), true
+}
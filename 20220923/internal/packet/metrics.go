@@ -0,0 +1,76 @@
+package packet
+
+import (
+	"20220923/internal/metrics"
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
+// Metrics 数据包读写的统计，同一个服务端或客户端的所有连接共用
+type Metrics struct {
+	packets      *metrics.CounterVec
+	messages     *metrics.CounterVec
+	bytes        *metrics.CounterVec
+	decodeErrors *metrics.Counter
+	writeLatency *metrics.Histogram
+}
+
+// NewMetrics 在 r 中注册以 namespace 为前缀的指标，如 namespace 为 server 时为 server_packets_total
+func NewMetrics(r *metrics.Registry, namespace string) *Metrics {
+	return &Metrics{
+		packets:      r.Counter(namespace+"_packets_total", "Packets read (in) and written (out).", "direction"),
+		messages:     r.Counter(namespace+"_messages_total", "Messages read (in) and written (out) by message type.", "direction", "msg_type"),
+		bytes:        r.Counter(namespace+"_bytes_total", "Bytes read (in) and written (out), including packet headers.", "direction"),
+		decodeErrors: r.Counter(namespace+"_decode_errors_total", "Packets or messages that could not be decoded.").With(),
+		writeLatency: r.Histogram(namespace+"_write_duration_seconds", "Time to write and flush one packet.", nil).With(),
+	}
+}
+
+// SetMetrics 统计该连接的读写，须在开始读写之前调用
+func (s *Session) SetMetrics(m *Metrics) {
+	s.Reader.metrics = m
+	s.Writer.metrics = m
+}
+
+func (m *Metrics) read(size int) {
+	if m == nil {
+		return
+	}
+	m.packets.With("in").Inc()
+	m.bytes.With("in").Add(uint64(size))
+}
+
+// readMessage 收到的消息在解码之后按类型统计，未知的类型只计入解码错误
+func (m *Metrics) readMessage(msgType uint16) {
+	if m == nil {
+		return
+	}
+	m.messages.With("in", strconv.Itoa(int(msgType))).Inc()
+}
+
+func (m *Metrics) decodeError() {
+	if m == nil {
+		return
+	}
+	m.decodeErrors.Inc()
+}
+
+// written body 为已写出的包体，按消息头中的类型统计
+func (m *Metrics) written(body []byte, cost time.Duration) {
+	if m == nil {
+		return
+	}
+	m.packets.With("out").Inc()
+	m.bytes.With("out").Add(uint64(int(headerSize) + len(body)))
+	m.writeLatency.Observe(cost)
+	for len(body) >= 4 {
+		size := int(binary.LittleEndian.Uint16(body))
+		msgType := binary.LittleEndian.Uint16(body[2:])
+		if size < 4 || size > len(body) {
+			return
+		}
+		m.messages.With("out", strconv.Itoa(int(msgType))).Inc()
+		body = body[size:]
+	}
+}
@@ -2,12 +2,15 @@ package packet
 
 import (
 	"20220923/internal/codec"
+	"20220923/internal/metrics"
 	"20220923/internal/model"
 	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"io"
+	"math"
 	"net"
 	"sync"
 	"time"
@@ -29,11 +32,14 @@ func NewSession(conn net.Conn) *Session {
 
 var headerSize = uint16(binary.Size(header{}))
 
+// ErrPacketFull 数据包的大小(PktSize 为 uint16)或消息个数(MsgCount 为 uint8)超出上限，更大的数据使用分片传输
+var ErrPacketFull = errors.New("packet: packet full")
+
 // binary_size = 2 + 1 + 1 + 4 + 8 = 16
 type header struct {
 	PktSize  uint16 `comment:"数据包大小"`
 	MsgCount uint8  `comment:"数据包中消息的个数"`
-	_        byte   `comment:"无实际意义"`
+	Channel  uint8  `comment:"逻辑通道 ID，0 为默认通道"`
 	SeqNum   uint32 `comment:"数据包中第一条消息的序号"`
 	SendTime uint64 `comment:"数据包发送时间(毫秒级时间戳)"`
 }
@@ -41,24 +47,46 @@ type header struct {
 type Buffer struct {
 	header `comment:"数据包头"`
 
-	mu  sync.RWMutex `comment:"读写锁"`
-	buf bytes.Buffer `comment:"数据包体(消息内容)"`
-	num uint8        `comment:"消息数量"`
+	mu     sync.RWMutex `comment:"读写锁"`
+	buf    bytes.Buffer `comment:"数据包体(消息内容)"`
+	num    uint8        `comment:"消息数量"`
+	shared []byte       `comment:"只读的数据包体，非空时代替 buf 写出，见 Shared"`
+	recv   time.Time    `comment:"收到数据包的时间，只对 ReadPacket 返回的数据包有效"`
+	m      *Metrics     `comment:"ReadMessage 时统计消息类型和解码错误，只对 ReadPacket 返回的数据包有效"`
+}
+
+// Shared 编码好的只读数据包体，可以写给多个连接而不必重复编码
+type Shared struct {
+	body []byte
+	num  uint8
 }
 
 type Reader struct {
 	mu sync.Mutex
 	rd *bufio.Reader
+
+	latency *metrics.Histogram `comment:"数据包的单向延迟(收到的时间 - 包头中的发送时间)，包含两端的时钟偏差"`
+	clock   metrics.Clock      `comment:"根据心跳的往返估算的时钟偏差"`
+	metrics *Metrics           `comment:"为 nil 时不统计"`
+	// 以下字段使用 atomic 读写，用于心跳回显
+	lastSend int64 // 最近收到的数据包的发送时间(毫秒级时间戳)
+	lastRecv int64 // 收到该数据包的时间(纳秒级时间戳)
 }
 
 type Writer struct {
-	mu sync.Mutex
-	wr *bufio.Writer
+	mu      sync.Mutex
+	wr      *bufio.Writer
+	metrics *Metrics `comment:"为 nil 时不统计"`
 }
 
 func NewReader(r io.Reader) *Reader {
+	return newReader(bufio.NewReader(r))
+}
+
+func newReader(rd *bufio.Reader) *Reader {
 	return &Reader{
-		rd: bufio.NewReader(r),
+		rd:      rd,
+		latency: metrics.NewHistogram(),
 	}
 }
 
@@ -75,18 +103,29 @@ func (w *Writer) WritePacket(ctx context.Context, p *Buffer) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	eh := make(chan error)
-	done := make(chan struct{})
+	// 带缓冲，ctx 结束后 goroutine 仍可写入并退出，不会泄漏
+	eh := make(chan error, 1)
+	done := make(chan struct{}, 1)
 
 	go func() {
+		start := time.Now()
+		body := p.shared
+		if body == nil {
+			body = p.buf.Bytes()
+		}
 		h := new(header)
 		// 数据包的大小 = 包头 + 包体
-		h.PktSize = headerSize + uint16(p.buf.Len())
+		if p.shared != nil {
+			h.PktSize = headerSize + uint16(len(p.shared))
+		} else {
+			h.PktSize = headerSize + uint16(p.buf.Len())
+		}
 		h.MsgCount = p.num
 		h.SendTime = uint64(time.Now().UnixMilli())
 		if p.SeqNum != 0 {
 			h.SeqNum = p.SeqNum
 		}
+		h.Channel = p.Channel
 		b, err := codec.Marshal(h)
 		if err != nil {
 			eh <- err
@@ -97,8 +136,13 @@ func (w *Writer) WritePacket(ctx context.Context, p *Buffer) error {
 			eh <- err
 			return
 		}
-		// 写入包体
-		if _, err = p.buf.WriteTo(w.wr); err != nil {
+		// 写入包体，共享的包体不能被取出
+		if p.shared != nil {
+			_, err = w.wr.Write(p.shared)
+		} else {
+			_, err = p.buf.WriteTo(w.wr)
+		}
+		if err != nil {
 			eh <- err
 			return
 		}
@@ -107,6 +151,7 @@ func (w *Writer) WritePacket(ctx context.Context, p *Buffer) error {
 			eh <- err
 			return
 		}
+		w.metrics.written(body, time.Since(start))
 		// 重置序号，因为 p 可能会被重复使用
 		p.num = 0
 		done <- struct{}{}
@@ -128,8 +173,9 @@ func (w *Writer) WritePacket(ctx context.Context, p *Buffer) error {
 func (r *Reader) ReadPacket(ctx context.Context) (*Buffer, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	bh := make(chan *Buffer)
-	eh := make(chan error)
+	// 带缓冲，ctx 结束后 goroutine 仍可写入并退出，不会泄漏
+	bh := make(chan *Buffer, 1)
+	eh := make(chan error, 1)
 	go func() {
 		// 用于接受数据包头
 		b := make([]byte, headerSize)
@@ -139,6 +185,7 @@ func (r *Reader) ReadPacket(ctx context.Context) (*Buffer, error) {
 		}
 		p := new(Buffer)
 		if err := codec.Unmarshal(b, &p.header); err != nil {
+			r.metrics.decodeError()
 			eh <- err
 			return
 		}
@@ -150,6 +197,9 @@ func (r *Reader) ReadPacket(ctx context.Context) (*Buffer, error) {
 		}
 		p.buf.Write(b)
 		p.num = p.MsgCount
+		p.m = r.metrics
+		r.metrics.read(int(p.PktSize))
+		r.received(p)
 		bh <- p
 	}()
 
@@ -173,6 +223,9 @@ func (p *Buffer) WriteMessage(m model.Message) error {
 	if err != nil {
 		return err
 	}
+	if p.num == math.MaxUint8 || int(headerSize)+p.buf.Len()+len(b) > math.MaxUint16 {
+		return ErrPacketFull
+	}
 	if _, err := p.buf.Write(b); err != nil {
 		return err
 	}
@@ -180,6 +233,55 @@ func (p *Buffer) WriteMessage(m model.Message) error {
 	return nil
 }
 
+// Share 取出 p 中已写入的消息作为共享的包体，之后 p 可以继续复用
+func (p *Buffer) Share() *Shared {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shared != nil {
+		return &Shared{body: p.shared, num: p.num}
+	}
+	s := &Shared{
+		body: append([]byte(nil), p.buf.Bytes()...),
+		num:  p.num,
+	}
+	p.buf.Reset()
+	p.num = 0
+	return s
+}
+
+// Packet 返回一个引用 s 的包体的数据包。每个连接各用一个，包头(序号等)互不影响
+func (s *Shared) Packet() *Buffer {
+	return &Buffer{
+		shared: s.body,
+		num:    s.num,
+	}
+}
+
+// Bytes 编码好的包体，不能修改
+func (s *Shared) Bytes() []byte {
+	return s.body
+}
+
+// NumMessages 包体中消息的数量
+func (s *Shared) NumMessages() int {
+	return int(s.num)
+}
+
+// NewBuffer 用已编码的包体创建数据包，用于读出从其他传输方式(如 UDP 组播)收到的消息
+func NewBuffer(body []byte, num uint8) *Buffer {
+	p := &Buffer{num: num}
+	p.MsgCount = num
+	p.buf.Write(body)
+	return p
+}
+
+// NumMessages 数据包中尚未读出的消息数量
+func (p *Buffer) NumMessages() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return int(p.num)
+}
+
 // ReadMessage 读出一个消息
 func (p *Buffer) ReadMessage() (model.Message, error) {
 	p.mu.Lock()
@@ -191,6 +293,7 @@ func (p *Buffer) ReadMessage() (model.Message, error) {
 	}
 	// 查看消息头长度的字节，返回了一个副本并反序列化。此时，p.buf 中的字节并没有被取出
 	if err := codec.Unmarshal(p.buf.Bytes()[:model.MetaMessageSize], h); err != nil {
+		p.m.decodeError()
 		return nil, err
 	}
 	// 消息不完整
@@ -200,13 +303,16 @@ func (p *Buffer) ReadMessage() (model.Message, error) {
 	// 根据消息类型创建出结构体
 	m, err := model.NewMessage(h.MsgType)
 	if err != nil {
+		p.m.decodeError()
 		return nil, err
 	}
 	// 从 p.buf 中读出 MsgSize 个字节并反序列。等同于 Next 方法等同于 Read，只是不会返回 error
 	if err := codec.Unmarshal(p.buf.Next(int(h.MsgSize)), m); err != nil {
+		p.m.decodeError()
 		return nil, err
 	}
 	p.num--
+	p.m.readMessage(h.MsgType)
 	return m, nil
 }
 
@@ -1,9 +1,15 @@
 package packet
 
 import (
+	"20220923/internal/enum"
+	"20220923/internal/model"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"testing"
 	"time"
 )
@@ -47,3 +53,181 @@ func TestChannel(t *testing.T) {
 		}
 	}
 }
+
+func TestSocketOptions(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := SocketOptions{
+		Nagle:       true,
+		KeepAlive:   time.Second * 30,
+		ReadBuffer:  1 << 20,
+		WriteBuffer: 1 << 20,
+		ReaderSize:  1 << 16,
+		WriterSize:  1 << 16,
+		Linger:      time.Millisecond * 500,
+	}
+	s, err := NewSessionWith(conn, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Reader.rd.Size() != 1<<16 || s.Writer.wr.Size() != 1<<16 {
+		t.Fatalf("bufio size = %d/%d", s.Reader.rd.Size(), s.Writer.wr.Size())
+	}
+	// 写出再读回，确认连接仍然可用
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	p := new(Buffer)
+	p.SeqNum = 7
+	if err = s.WritePacket(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = s.ReadPacket(ctx); err != nil || p.SeqNum != 7 {
+		t.Fatalf("ReadPacket = %v, %v", p, err)
+	}
+
+	// 不支持的选项被忽略
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err = NewSessionWith(a, o); err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	a, b := net.Pipe()
+	sa, sb := NewSession(a), NewSession(b)
+	defer sa.Close()
+	defer sb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// 没有收到过数据包时不回显
+	hb := model.NewHeartBeatEcho()
+	sb.Echo(hb)
+	if hb.EchoTime != 0 {
+		t.Fatalf("EchoTime = %d", hb.EchoTime)
+	}
+	go func() { _ = sa.WritePacket(ctx, new(Buffer)) }()
+	if _, err := sb.ReadPacket(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sb.Latency().Count != 1 {
+		t.Fatalf("latency count = %d", sb.Latency().Count)
+	}
+	time.Sleep(time.Millisecond * 20)
+	sb.Echo(hb)
+	if hb.EchoTime == 0 || hb.EchoDelay < 20 {
+		t.Fatalf("echo = %d, %d", hb.EchoTime, hb.EchoDelay)
+	}
+	p := new(Buffer)
+	_ = p.WriteMessage(hb)
+	go func() { _ = sb.WritePacket(ctx, p) }()
+	p, err := sa.ReadPacket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := p.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, ok := sa.ObserveEcho(m.(*model.HeartBeatEcho), p)
+	if !ok {
+		t.Fatal("no clock sample")
+	}
+	// 同一台机器的时钟相同，偏差和往返时间只有毫秒级的截断误差，不含对端等待的 20 毫秒
+	if cs.Offset < -time.Millisecond*2 || cs.Offset > time.Millisecond*2 || cs.RTT > time.Millisecond*5 {
+		t.Fatalf("sample = %+v", cs)
+	}
+	if est, ok := sa.Clock(); !ok || est != cs {
+		t.Fatalf("estimate = %+v, %v", est, ok)
+	}
+}
+
+// 旧版本的消息布局，后来的字段都追加在末尾
+type loginV1 struct {
+	model.MetaMessage
+	Username [12]byte
+	Password [20]byte
+}
+
+type loginResponseV1 struct {
+	model.MetaMessage
+	SessionStatus uint8
+	_             [3]byte
+}
+
+type serverDemoV1 struct {
+	model.MetaMessage
+	_      [1]byte
+	Addr   [12]byte
+	Port   uint16
+	_      [2]byte
+	Remark [20]byte
+}
+
+func TestOldLayout(t *testing.T) {
+	login := &loginV1{MetaMessage: model.MetaMessage{MsgSize: 36, MsgType: enum.MsgTypeLogin}}
+	copy(login.Username[:], "mayee")
+	resp := &loginResponseV1{MetaMessage: model.MetaMessage{MsgSize: 8, MsgType: enum.MsgTypeLoginResponse}, SessionStatus: enum.SessionStatusInvalid}
+	demo := &serverDemoV1{MetaMessage: model.MetaMessage{MsgSize: 41, MsgType: enum.MsgTypeServerDemo}, Port: 30001}
+	copy(demo.Addr[:], "127.0.0.1")
+	p := new(Buffer)
+	for _, m := range []model.Message{login, resp, &model.MetaMessage{MsgSize: 4, MsgType: enum.MsgTypeClientDemo}, demo, model.NewHeartBeat()} {
+		if err := p.WriteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := p.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := m.(*model.Login); l.Username.String() != "mayee" || l.SeqNum != 0 || l.HeartBtInt != 0 {
+		t.Fatalf("login = %+v", l)
+	}
+	if m, err = p.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if r := m.(*model.LoginResponse); r.SessionStatus != enum.SessionStatusInvalid || r.Features != 0 || r.HeartBtInt != 0 {
+		t.Fatalf("login response = %+v", r)
+	}
+	if m, err = p.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if c := m.(*model.ClientDemo); c.CorrID != 0 {
+		t.Fatalf("client demo = %+v", c)
+	}
+	if m, err = p.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if d := m.(*model.ServerDemo); d.Addr.String() != "127.0.0.1" || d.Port != 30001 || d.CorrID != 0 {
+		t.Fatalf("server demo = %s", d)
+	}
+	// 之后的消息从正确的位置开始
+	if m, err = p.ReadMessage(); err != nil || m.Type() != enum.MsgTypeHeartBeat {
+		t.Fatalf("next message = %v, %v", m, err)
+	}
+
+	// 比旧版本还短的消息不完整
+	p = new(Buffer)
+	_ = p.WriteMessage(&model.MetaMessage{MsgSize: 4, MsgType: enum.MsgTypeLoginResponse})
+	if _, err = p.ReadMessage(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("short login response: err = %v", err)
+	}
+}
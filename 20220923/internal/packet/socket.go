@@ -0,0 +1,93 @@
+package packet
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+)
+
+// SocketOptions 连接的套接字选项和读写缓冲区大小，零值表示使用系统或 Go 的默认值。
+// 套接字选项只对支持的连接生效(如 TCP)，其它连接(Unix 域套接字、net.Pipe)忽略不支持的选项
+type SocketOptions struct {
+	Nagle       bool          `mapstructure:"nagle" comment:"启用 Nagle 算法(即关闭 TCP_NODELAY)。默认关闭，小包立即发送；带宽受限的广域网可以开启以减少包数"`
+	KeepAlive   time.Duration `mapstructure:"keepalive" comment:"TCP keepalive 探测间隔，0 使用默认值(15 秒)，小于 0 关闭"`
+	ReadBuffer  int           `mapstructure:"read_buffer" comment:"内核接收缓冲区大小(SO_RCVBUF)，0 使用系统默认值"`
+	WriteBuffer int           `mapstructure:"write_buffer" comment:"内核发送缓冲区大小(SO_SNDBUF)，0 使用系统默认值"`
+	ReaderSize  int           `mapstructure:"reader_size" comment:"bufio.Reader 的大小，0 使用默认值 4096"`
+	WriterSize  int           `mapstructure:"writer_size" comment:"bufio.Writer 的大小，0 使用默认值 4096"`
+	Linger      time.Duration `mapstructure:"linger" comment:"关闭连接时等待未发送数据的最长时间(SO_LINGER，精确到秒)，0 使用系统默认值(后台发送)，小于 0 表示丢弃未发送的数据并立即复位连接"`
+}
+
+// Apply 设置连接的套接字选项
+func (o SocketOptions) Apply(conn net.Conn) error {
+	if c, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+		if err := c.SetNoDelay(!o.Nagle); err != nil {
+			return err
+		}
+	}
+	if c, ok := conn.(interface {
+		SetKeepAlive(bool) error
+		SetKeepAlivePeriod(time.Duration) error
+	}); ok && o.KeepAlive != 0 {
+		if err := c.SetKeepAlive(o.KeepAlive > 0); err != nil {
+			return err
+		}
+		if o.KeepAlive > 0 {
+			if err := c.SetKeepAlivePeriod(o.KeepAlive); err != nil {
+				return err
+			}
+		}
+	}
+	if c, ok := conn.(interface{ SetReadBuffer(int) error }); ok && o.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if c, ok := conn.(interface{ SetWriteBuffer(int) error }); ok && o.WriteBuffer > 0 {
+		if err := c.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	if c, ok := conn.(interface{ SetLinger(int) error }); ok && o.Linger != 0 {
+		sec := 0
+		if o.Linger > 0 {
+			// 不足 1 秒按 1 秒，避免变成丢弃未发送的数据
+			sec = int((o.Linger + time.Second - 1) / time.Second)
+		}
+		if err := c.SetLinger(sec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSessionWith 设置套接字选项并按指定大小创建读写缓冲区
+func NewSessionWith(conn net.Conn, o SocketOptions) (*Session, error) {
+	if err := o.Apply(conn); err != nil {
+		return nil, err
+	}
+	return &Session{
+		Conn:   conn,
+		Reader: NewReaderSize(conn, o.ReaderSize),
+		Writer: NewWriterSize(conn, o.WriterSize),
+	}, nil
+}
+
+// NewReaderSize size <= 0 时使用 bufio 的默认大小
+func NewReaderSize(r io.Reader, size int) *Reader {
+	if size <= 0 {
+		return NewReader(r)
+	}
+	return newReader(bufio.NewReaderSize(r, size))
+}
+
+// NewWriterSize size <= 0 时使用 bufio 的默认大小
+func NewWriterSize(w io.Writer, size int) *Writer {
+	if size <= 0 {
+		return NewWriter(w)
+	}
+	return &Writer{
+		wr: bufio.NewWriterSize(w, size),
+	}
+}
@@ -0,0 +1,81 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrClosed 监听已关闭
+var ErrClosed = errors.New("pipe: listener closed")
+
+// Addr 内存连接的地址
+type Addr string
+
+func (a Addr) Network() string {
+	return "pipe"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+// Listener 进程内的监听，连接为 net.Pipe，不占用端口。用于同进程内嵌服务端以及集成测试
+type Listener struct {
+	addr  Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Listen name 仅用于日志中的地址
+func Listen(name string) *Listener {
+	return &Listener{
+		addr:  Addr(name),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept 等待 Dial 建立的连接
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close 之后 Accept 和 Dial 都返回 ErrClosed，已建立的连接不受影响
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial 建立一个连接，服务端 Accept 之后才返回
+func (l *Listener) Dial(ctx context.Context) (net.Conn, error) {
+	server, client := net.Pipe()
+	var err error
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		err = ErrClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	_ = server.Close()
+	_ = client.Close()
+	return nil, err
+}
+
+// DialContext 与 net.Dialer.DialContext 的签名相同，可以直接用作 client.Options.Dial，忽略 network 和 address
+func (l *Listener) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	return l.Dial(ctx)
+}
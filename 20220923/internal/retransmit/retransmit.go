@@ -0,0 +1,94 @@
+package retransmit
+
+import (
+	"20220923/internal/packet"
+	"sync"
+)
+
+// Buffer 已发送、尚未被对端确认(Ack)的业务数据包，断线重连后从对端已处理的位置重发
+type Buffer struct {
+	mu    sync.Mutex
+	max   int
+	items []item
+}
+
+type item struct {
+	seq    uint32 `comment:"数据包中第一条消息的序号"`
+	n      uint32 `comment:"数据包中消息的个数"`
+	shared *packet.Shared
+}
+
+// New max 为最多保存的数据包个数，超出时丢弃最早的数据包。max <= 0 表示不限制
+func New(max int) *Buffer {
+	return &Buffer{max: max}
+}
+
+// Add 保存一个已分配序号的数据包。返回 true 表示为此丢弃了最早的数据包
+func (b *Buffer) Add(seq uint32, n int, shared *packet.Shared) (dropped bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.max > 0 && len(b.items) >= b.max {
+		b.items[0] = item{}
+		b.items = b.items[1:]
+		dropped = true
+	}
+	b.items = append(b.items, item{seq: seq, n: uint32(n), shared: shared})
+	return dropped
+}
+
+// Ack 对端已处理序号 seq 及之前的消息，释放对应的数据包
+func (b *Buffer) Ack(seq uint32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := 0
+	for ; i < len(b.items); i++ {
+		if it := b.items[i]; it.seq+it.n-1 > seq {
+			break
+		}
+	}
+	if i == 0 {
+		return
+	}
+	// 复制到新的切片，释放已确认的数据包
+	b.items = append([]item(nil), b.items[i:]...)
+}
+
+// Since 返回包含序号 seq 及之后消息的数据包(已设置好序号)，用于重发
+func (b *Buffer) Since(seq uint32) []*packet.Buffer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ps []*packet.Buffer
+	for _, it := range b.items {
+		if it.seq+it.n-1 < seq {
+			continue
+		}
+		p := it.shared.Packet()
+		p.SeqNum = it.seq
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// First 最早的未确认消息的序号，没有未确认的消息时返回 0
+func (b *Buffer) First() uint32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.items) == 0 {
+		return 0
+	}
+	return b.items[0].seq
+}
+
+// Len 未确认的数据包个数
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.items)
+}
+
+// Reset 丢弃所有未确认的数据包
+func (b *Buffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.items = nil
+}
@@ -0,0 +1,49 @@
+package retransmit
+
+import (
+	"20220923/internal/model"
+	"20220923/internal/packet"
+	"testing"
+)
+
+func shared(n int) *packet.Shared {
+	p := new(packet.Buffer)
+	for i := 0; i < n; i++ {
+		_ = p.WriteMessage(model.NewClientDemo())
+	}
+	return p.Share()
+}
+
+func TestBuffer(t *testing.T) {
+	b := New(3)
+	// 序号 1、2-3、4
+	b.Add(1, 1, shared(1))
+	b.Add(2, 2, shared(2))
+	b.Add(4, 1, shared(1))
+
+	ps := b.Since(3)
+	if len(ps) != 2 || ps[0].SeqNum != 2 || ps[1].SeqNum != 4 {
+		t.Fatalf("Since(3) = %d packets", len(ps))
+	}
+	if n := ps[0].NumMessages(); n != 2 {
+		t.Fatalf("NumMessages = %d", n)
+	}
+
+	// 只确认了序号 2，包含 2-3 的数据包仍需保留
+	b.Ack(2)
+	if first := b.First(); first != 2 {
+		t.Fatalf("First = %d, want 2", first)
+	}
+	b.Ack(3)
+	if first := b.First(); first != 4 || b.Len() != 1 {
+		t.Fatalf("First = %d, Len = %d", first, b.Len())
+	}
+
+	b.Add(5, 1, shared(1))
+	if dropped := b.Add(6, 1, shared(1)); dropped {
+		t.Fatal("dropped before full")
+	}
+	if dropped := b.Add(7, 1, shared(1)); !dropped || b.First() != 5 {
+		t.Fatalf("dropped = %v, First = %d", dropped, b.First())
+	}
+}
@@ -0,0 +1,386 @@
+package transfer
+
+import (
+	"20220923/internal/enum"
+	"20220923/internal/model"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxSize   = 64 << 20
+	defaultMaxMemory = 256 << 20
+	defaultMaxActive = 16
+	defaultTimeout   = time.Second * 30
+	// 发送方取消时发送 TransferCancel 的最长等待时间
+	cancelTimeout = time.Second
+)
+
+// Limits 接收方的限制，超出时取消传输
+type Limits struct {
+	MaxSize   uint64        `comment:"单个传输的最大字节数，默认 64MB"`
+	MaxMemory uint64        `comment:"所有进行中的传输已接收的字节数合计的上限，默认 256MB"`
+	MaxActive int           `comment:"同时进行的传输个数，默认 16"`
+	Timeout   time.Duration `comment:"两个分片之间的最长间隔，超时的传输被丢弃，默认 30 秒"`
+	Budget    *Budget       `comment:"多个 Assembler 共用的内存预算，如服务端所有用户的传输合计，为 nil 时只按 MaxMemory 限制"`
+}
+
+// Budget 多个 Assembler 共用的内存预算，并发安全
+type Budget struct {
+	mu   sync.Mutex
+	max  uint64
+	used uint64
+}
+
+// NewBudget max 为 0 时使用默认的 256MB
+func NewBudget(max uint64) *Budget {
+	if max == 0 {
+		max = defaultMaxMemory
+	}
+	return &Budget{max: max}
+}
+
+func (b *Budget) reserve(n uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *Budget) release(n uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// Used 已预留的字节数
+func (b *Budget) Used() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Transfer 接收完成的数据
+type Transfer struct {
+	ID   uint32
+	Name string
+	Data []byte
+}
+
+// CancelError 传输被取消。由 Assembler 返回时调用方应把 Cancel 返回的消息发给发送方；
+// 由 Senders.Send 返回时表示接收方取消了传输
+type CancelError struct {
+	ID     uint32
+	Reason uint8
+	Err    error
+}
+
+func (e *CancelError) Error() string {
+	return fmt.Sprintf("transfer %d cancelled, reason %d: %v", e.ID, e.Reason, e.Err)
+}
+
+func (e *CancelError) Unwrap() error {
+	return e.Err
+}
+
+// Cancel 通知发送方的 TransferCancel 消息
+func (e *CancelError) Cancel() *model.TransferCancel {
+	m := model.NewTransferCancel()
+	m.TransferID = e.ID
+	m.Reason = e.Reason
+	m.Origin = enum.TransferOriginReceiver
+	return m
+}
+
+// partial 进行中的传输
+type partial struct {
+	name    string
+	size    uint64
+	data    []byte
+	updated time.Time
+}
+
+// Assembler 在接收方按传输 ID 重组分片，并发安全。
+// 缓冲区随分片到达增长，内存按已接收的字节数计算；长时间没有新分片的传输由定时器丢弃
+type Assembler struct {
+	mu     sync.Mutex
+	limits Limits
+	active map[uint32]*partial
+	used   uint64      `comment:"进行中的传输已接收的字节数"`
+	timer  *time.Timer `comment:"有进行中的传输时运行，到期时丢弃超时的传输"`
+}
+
+func NewAssembler(l Limits) *Assembler {
+	if l.MaxSize == 0 {
+		l.MaxSize = defaultMaxSize
+	}
+	if l.MaxMemory == 0 {
+		l.MaxMemory = defaultMaxMemory
+	}
+	if l.MaxActive <= 0 {
+		l.MaxActive = defaultMaxActive
+	}
+	if l.Timeout <= 0 {
+		l.Timeout = defaultTimeout
+	}
+	return &Assembler{
+		limits: l,
+		active: make(map[uint32]*partial),
+	}
+}
+
+// IsTransfer 是否为分片传输的消息
+func IsTransfer(m model.Message) bool {
+	switch m.Type() {
+	case enum.MsgTypeTransferStart, enum.MsgTypeTransferChunk, enum.MsgTypeTransferEnd, enum.MsgTypeTransferCancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Handle 处理一个分片传输的消息，传输完成时返回 Transfer。
+// 超出限制或数据有误时丢弃该传输并返回 *CancelError；未知传输 ID 的分片(如已取消的传输)被忽略
+func (a *Assembler) Handle(m model.Message) (*Transfer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	switch m := m.(type) {
+	case *model.TransferStart:
+		if _, ok := a.active[m.TransferID]; ok {
+			a.drop(m.TransferID)
+			return nil, &CancelError{ID: m.TransferID, Reason: enum.TransferCancelInvalid, Err: errors.New("duplicate transfer id")}
+		}
+		if m.TotalSize > a.limits.MaxSize || len(a.active) >= a.limits.MaxActive {
+			return nil, &CancelError{ID: m.TransferID, Reason: enum.TransferCancelTooLarge, Err: fmt.Errorf("size %d exceeds limits", m.TotalSize)}
+		}
+		a.active[m.TransferID] = &partial{
+			name:    m.Name.String(),
+			size:    m.TotalSize,
+			updated: now,
+		}
+		if a.timer == nil {
+			a.timer = time.AfterFunc(a.limits.Timeout, a.onTimer)
+		}
+	case *model.TransferChunk:
+		p, ok := a.active[m.TransferID]
+		if !ok {
+			return nil, nil
+		}
+		if m.Offset != uint64(len(p.data)) || m.Offset+uint64(len(m.Data)) > p.size {
+			a.drop(m.TransferID)
+			return nil, &CancelError{ID: m.TransferID, Reason: enum.TransferCancelInvalid, Err: fmt.Errorf("unexpected chunk offset %d, length %d", m.Offset, len(m.Data))}
+		}
+		if !a.reserve(uint64(len(m.Data))) {
+			a.drop(m.TransferID)
+			return nil, &CancelError{ID: m.TransferID, Reason: enum.TransferCancelTooLarge, Err: fmt.Errorf("memory limit exceeded at offset %d", m.Offset)}
+		}
+		p.data = append(p.data, m.Data...)
+		p.updated = now
+	case *model.TransferEnd:
+		p, ok := a.active[m.TransferID]
+		if !ok {
+			return nil, nil
+		}
+		a.drop(m.TransferID)
+		if uint64(len(p.data)) != p.size {
+			return nil, &CancelError{ID: m.TransferID, Reason: enum.TransferCancelInvalid, Err: fmt.Errorf("received %d of %d bytes", len(p.data), p.size)}
+		}
+		if sum := crc32.ChecksumIEEE(p.data); sum != m.Checksum {
+			return nil, &CancelError{ID: m.TransferID, Reason: enum.TransferCancelChecksum, Err: fmt.Errorf("checksum %08x, want %08x", sum, m.Checksum)}
+		}
+		return &Transfer{ID: m.TransferID, Name: p.name, Data: p.data}, nil
+	case *model.TransferCancel:
+		// 接收方发出的取消属于本端发出的传输，由 Senders 处理
+		if m.Origin == enum.TransferOriginSender {
+			a.drop(m.TransferID)
+		}
+	}
+	return nil, nil
+}
+
+// onTimer 丢弃长时间未收到分片的传输，还有进行中的传输时在最早的超时时间再次运行
+func (a *Assembler) onTimer() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	next := a.limits.Timeout
+	for id, p := range a.active {
+		if d := a.limits.Timeout - now.Sub(p.updated); d <= 0 {
+			a.drop(id)
+		} else if d < next {
+			next = d
+		}
+	}
+	if len(a.active) == 0 {
+		a.timer = nil
+		return
+	}
+	a.timer.Reset(next)
+}
+
+// reserve 按接收的字节数预留内存，超出本 Assembler 或共用预算的上限时返回 false
+func (a *Assembler) reserve(n uint64) bool {
+	if a.used+n > a.limits.MaxMemory {
+		return false
+	}
+	if a.limits.Budget != nil && !a.limits.Budget.reserve(n) {
+		return false
+	}
+	a.used += n
+	return true
+}
+
+func (a *Assembler) drop(id uint32) {
+	if p, ok := a.active[id]; ok {
+		a.release(uint64(len(p.data)))
+		delete(a.active, id)
+	}
+}
+
+func (a *Assembler) release(n uint64) {
+	a.used -= n
+	if a.limits.Budget != nil {
+		a.limits.Budget.release(n)
+	}
+}
+
+// Active 进行中的传输个数
+func (a *Assembler) Active() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.active)
+}
+
+// Reset 丢弃所有进行中的传输
+func (a *Assembler) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active = make(map[uint32]*partial)
+	a.release(a.used)
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+}
+
+// Senders 分配发送方的传输 ID，收到接收方的 TransferCancel 时中止对应的发送，并发安全
+type Senders struct {
+	mu     sync.Mutex
+	nextID uint32
+	active map[uint32]*sending
+}
+
+// sending 进行中的发送
+type sending struct {
+	cancel context.CancelFunc
+	reason uint8 `comment:"接收方取消的原因，0 表示未被取消"`
+}
+
+func NewSenders() *Senders {
+	return &Senders{active: make(map[uint32]*sending)}
+}
+
+// Send 分配传输 ID 后发送 data，同 Send。接收方取消时返回 *CancelError
+func (s *Senders) Send(ctx context.Context, name string, data []byte, write func(ctx context.Context, m model.Message) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	st := &sending{cancel: cancel}
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.active[id] = st
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.active, id)
+		s.mu.Unlock()
+	}()
+	return send(ctx, id, name, data, write, func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if st.reason == 0 {
+			return nil
+		}
+		return &CancelError{ID: id, Reason: st.reason, Err: errors.New("cancelled by receiver")}
+	})
+}
+
+// Cancelled 处理接收方发来的 TransferCancel，中止对应的发送。传输已结束或 ID 未知时返回 false
+func (s *Senders) Cancelled(m *model.TransferCancel) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.active[m.TransferID]
+	if !ok || st.reason != 0 {
+		return false
+	}
+	st.reason = m.Reason
+	if st.reason == 0 {
+		st.reason = enum.TransferCancelInvalid
+	}
+	st.cancel()
+	return true
+}
+
+// Send 把 data 拆分为 TransferStart、TransferChunk、TransferEnd 依次交给 write，每个消息单独一个数据包。
+// ctx 结束或 write 出错时发送 TransferCancel 并返回该错误
+func Send(ctx context.Context, id uint32, name string, data []byte, write func(ctx context.Context, m model.Message) error) error {
+	return send(ctx, id, name, data, write, nil)
+}
+
+// send rejected 不为 nil 且返回错误时表示接收方已取消，不再通知接收方
+func send(ctx context.Context, id uint32, name string, data []byte, write func(ctx context.Context, m model.Message) error, rejected func() error) error {
+	// stop 发送中止时通知接收方丢弃已收到的分片
+	stop := func(err error) error {
+		if rejected != nil {
+			if rerr := rejected(); rerr != nil {
+				return rerr
+			}
+		}
+		cancel(id, write)
+		return err
+	}
+	start := model.NewTransferStart()
+	start.TransferID = id
+	start.TotalSize = uint64(len(data))
+	start.Name.Set([]byte(name))
+	if err := write(ctx, start); err != nil {
+		return stop(err)
+	}
+	for off := 0; off < len(data); off += model.MaxChunkSize {
+		if err := ctx.Err(); err != nil {
+			return stop(err)
+		}
+		chunk := model.NewTransferChunk()
+		chunk.TransferID = id
+		chunk.Offset = uint64(off)
+		chunk.SetData(data[off:])
+		if err := write(ctx, chunk); err != nil {
+			return stop(err)
+		}
+	}
+	end := model.NewTransferEnd()
+	end.TransferID = id
+	end.Checksum = crc32.ChecksumIEEE(data)
+	if err := write(ctx, end); err != nil {
+		return stop(err)
+	}
+	return nil
+}
+
+func cancel(id uint32, write func(ctx context.Context, m model.Message) error) {
+	m := model.NewTransferCancel()
+	m.TransferID = id
+	m.Reason = enum.TransferCancelSender
+	m.Origin = enum.TransferOriginSender
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	_ = write(ctx, m)
+}
@@ -0,0 +1,249 @@
+package transfer
+
+import (
+	"20220923/internal/enum"
+	"20220923/internal/model"
+	"20220923/internal/packet"
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// roundTrip 经过编码、解码后交给 Assembler
+func roundTrip(t *testing.T, a *Assembler, done *[]*Transfer) func(ctx context.Context, m model.Message) error {
+	return func(_ context.Context, m model.Message) error {
+		p := new(packet.Buffer)
+		if err := p.WriteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+		m, err := p.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err := a.Handle(m)
+		if err != nil {
+			return err
+		}
+		if tr != nil {
+			*done = append(*done, tr)
+		}
+		return nil
+	}
+}
+
+func TestSend(t *testing.T) {
+	data := make([]byte, model.MaxChunkSize*2+100)
+	rand.Read(data)
+	a := NewAssembler(Limits{})
+	var done []*Transfer
+	if err := Send(context.Background(), 1, "snapshot", data, roundTrip(t, a, &done)); err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 || done[0].Name != "snapshot" || !bytes.Equal(done[0].Data, data) {
+		t.Fatalf("transfers = %d", len(done))
+	}
+	if n := a.Active(); n != 0 {
+		t.Fatalf("Active = %d", n)
+	}
+
+	// 空数据只有开始和结束
+	done = nil
+	if err := Send(context.Background(), 2, "empty", nil, roundTrip(t, a, &done)); err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 || len(done[0].Data) != 0 {
+		t.Fatalf("empty transfer = %v", done)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	a := NewAssembler(Limits{MaxSize: 100, MaxMemory: 150})
+	start := func(id uint32, size uint64) error {
+		m := model.NewTransferStart()
+		m.TransferID = id
+		m.TotalSize = size
+		_, err := a.Handle(m)
+		return err
+	}
+	chunk := func(id uint32, off uint64, n int) error {
+		m := model.NewTransferChunk()
+		m.TransferID = id
+		m.Offset = off
+		m.SetData(make([]byte, n))
+		_, err := a.Handle(m)
+		return err
+	}
+	var ce *CancelError
+	if err := start(1, 101); !errors.As(err, &ce) || ce.Reason != enum.TransferCancelTooLarge {
+		t.Fatalf("MaxSize: err = %v", err)
+	}
+	// 内存按已接收的字节数计算，开始时不预留
+	if err := start(2, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := start(3, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk(2, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk(3, 0, 100); !errors.As(err, &ce) || ce.Reason != enum.TransferCancelTooLarge {
+		t.Fatalf("MaxMemory: err = %v", err)
+	}
+	// 取消后释放内存
+	cancel := model.NewTransferCancel()
+	cancel.TransferID = 2
+	if _, err := a.Handle(cancel); err != nil {
+		t.Fatal(err)
+	}
+	if err := start(3, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk(3, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// 偏移量不连续
+	if err := chunk(3, 10, 3); !errors.As(err, &ce) || ce.Reason != enum.TransferCancelInvalid {
+		t.Fatalf("offset: err = %v", err)
+	}
+	// 已取消的传输的分片被忽略
+	if err := chunk(3, 0, 3); err != nil || a.Active() != 0 {
+		t.Fatalf("after cancel: %v, active = %d", err, a.Active())
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(150)
+	a1 := NewAssembler(Limits{Budget: b})
+	a2 := NewAssembler(Limits{Budget: b})
+	var done []*Transfer
+	if err := Send(context.Background(), 1, "a", make([]byte, 100), roundTrip(t, a1, &done)); err != nil {
+		t.Fatal(err)
+	}
+	// 完成的传输释放预算
+	if len(done) != 1 || b.Used() != 0 {
+		t.Fatalf("transfers = %d, used = %d", len(done), b.Used())
+	}
+	start := model.NewTransferStart()
+	start.TransferID = 1
+	start.TotalSize = 100
+	chunk := model.NewTransferChunk()
+	chunk.TransferID = 1
+	chunk.SetData(make([]byte, 100))
+	for _, m := range []model.Message{start, chunk} {
+		if _, err := a1.Handle(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 另一个 Assembler 共用同一预算
+	if _, err := a2.Handle(start); err != nil {
+		t.Fatal(err)
+	}
+	var ce *CancelError
+	if _, err := a2.Handle(chunk); !errors.As(err, &ce) || ce.Reason != enum.TransferCancelTooLarge {
+		t.Fatalf("shared budget: err = %v", err)
+	}
+	a1.Reset()
+	if b.Used() != 0 {
+		t.Fatalf("used after reset = %d", b.Used())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	b := NewBudget(0)
+	a := NewAssembler(Limits{Timeout: time.Millisecond * 20, Budget: b})
+	start := model.NewTransferStart()
+	start.TransferID = 1
+	start.TotalSize = 100
+	chunk := model.NewTransferChunk()
+	chunk.TransferID = 1
+	chunk.SetData(make([]byte, 10))
+	for _, m := range []model.Message{start, chunk} {
+		if _, err := a.Handle(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 不再收到消息也会被定时器丢弃
+	deadline := time.Now().Add(time.Second)
+	for a.Active() != 0 || b.Used() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("active = %d, used = %d", a.Active(), b.Used())
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	a := NewAssembler(Limits{})
+	var done []*Transfer
+	write := roundTrip(t, a, &done)
+	err := Send(context.Background(), 1, "doc", []byte("hello"), func(ctx context.Context, m model.Message) error {
+		if end, ok := m.(*model.TransferEnd); ok {
+			end.Checksum++
+		}
+		return write(ctx, m)
+	})
+	var ce *CancelError
+	if !errors.As(err, &ce) || ce.Reason != enum.TransferCancelChecksum || len(done) != 0 {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	a := NewAssembler(Limits{})
+	var done []*Transfer
+	write := roundTrip(t, a, &done)
+	ctx, cancel := context.WithCancel(context.Background())
+	var last model.Message
+	err := Send(ctx, 1, "doc", make([]byte, model.MaxChunkSize*3), func(ctx context.Context, m model.Message) error {
+		if m.Type() == enum.MsgTypeTransferChunk {
+			// 发出第一个分片后取消
+			cancel()
+		}
+		last = m
+		return write(ctx, m)
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v", err)
+	}
+	if last.Type() != enum.MsgTypeTransferCancel || a.Active() != 0 {
+		t.Fatalf("last message = %d, active = %d", last.Type(), a.Active())
+	}
+}
+
+func TestReject(t *testing.T) {
+	s := NewSenders()
+	a := NewAssembler(Limits{MaxSize: model.MaxChunkSize})
+	var sent []model.Message
+	err := s.Send(context.Background(), "doc", make([]byte, model.MaxChunkSize*3), func(ctx context.Context, m model.Message) error {
+		sent = append(sent, m)
+		_, err := a.Handle(m)
+		var ce *CancelError
+		if errors.As(err, &ce) && !s.Cancelled(ce.Cancel()) {
+			t.Fatal("transfer not active")
+		}
+		return ctx.Err()
+	})
+	var ce *CancelError
+	if !errors.As(err, &ce) || ce.Reason != enum.TransferCancelTooLarge {
+		t.Fatalf("err = %v", err)
+	}
+	// 接收方已取消，发送方不再发送 TransferCancel
+	if len(sent) != 1 || sent[0].Type() != enum.MsgTypeTransferStart {
+		t.Fatalf("sent %d messages", len(sent))
+	}
+
+	// 接收方发出的取消不影响本端正在接收的同一 ID 的传输
+	start := model.NewTransferStart()
+	start.TransferID = 1
+	if _, err = a.Handle(start); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Handle(ce.Cancel()); err != nil || a.Active() != 1 {
+		t.Fatalf("receiver cancel: %v, active = %d", err, a.Active())
+	}
+}
@@ -1,5 +1,7 @@
 package typebase
 
+import "encoding/json"
+
 type ByteArrayL12 [12]byte
 
 func (s *ByteArrayL12) Set(b []byte) {
@@ -51,3 +53,33 @@ func (s *ByteArrayL20) Bytes() []byte {
 func (s *ByteArrayL20) String() string {
 	return string(s.Bytes())
 }
+
+// MarshalJSON 编码为字符串
+func (s ByteArrayL12) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON 超过长度的部分被截断
+func (s *ByteArrayL12) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	s.Set([]byte(str))
+	return nil
+}
+
+// MarshalJSON 编码为字符串
+func (s ByteArrayL20) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON 超过长度的部分被截断
+func (s *ByteArrayL20) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	s.Set([]byte(str))
+	return nil
+}
@@ -0,0 +1,21 @@
+package server
+
+// Authenticator 校验登录请求中的账号密码
+type Authenticator interface {
+	Authenticate(username, password string) bool
+}
+
+// AuthenticatorFunc 函数形式的 Authenticator
+type AuthenticatorFunc func(username, password string) bool
+
+func (f AuthenticatorFunc) Authenticate(username, password string) bool {
+	return f(username, password)
+}
+
+// StaticUsers 使用固定的账号密码表校验
+func StaticUsers(users map[string]string) Authenticator {
+	return AuthenticatorFunc(func(username, password string) bool {
+		p, ok := users[username]
+		return ok && p == password
+	})
+}
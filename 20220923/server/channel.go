@@ -0,0 +1,112 @@
+package server
+
+import (
+	"20220923/internal/packet"
+	"20220923/internal/retransmit"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// ErrUnknownChannel 写入未配置的逻辑通道
+var ErrUnknownChannel = errors.New("server: unknown channel")
+
+// ChannelConfig 逻辑通道。一个连接上可以承载多个逻辑通道(如委托、行情、管理)，每个通道有独立的序号、发送队列、流量控制和优先级。
+// 通道 0 为默认通道，始终存在；只有默认通道的消息在断线重连后续传
+type ChannelConfig struct {
+	ID       uint8
+	Name     string `comment:"通道名称，用于日志"`
+	Priority int    `comment:"优先级，数值大的通道先写出"`
+	Window   int    `comment:"流量控制：已发送未确认的数据包达到该个数时暂停写出该通道，0 表示不限制"`
+}
+
+// channel 会话中一个逻辑通道的状态
+type channel struct {
+	ChannelConfig
+	out     chan *packet.Buffer `comment:"待写回客户端的业务数据包，写出时分配序号"`
+	bulk    chan *packet.Buffer `comment:"分片传输的数据包，与 out 交替写出，不按 OverflowPolicy 丢弃"`
+	unacked *retransmit.Buffer  `comment:"已发送未确认的业务数据包。默认通道的属于用户，断线后保留"`
+
+	// 以下字段使用 atomic 读写
+	nextSeq uint32 // 下一条业务消息的序号
+	ackSeq  uint32 // 已处理的客户端业务消息的最大序号
+}
+
+// newChannel 非默认通道的未确认数据包只用于流量控制，不启用流量控制时最多保留 queueSize 个
+func newChannel(cfg ChannelConfig, queueSize int) *channel {
+	max := cfg.Window
+	if max <= 0 {
+		max = queueSize
+	}
+	return &channel{
+		ChannelConfig: cfg,
+		out:           make(chan *packet.Buffer, queueSize),
+		bulk:          make(chan *packet.Buffer, queueSize),
+		unacked:       retransmit.New(max),
+		nextSeq:       1,
+	}
+}
+
+// open 流量控制窗口是否允许继续写出
+func (c *channel) open() bool {
+	return c.Window <= 0 || c.unacked.Len() < c.Window
+}
+
+// ChannelInfo 逻辑通道的快照
+type ChannelInfo struct {
+	ID       uint8
+	Name     string
+	NextSeq  uint32
+	AckSeq   uint32
+	QueueLen int
+	Unacked  int
+}
+
+func (c *channel) info() ChannelInfo {
+	return ChannelInfo{
+		ID:       c.ID,
+		Name:     c.Name,
+		NextSeq:  atomic.LoadUint32(&c.nextSeq),
+		AckSeq:   atomic.LoadUint32(&c.ackSeq),
+		QueueLen: len(c.out) + len(c.bulk),
+		Unacked:  c.unacked.Len(),
+	}
+}
+
+// sortChannels 补上默认通道并按优先级排序，ID 重复时 panic
+func sortChannels(cs []ChannelConfig) []ChannelConfig {
+	seen := make(map[uint8]bool, len(cs)+1)
+	out := make([]ChannelConfig, 0, len(cs)+1)
+	for _, c := range cs {
+		if seen[c.ID] {
+			panic(fmt.Sprintf("server: duplicate channel %d", c.ID))
+		}
+		seen[c.ID] = true
+		out = append(out, c)
+	}
+	if !seen[0] {
+		out = append(out, ChannelConfig{ID: 0, Name: "default"})
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Priority != out[j].Priority {
+			return out[i].Priority > out[j].Priority
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+type channelKey struct{}
+
+// withChannel 记录消息所在的逻辑通道
+func withChannel(ctx context.Context, id uint8) context.Context {
+	return context.WithValue(ctx, channelKey{}, id)
+}
+
+// ChannelFromContext 处理函数中取出请求所在的逻辑通道，Session.Write 默认回复到该通道
+func ChannelFromContext(ctx context.Context) uint8 {
+	id, _ := ctx.Value(channelKey{}).(uint8)
+	return id
+}
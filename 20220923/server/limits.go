@@ -0,0 +1,160 @@
+package server
+
+import (
+	"20220923/internal/enum"
+	"fmt"
+	"golang.org/x/time/rate"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits 登录之前的连接限制，零值表示不限制
+type Limits struct {
+	LoginTimeout  time.Duration `comment:"accept 之后必须在该时间内完成登录"`
+	MaxPending    int           `comment:"未登录连接的最大数量"`
+	ConnRate      rate.Limit    `comment:"同一 IP 每秒最多新建的连接数"`
+	ConnBurst     int           `comment:"同一 IP 短时间内允许的突发连接数"`
+	MaxFailures   int           `comment:"同一 IP 在 FailureWindow 内登录失败达到该次数后锁定"`
+	FailureWindow time.Duration `comment:"统计登录失败次数的时间窗口"`
+	LockoutPeriod time.Duration `comment:"锁定时长"`
+}
+
+const (
+	defaultLoginTimeout = time.Second * 10
+	// 按 IP 记录的状态超过该时间未更新则清理
+	guardIdleTimeout = time.Minute * 10
+)
+
+// ipState 某个 IP 的连接频率和登录失败记录
+type ipState struct {
+	limiter     *rate.Limiter
+	failures    int
+	firstFail   time.Time
+	lockedUntil time.Time
+	lastSeen    time.Time
+}
+
+// guard 在 accept 和登录时执行 Limits
+type guard struct {
+	limits Limits
+
+	mu        sync.Mutex
+	pending   int
+	ips       map[string]*ipState
+	lastSweep time.Time
+}
+
+func newGuard(limits Limits) *guard {
+	if limits.ConnRate > 0 && limits.ConnBurst <= 0 {
+		limits.ConnBurst = 1
+	}
+	return &guard{
+		limits: limits,
+		ips:    make(map[string]*ipState),
+	}
+}
+
+// accept 在 accept 之后调用，不允许连接时返回对应的登录响应状态。返回 nil 时计入未登录连接，登录结束后需调用 loginDone
+func (g *guard) accept(ip net.IP) (uint8, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.sweep(now)
+	if ip != nil {
+		if status, err := g.check(ip, now); err != nil {
+			return status, err
+		}
+	}
+	if g.limits.MaxPending > 0 && g.pending >= g.limits.MaxPending {
+		return enum.SessionStatusBusy, fmt.Errorf("too many pending logins (%d)", g.pending)
+	}
+	g.pending++
+	return 0, nil
+}
+
+// forwarded 网关转发的客户端 IP 同样按 IP 限制连接频率和锁定，网关自身的 IP 在 accept 时不受限制
+func (g *guard) forwarded(ip net.IP) (uint8, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.check(ip, time.Now())
+}
+
+func (g *guard) check(ip net.IP, now time.Time) (uint8, error) {
+	st := g.state(ip, now)
+	if now.Before(st.lockedUntil) {
+		return enum.SessionStatusLocked, fmt.Errorf("ip %s locked until %s", ip, st.lockedUntil.Format(time.RFC3339))
+	}
+	if st.limiter != nil && !st.limiter.AllowN(now, 1) {
+		return enum.SessionStatusRateLimited, fmt.Errorf("ip %s connecting too frequently", ip)
+	}
+	return 0, nil
+}
+
+// loginDone 登录结束(无论成功与否)
+func (g *guard) loginDone() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending--
+}
+
+// loginFailed 记录一次登录失败，达到次数后锁定该 IP
+func (g *guard) loginFailed(ip net.IP) (locked bool) {
+	if ip == nil || g.limits.MaxFailures <= 0 {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	st := g.state(ip, now)
+	if st.failures == 0 || (g.limits.FailureWindow > 0 && now.Sub(st.firstFail) > g.limits.FailureWindow) {
+		st.failures = 0
+		st.firstFail = now
+	}
+	st.failures++
+	if st.failures < g.limits.MaxFailures {
+		return false
+	}
+	st.failures = 0
+	st.lockedUntil = now.Add(g.limits.LockoutPeriod)
+	return true
+}
+
+// loginSucceeded 登录成功后清除失败记录
+func (g *guard) loginSucceeded(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if st, ok := g.ips[ip.String()]; ok {
+		st.failures = 0
+	}
+}
+
+func (g *guard) state(ip net.IP, now time.Time) *ipState {
+	key := ip.String()
+	st, ok := g.ips[key]
+	if !ok {
+		st = new(ipState)
+		if g.limits.ConnRate > 0 {
+			st.limiter = rate.NewLimiter(g.limits.ConnRate, g.limits.ConnBurst)
+		}
+		g.ips[key] = st
+	}
+	st.lastSeen = now
+	return st
+}
+
+// sweep 清理长时间没有连接且未被锁定的 IP，避免 map 无限增长
+func (g *guard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+	for k, st := range g.ips {
+		if now.Sub(st.lastSeen) > guardIdleTimeout && now.After(st.lockedUntil) {
+			delete(g.ips, k)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"20220923/internal/metrics"
+	"20220923/internal/packet"
+	"sync/atomic"
+)
+
+// serverMetrics 服务端的连接、登录、心跳和发送队列指标，数据包的读写由 packet.Metrics 统计
+type serverMetrics struct {
+	packets           *packet.Metrics
+	accepted          *metrics.Counter
+	rejected          *metrics.CounterVec
+	logins            *metrics.CounterVec
+	heartbeatTimeouts *metrics.Counter
+}
+
+// newServerMetrics 未调用 WithMetrics 时注册到一个不对外输出的 Registry
+func newServerMetrics(s *Server) *serverMetrics {
+	r := s.metricsRegistry
+	if r == nil {
+		r = metrics.NewRegistry()
+	}
+	r.GaugeFunc("server_connections", "Open connections, including those not logged in yet.", func() float64 {
+		return float64(s.connCount())
+	})
+	r.GaugeFunc("server_sessions", "Logged in sessions.", func() float64 {
+		return float64(s.registry.Len())
+	})
+	r.GaugeFunc("server_queue_depth", "Packets waiting in the outbound queues of all sessions.", func() float64 {
+		return float64(atomic.LoadInt64(&s.queueDepth))
+	})
+	return &serverMetrics{
+		packets:           packet.NewMetrics(r, "server"),
+		accepted:          r.Counter("server_connections_accepted_total", "Accepted connections.").With(),
+		rejected:          r.Counter("server_connections_rejected_total", "Connections rejected before login by login response status.", "status"),
+		logins:            r.Counter("server_logins_total", "Login attempts by login response status.", "status"),
+		heartbeatTimeouts: r.Counter("server_heartbeat_timeouts_total", "Sessions closed because the client stopped sending.").With(),
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"20220923/internal/model"
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Middleware 包装 HandlerFunc，在消息处理前后插入通用逻辑
+type Middleware func(HandlerFunc) HandlerFunc
+
+// Chain 按顺序组合中间件，第一个中间件在最外层
+func Chain(h HandlerFunc, mws ...Middleware) HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Recovery 恢复单条消息处理中的 panic，只丢弃这条消息，不断开会话
+func Recovery() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, s *Session, m model.Message) (err error) {
+			defer func() {
+				if exp := recover(); exp != nil {
+					s.Logger().Errorf("[recovered] panic: %v, username=[%s], msg_type=[%d]\n%s", exp, s.Username(), m.Type(), debug.Stack())
+					err = nil
+				}
+			}()
+			return next(ctx, s, m)
+		}
+	}
+}
+
+// Logging 记录每条消息的处理结果和耗时
+func Logging() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, s *Session, m model.Message) error {
+			start := time.Now()
+			err := next(ctx, s, m)
+			if err != nil {
+				s.Logger().Warnf("handle message failed. username=[%s], msg_type=[%d], cost=[%s], err=[%v]", s.Username(), m.Type(), time.Since(start), err)
+			} else {
+				s.Logger().Debugf("handle message. username=[%s], msg_type=[%d], cost=[%s]", s.Username(), m.Type(), time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// HandlerStat 某个消息类型的处理统计
+type HandlerStat struct {
+	Count  uint64
+	Errors uint64
+	Total  time.Duration
+	Max    time.Duration
+}
+
+// String 便于日志输出
+func (st HandlerStat) String() string {
+	var avg time.Duration
+	if st.Count > 0 {
+		avg = st.Total / time.Duration(st.Count)
+	}
+	return fmt.Sprintf("count=%d, errors=%d, avg=%s, max=%s", st.Count, st.Errors, avg, st.Max)
+}
+
+// HandlerMetrics 按消息类型统计处理次数和耗时
+type HandlerMetrics struct {
+	mu    sync.Mutex
+	stats map[uint16]*HandlerStat
+}
+
+func NewHandlerMetrics() *HandlerMetrics {
+	return &HandlerMetrics{
+		stats: make(map[uint16]*HandlerStat),
+	}
+}
+
+func (hm *HandlerMetrics) observe(msgType uint16, cost time.Duration, err error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	st, ok := hm.stats[msgType]
+	if !ok {
+		st = new(HandlerStat)
+		hm.stats[msgType] = st
+	}
+	st.Count++
+	if err != nil {
+		st.Errors++
+	}
+	st.Total += cost
+	if cost > st.Max {
+		st.Max = cost
+	}
+}
+
+// Snapshot 返回当前统计的副本
+func (hm *HandlerMetrics) Snapshot() map[uint16]HandlerStat {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	m := make(map[uint16]HandlerStat, len(hm.stats))
+	for k, v := range hm.stats {
+		m[k] = *v
+	}
+	return m
+}
+
+// Timing 将每条消息的处理耗时记录到 hm
+func Timing(hm *HandlerMetrics) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, s *Session, m model.Message) error {
+			start := time.Now()
+			err := next(ctx, s, m)
+			hm.observe(m.Type(), time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Authorize 按用户限制可以发送的消息类型。perms 中未配置的用户不做限制；无权限的消息会被丢弃
+func Authorize(perms map[string][]uint16) Middleware {
+	allowed := make(map[string]map[uint16]struct{}, len(perms))
+	for user, types := range perms {
+		set := make(map[uint16]struct{}, len(types))
+		for _, t := range types {
+			set[t] = struct{}{}
+		}
+		allowed[user] = set
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, s *Session, m model.Message) error {
+			if set, ok := allowed[s.Username()]; ok {
+				if _, ok := set[m.Type()]; !ok {
+					s.Logger().Warnf("message forbidden. username=[%s], msg_type=[%d]", s.Username(), m.Type())
+					return nil
+				}
+			}
+			return next(ctx, s, m)
+		}
+	}
+}
+
+// rateLimitPrune 清理空闲限速器的间隔
+const rateLimitPrune = time.Minute
+
+// userLimiters 每个 RateLimit 中间件按用户名保存的限速器，同一用户重连后继续使用原来的限速器
+type userLimiters struct {
+	r     rate.Limit
+	burst int
+
+	mu     sync.Mutex
+	users  map[string]*rate.Limiter
+	pruned time.Time
+}
+
+func (u *userLimiters) get(username string) *rate.Limiter {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	// 令牌已经补满的限速器与新建的没有区别，可以丢弃
+	if now.Sub(u.pruned) > rateLimitPrune {
+		for name, l := range u.users {
+			if l.TokensAt(now) >= float64(u.burst) {
+				delete(u.users, name)
+			}
+		}
+		u.pruned = now
+	}
+	l, ok := u.users[username]
+	if !ok {
+		l = rate.NewLimiter(u.r, u.burst)
+		u.users[username] = l
+	}
+	return l
+}
+
+// RateLimit 限制每个用户每秒处理的消息数量，超出的消息会被丢弃。各用户的限速器相互独立，重连不会重置
+func RateLimit(r rate.Limit, burst int) Middleware {
+	u := &userLimiters{r: r, burst: burst, users: make(map[string]*rate.Limiter), pruned: time.Now()}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, s *Session, m model.Message) error {
+			l := u.get(s.Username())
+			if !l.Allow() {
+				s.Logger().Warnf("message rate limited. username=[%s], msg_type=[%d]", s.Username(), m.Type())
+				return nil
+			}
+			return next(ctx, s, m)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"20220923/internal/model"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// HandlerFunc 业务消息的处理函数。返回 error 会断开该会话
+type HandlerFunc func(ctx context.Context, s *Session, m model.Message) error
+
+// RequestFunc 请求-响应形式的处理函数。返回的响应会带上请求的关联 ID 写回客户端，resp 为 nil 时不回复
+type RequestFunc func(ctx context.Context, s *Session, req model.Message) (resp model.Message, err error)
+
+// UnknownPolicy 收到未注册的消息类型时的处理策略
+type UnknownPolicy int
+
+const (
+	UnknownIgnore     UnknownPolicy = iota // 记录日志后忽略
+	UnknownDisconnect                      // 断开会话
+)
+
+// Mux 按消息类型分发业务消息。心跳、登录等协议消息由框架处理，不会进入 Mux
+type Mux struct {
+	mu       sync.RWMutex
+	handlers map[uint16]HandlerFunc
+	mws      []Middleware
+	unknown  UnknownPolicy
+}
+
+func NewMux() *Mux {
+	return &Mux{
+		handlers: make(map[uint16]HandlerFunc),
+	}
+}
+
+// Handle 注册某个消息类型的处理函数，重复注册会 panic
+func (m *Mux) Handle(msgType uint16, h HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h == nil {
+		panic("mux: nil handler")
+	}
+	if _, ok := m.handlers[msgType]; ok {
+		panic(fmt.Sprintf("mux: multiple registrations for MsgType(%d)", msgType))
+	}
+	m.handlers[msgType] = h
+}
+
+// HandleRequest 注册请求-响应形式的处理函数，重复注册会 panic
+func (m *Mux) HandleRequest(msgType uint16, h RequestFunc) {
+	if h == nil {
+		panic("mux: nil handler")
+	}
+	m.Handle(msgType, Respond(h))
+}
+
+// Respond 把 RequestFunc 转换为 HandlerFunc。请求和响应都实现了 model.Correlated 时，响应使用请求的关联 ID
+func Respond(h RequestFunc) HandlerFunc {
+	return func(ctx context.Context, s *Session, req model.Message) error {
+		resp, err := h(ctx, s, req)
+		if err != nil || resp == nil {
+			return err
+		}
+		if rq, ok := req.(model.Correlated); ok {
+			if rp, ok := resp.(model.Correlated); ok {
+				rp.SetCorrelationID(rq.CorrelationID())
+			}
+		}
+		return s.Write(ctx, resp)
+	}
+}
+
+// Use 追加中间件，作用于所有消息(包括未注册的消息类型)
+func (m *Mux) Use(mws ...Middleware) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mws = append(m.mws, mws...)
+}
+
+// SetUnknownPolicy 设置未注册消息类型的处理策略，默认忽略
+func (m *Mux) SetUnknownPolicy(p UnknownPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unknown = p
+}
+
+// ServeMessage 将消息分发给对应的处理函数
+func (m *Mux) ServeMessage(ctx context.Context, s *Session, msg model.Message) error {
+	m.mu.RLock()
+	h, ok := m.handlers[msg.Type()]
+	if !ok {
+		h = m.unknownHandler()
+	}
+	mws := m.mws
+	m.mu.RUnlock()
+	return Chain(h, mws...)(ctx, s, msg)
+}
+
+func (m *Mux) unknownHandler() HandlerFunc {
+	if m.unknown == UnknownDisconnect {
+		return func(_ context.Context, _ *Session, msg model.Message) error {
+			return fmt.Errorf("unhandled MsgType(%d)", msg.Type())
+		}
+	}
+	return func(_ context.Context, s *Session, msg model.Message) error {
+		s.Logger().Warnf("unhandled message. username=[%s], msg_type=[%d]", s.Username(), msg.Type())
+		return nil
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"20220923/internal/acl"
+	"20220923/internal/metrics"
+	"20220923/internal/model"
+	"20220923/internal/multicast"
+	"20220923/internal/packet"
+	"20220923/internal/transfer"
+	"go.uber.org/zap"
+	"net"
+	"time"
+)
+
+// Option 创建 Server 时的可选配置
+type Option func(*Server)
+
+// Hooks 会话生命周期的回调，均为可选
+type Hooks struct {
+	OnConnect    func(conn net.Conn) error              `comment:"accept 之后、登录之前调用，返回 error 则拒绝连接"`
+	OnLogin      func(s *Session)                       `comment:"登录成功后调用"`
+	OnMessage    func(s *Session, m model.Message)      `comment:"收到每个消息时调用(包括心跳)，在分发给 Mux 之前"`
+	OnSubscribe  func(s *Session, topic string) error   `comment:"客户端订阅主题时调用，返回 error 则忽略该订阅"`
+	OnTransfer   func(s *Session, t *transfer.Transfer) `comment:"收到客户端完整的分片传输时调用，在读 goroutine 中执行"`
+	OnDisconnect func(s *Session, err error)            `comment:"已登录的会话断开时调用，err 为断开原因"`
+}
+
+// WithAddr 监听地址，可以有多个，如 127.0.0.1:30001、[::1]:30001。默认 127.0.0.1:30001。
+// IP 为空(如 :30001)时监听本机所有 IPv4 和 IPv6 地址
+func WithAddr(addrs ...string) Option {
+	return func(s *Server) {
+		for _, addr := range addrs {
+			if addr != "" {
+				s.addrs = append(s.addrs, addr)
+			}
+		}
+	}
+}
+
+// WithNetwork 监听的网络类型，"tcp"(默认)、"tcp4"、"tcp6" 或 "unix"。unix 时 WithAddr 为套接字文件路径
+func WithNetwork(network string) Option {
+	return func(s *Server) {
+		if network != "" {
+			s.network = network
+		}
+	}
+}
+
+// WithListener 使用已创建的监听(如 pipe.Listen、systemd 传入的套接字)，可以有多个，忽略 WithNetwork、WithAddr
+func WithListener(lis ...net.Listener) Option {
+	return func(s *Server) {
+		s.lis = append(s.lis, lis...)
+	}
+}
+
+// WithSocket 每个连接的套接字选项和读写缓冲区大小
+func WithSocket(o packet.SocketOptions) Option {
+	return func(s *Server) {
+		s.socket = o
+	}
+}
+
+// WithMetrics 注册连接、登录、数据包、心跳和发送队列的指标，通过 r.Handler() 以 Prometheus 格式输出。
+// 多个服务端共用 r 时计数器合并统计，连接数等数值只反映第一个服务端
+func WithMetrics(r *metrics.Registry) Option {
+	return func(s *Server) {
+		s.metricsRegistry = r
+	}
+}
+
+// WithAuthenticator 校验登录的账号密码
+func WithAuthenticator(a Authenticator) Option {
+	return func(s *Server) {
+		s.auth = a
+	}
+}
+
+// WithHandler 处理业务消息的 Mux
+func WithHandler(mux *Mux) Option {
+	return func(s *Server) {
+		s.mux = mux
+	}
+}
+
+// WithHeartbeat 默认心跳间隔，以及连续多少个间隔收不到客户端消息判定为超时
+func WithHeartbeat(interval time.Duration, maxMissed int) Option {
+	return func(s *Server) {
+		s.heartbeatInterval = interval
+		s.heartbeatMaxMissed = maxMissed
+	}
+}
+
+// WithHeartbeatLimits 客户端登录时可以请求的心跳间隔范围
+func WithHeartbeatLimits(min, max time.Duration) Option {
+	return func(s *Server) {
+		s.heartbeatMin = min
+		s.heartbeatMax = max
+	}
+}
+
+// WithLogger 指定日志，默认使用 zap 的全局日志
+func WithLogger(l *zap.SugaredLogger) Option {
+	return func(s *Server) {
+		s.log = l
+	}
+}
+
+// WithACL 来源 IP 访问控制
+func WithACL(a *acl.ACL) Option {
+	return func(s *Server) {
+		s.acl = a
+	}
+}
+
+// WithDuplicatePolicy 同一用户重复登录的策略
+func WithDuplicatePolicy(p DuplicatePolicy) Option {
+	return func(s *Server) {
+		s.policy = p
+	}
+}
+
+// WithHooks 会话生命周期回调
+func WithHooks(h Hooks) Option {
+	return func(s *Server) {
+		s.hooks = h
+	}
+}
+
+// WithLimits 登录超时、未登录连接数、同一 IP 的连接频率以及登录失败锁定
+func WithLimits(l Limits) Option {
+	return func(s *Server) {
+		s.limits = l
+	}
+}
+
+// WithQueue 每个会话的发送队列长度及队列已满时的处理策略
+func WithQueue(q QueueConfig) Option {
+	return func(s *Server) {
+		s.queue = q
+	}
+}
+
+// WithAck 确认已处理的客户端消息的间隔(默认 1 秒)，以及每个用户最多保存的未确认数据包个数(默认 4096，小于 0 表示不限制)
+func WithAck(interval time.Duration, retransmitSize int) Option {
+	return func(s *Server) {
+		s.ackInterval = interval
+		s.retransmitSize = retransmitSize
+	}
+}
+
+// WithResumeTTL 会话断开后保留用户状态(序号、未确认的消息、未完成的分片传输)的时长，默认 10 分钟。
+// 超过该时长未重连的客户端从头开始，客户端登出时立即删除
+func WithResumeTTL(d time.Duration) Option {
+	return func(s *Server) {
+		s.resumeTTL = d
+	}
+}
+
+// WithChannels 配置逻辑通道，未配置通道 0 时使用默认的通道 0。通道 ID 重复会 panic
+func WithChannels(cs ...ChannelConfig) Option {
+	return func(s *Server) {
+		s.channels = append(s.channels, cs...)
+	}
+}
+
+// WithTransfer 接收客户端分片传输的大小、内存和超时限制，Budget 为空时所有用户共用 MaxMemory
+func WithTransfer(l transfer.Limits) Option {
+	return func(s *Server) {
+		s.transferLimits = l
+	}
+}
+
+// WithMulticast 通过 UDP 组播发布的会话，客户端可以通过 TCP 会话请求补发其中丢失的消息
+func WithMulticast(pubs ...*multicast.Publisher) Option {
+	return func(s *Server) {
+		if s.publishers == nil {
+			s.publishers = make(map[string]*multicast.Publisher, len(pubs))
+		}
+		for _, p := range pubs {
+			s.publishers[p.Session()] = p
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"20220923/internal/model"
+	"20220923/internal/packet"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// topics 主题和订阅者，以及订阅者接收该主题的逻辑通道
+type topics struct {
+	mu   sync.RWMutex
+	subs map[string]map[*Session]uint8
+}
+
+func newTopics() *topics {
+	return &topics{
+		subs: make(map[string]map[*Session]uint8),
+	}
+}
+
+// subscribe 重复订阅同一主题时以最后一次订阅的通道为准
+func (t *topics) subscribe(topic string, s *Session, ch uint8) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ss, ok := t.subs[topic]
+	if !ok {
+		ss = make(map[*Session]uint8)
+		t.subs[topic] = ss
+	}
+	ss[s] = ch
+}
+
+func (t *topics) unsubscribe(topic string, s *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(topic, s)
+}
+
+// unsubscribeAll 会话结束时取消它的所有订阅
+func (t *topics) unsubscribeAll(s *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for topic := range t.subs {
+		t.remove(topic, s)
+	}
+}
+
+func (t *topics) remove(topic string, s *Session) {
+	ss, ok := t.subs[topic]
+	if !ok {
+		return
+	}
+	delete(ss, s)
+	if len(ss) == 0 {
+		delete(t.subs, topic)
+	}
+}
+
+type subscriber struct {
+	sess    *Session
+	channel uint8
+}
+
+// subscribers 返回订阅者的副本，发布时不持有锁
+func (t *topics) subscribers(topic string) []subscriber {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ss := make([]subscriber, 0, len(t.subs[topic]))
+	for s, ch := range t.subs[topic] {
+		ss = append(ss, subscriber{sess: s, channel: ch})
+	}
+	return ss
+}
+
+// list 所有有订阅者的主题，按名称排序
+func (t *topics) list() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ts := make([]string, 0, len(t.subs))
+	for topic := range t.subs {
+		ts = append(ts, topic)
+	}
+	sort.Strings(ts)
+	return ts
+}
+
+// Publish 发布消息给订阅了 topic 的所有会话，返回成功放入发送队列的会话数。
+// 消息只编码一次，各会话写出同一份字节，写到会话订阅时所在的逻辑通道。会话的发送队列已满时按 OverflowPolicy 处理，
+// 阻塞等待的时间不超过 ctx 和 QueueConfig.Timeout，慢的订阅者不影响其它订阅者
+func (s *Server) Publish(ctx context.Context, topic string, ms ...model.Message) (int, error) {
+	subs := s.topics.subscribers(topic)
+	if len(subs) == 0 {
+		return 0, nil
+	}
+	targets := make([]target, 0, len(subs))
+	for _, sub := range subs {
+		if ch, ok := sub.sess.byID[sub.channel]; ok {
+			targets = append(targets, target{sess: sub.sess, ch: ch})
+		}
+	}
+	return s.fanout(ctx, targets, ms, func(t target, err error) {
+		s.log.Warnf("publish failed. topic=[%s], username=[%s], channel=[%d], err=[%v]", topic, t.sess.username, t.ch.ID, err)
+	})
+}
+
+// target 发布的目标会话及其逻辑通道
+type target struct {
+	sess *Session
+	ch   *channel
+}
+
+// fanout 把只编码一次的消息放入各目标的发送队列，返回成功的个数。
+// 先不阻塞地放入所有队列，已满的队列再并发地按 OverflowPolicy 处理，onErr 记录失败的目标
+func (s *Server) fanout(ctx context.Context, targets []target, ms []model.Message, onErr func(t target, err error)) (int, error) {
+	if len(targets) == 0 {
+		return 0, nil
+	}
+	p := new(packet.Buffer)
+	for _, m := range ms {
+		if err := p.WriteMessage(m); err != nil {
+			return 0, err
+		}
+	}
+	shared := p.Share()
+	var n int64
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		p := shared.Packet()
+		p.Channel = t.ch.ID
+		if t.sess.tryEnqueue(t.ch, p) {
+			atomic.AddInt64(&n, 1)
+			continue
+		}
+		wg.Add(1)
+		go func(t target, p *packet.Buffer) {
+			defer wg.Done()
+			if err := t.sess.enqueue(ctx, t.ch, p); err != nil {
+				onErr(t, err)
+				return
+			}
+			atomic.AddInt64(&n, 1)
+		}(t, p)
+	}
+	wg.Wait()
+	return int(n), nil
+}
+
+// Topics 列出所有有订阅者的主题
+func (s *Server) Topics() []string {
+	return s.topics.list()
+}
+
+// Broadcast 发送消息给所有在线会话，写到默认通道，返回成功放入发送队列的会话数。
+// 与 Publish 一样消息只编码一次，会话的发送队列已满时按 OverflowPolicy 处理，阻塞等待的时间不超过 ctx 和 QueueConfig.Timeout
+func (s *Server) Broadcast(ctx context.Context, ms ...model.Message) (int, error) {
+	sessions := s.registry.all()
+	targets := make([]target, 0, len(sessions))
+	for _, sess := range sessions {
+		targets = append(targets, target{sess: sess, ch: sess.defaultChannel()})
+	}
+	return s.fanout(ctx, targets, ms, func(t target, err error) {
+		s.log.Warnf("broadcast failed. username=[%s], err=[%v]", t.sess.username, err)
+	})
+}
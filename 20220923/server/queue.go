@@ -0,0 +1,170 @@
+package server
+
+import (
+	"20220923/internal/packet"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy 会话的发送队列已满时的处理策略
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // 阻塞等待，超过 Timeout 返回 ErrQueueFull
+	OverflowDropOldest                       // 丢弃队列中最早的数据包(尚未分配序号，客户端不会感知到序号缺口)
+	OverflowDisconnect                       // 断开消费过慢的客户端
+)
+
+// ParseOverflowPolicy 解析配置中的策略名称
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "", "block":
+		return OverflowBlock, nil
+	case "drop_oldest":
+		return OverflowDropOldest, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	default:
+		return 0, fmt.Errorf("unknown queue overflow policy %q", s)
+	}
+}
+
+var (
+	// ErrQueueFull 发送队列已满且等待超时，消息未发送
+	ErrQueueFull = errors.New("server: outbound queue full")
+	// ErrSlowConsumer 发送队列已满，会话已被断开
+	ErrSlowConsumer = errors.New("server: slow consumer disconnected")
+	// ErrSessionClosed 会话已结束，消息未发送
+	ErrSessionClosed = errors.New("server: session closed")
+)
+
+const (
+	defaultQueueSize    = 1024
+	defaultQueueTimeout = time.Second
+	// 协议消息(心跳等)的队列长度，写出时优先于业务消息
+	ctrlQueueSize = 16
+)
+
+// QueueConfig 每个会话的业务消息发送队列
+type QueueConfig struct {
+	Size     int            `comment:"队列长度(数据包个数)，默认 1024"`
+	Overflow OverflowPolicy `comment:"队列已满时的处理策略，默认 OverflowBlock"`
+	Timeout  time.Duration  `comment:"OverflowBlock 时最长的等待时间，默认 1 秒"`
+}
+
+// enqueue 按 OverflowPolicy 把数据包放入逻辑通道的发送队列
+func (s *Session) enqueue(ctx context.Context, c *channel, p *packet.Buffer) error {
+	s.qmu.RLock()
+	defer s.qmu.RUnlock()
+	if s.closed {
+		return ErrSessionClosed
+	}
+	err := s.push(ctx, c, p)
+	if err == nil {
+		atomic.AddInt64(s.depth, 1)
+		s.wakeup()
+	}
+	return err
+}
+
+// tryEnqueue 不阻塞地放入发送队列，队列已满时返回 false，不按 OverflowPolicy 处理
+func (s *Session) tryEnqueue(c *channel, p *packet.Buffer) bool {
+	s.qmu.RLock()
+	defer s.qmu.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case c.out <- p:
+		atomic.AddInt64(s.depth, 1)
+		s.wakeup()
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueueBulk 把分片传输的数据包放入逻辑通道的分片队列，队列已满时阻塞等待，超过 Timeout 返回 ErrQueueFull。
+// 分片不按 OverflowPolicy 丢弃，以免传输中途缺少分片；调用方应在出错时取消整个传输
+func (s *Session) enqueueBulk(ctx context.Context, c *channel, p *packet.Buffer) error {
+	s.qmu.RLock()
+	defer s.qmu.RUnlock()
+	if s.closed {
+		return ErrSessionClosed
+	}
+	timer := time.NewTimer(s.queue.Timeout)
+	defer timer.Stop()
+	select {
+	case c.bulk <- p:
+		atomic.AddInt64(s.depth, 1)
+		s.wakeup()
+		return nil
+	case <-timer.C:
+		return ErrQueueFull
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// discard 关闭发送队列并丢弃其中的数据包，之后的入队返回 ErrSessionClosed。须在写 goroutine 退出之后调用
+func (s *Session) discard() {
+	s.qmu.Lock()
+	defer s.qmu.Unlock()
+	s.closed = true
+	for _, c := range s.chans {
+		for _, q := range []chan *packet.Buffer{c.out, c.bulk} {
+			for drained := false; !drained; {
+				select {
+				case <-q:
+					atomic.AddInt64(s.depth, -1)
+				default:
+					drained = true
+				}
+			}
+		}
+	}
+}
+
+func (s *Session) push(ctx context.Context, c *channel, p *packet.Buffer) error {
+	select {
+	case c.out <- p:
+		return nil
+	default:
+	}
+	switch s.queue.Overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case <-c.out:
+				atomic.AddInt64(s.depth, -1)
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+			select {
+			case c.out <- p:
+				return nil
+			default:
+			}
+		}
+	case OverflowDisconnect:
+		s.log.Warnf("slow consumer disconnected. username=[%s], channel=[%d], queue_size=[%d]", s.username, c.ID, cap(c.out))
+		atomic.AddUint64(&s.dropped, 1)
+		s.disconnect()
+		return ErrSlowConsumer
+	default:
+		timer := time.NewTimer(s.queue.Timeout)
+		defer timer.Stop()
+		select {
+		case c.out <- p:
+			return nil
+		case <-timer.C:
+			atomic.AddUint64(&s.dropped, 1)
+			return ErrQueueFull
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"20220923/internal/enum"
+	"20220923/internal/packet"
+	"20220923/internal/transfer"
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEnqueue(t *testing.T) {
+	newTestSession := func(policy OverflowPolicy) (*Session, context.Context) {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { _ = c2.Close() })
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		q := QueueConfig{Size: 2, Overflow: policy, Timeout: time.Millisecond * 10}
+		return newSession(packet.NewSession(c1), "mayee", cancel, q, sortChannels(nil), zap.NewNop().Sugar()), ctx
+	}
+	ctx := context.Background()
+
+	s, _ := newTestSession(OverflowBlock)
+	for i := 0; i < 2; i++ {
+		if err := s.Write(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Write(ctx); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("block: Write = %v, want ErrQueueFull", err)
+	}
+
+	s, _ = newTestSession(OverflowDropOldest)
+	ps := make([]*packet.Buffer, 3)
+	for i := range ps {
+		ps[i] = new(packet.Buffer)
+		if err := s.enqueue(ctx, s.defaultChannel(), ps[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 丢弃的数据包不计入队列深度
+	if n := atomic.LoadInt64(s.depth); n != 2 {
+		t.Fatalf("drop_oldest: depth = %d", n)
+	}
+	if _, p := s.next(false); p != ps[1] {
+		t.Fatal("drop_oldest: oldest packet not dropped")
+	}
+	if info := s.Info(); info.Dropped != 1 || info.QueueLen != 1 || info.QueueCap != 2 {
+		t.Fatalf("drop_oldest: info = %+v", info)
+	}
+	// 分片传输不按 drop_oldest 丢弃，队列已满时整个传输失败
+	s, _ = newTestSession(OverflowDropOldest)
+	if err := s.SendTransfer(ctx, "doc", []byte("hello")); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("transfer: SendTransfer = %v, want ErrQueueFull", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.Write(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info := s.Info(); info.Dropped != 1 || info.QueueLen != 4 {
+		t.Fatalf("transfer: info = %+v", info)
+	}
+	if m, err := (<-s.defaultChannel().bulk).ReadMessage(); err != nil || m.Type() != enum.MsgTypeTransferStart {
+		t.Fatalf("transfer: first packet = %v, %v", m, err)
+	}
+
+	s, sctx := newTestSession(OverflowDisconnect)
+	for i := 0; i < 2; i++ {
+		_ = s.Write(ctx)
+	}
+	if err := s.Write(ctx); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("disconnect: Write = %v, want ErrSlowConsumer", err)
+	}
+	if sctx.Err() == nil {
+		t.Fatal("disconnect: session not cancelled")
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { _ = c1.Close(); _ = c2.Close() })
+	q := QueueConfig{Size: 4, Timeout: time.Millisecond * 10}
+	s := newSession(packet.NewSession(c1), "mayee", func() {}, q, sortChannels([]ChannelConfig{{ID: 1, Priority: 10}}), zap.NewNop().Sugar())
+	ctx := context.Background()
+	for _, id := range []uint8{0, 0, 1} {
+		if err := s.WriteChannel(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.enqueueBulk(ctx, s.defaultChannel(), new(packet.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(s.depth); n != 4 {
+		t.Fatalf("depth = %d", n)
+	}
+	s.discard()
+	if n := atomic.LoadInt64(s.depth); n != 0 || s.Info().QueueLen != 0 {
+		t.Fatalf("after discard: depth = %d, queue = %d", n, s.Info().QueueLen)
+	}
+	// 关闭之后不再入队，计数不会增加
+	if err := s.Write(ctx); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("Write = %v, want ErrSessionClosed", err)
+	}
+	if s.tryEnqueue(s.defaultChannel(), new(packet.Buffer)) {
+		t.Fatal("tryEnqueue after discard")
+	}
+	if err := s.enqueueBulk(ctx, s.defaultChannel(), new(packet.Buffer)); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("enqueueBulk = %v, want ErrSessionClosed", err)
+	}
+	if n := atomic.LoadInt64(s.depth); n != 0 {
+		t.Fatalf("depth = %d", n)
+	}
+}
+
+func TestPublishSlowSubscriber(t *testing.T) {
+	srv := New(WithLogger(zap.NewNop().Sugar()))
+	sess := func(username string) *Session {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { _ = c1.Close(); _ = c2.Close() })
+		q := QueueConfig{Size: 1, Overflow: OverflowBlock, Timeout: time.Hour}
+		s := newSession(packet.NewSession(c1), username, func() {}, q, sortChannels(nil), zap.NewNop().Sugar())
+		srv.topics.subscribe("quotes", s, 0)
+		return s
+	}
+	slow, fast := sess("slow"), sess("fast")
+	// slow 的发送队列已满且没有写 goroutine
+	slow.defaultChannel().out <- new(packet.Buffer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	n, err := srv.Publish(ctx, "quotes")
+	if err != nil || n != 1 {
+		t.Fatalf("Publish = %d, %v, want 1", n, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Publish blocked %s on a slow subscriber", d)
+	}
+	if len(fast.defaultChannel().out) != 1 {
+		t.Fatal("fast subscriber did not receive the message")
+	}
+}
+
+func TestRegistryEvict(t *testing.T) {
+	r := newRegistry(DuplicateReject, 16, transfer.Limits{}, time.Minute*3, zap.NewNop().Sugar())
+	sess := func(username string) *Session {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { _ = c1.Close(); _ = c2.Close() })
+		return newSession(packet.NewSession(c1), username, func() {}, QueueConfig{Size: 1}, sortChannels(nil), zap.NewNop().Sugar())
+	}
+	a, b := sess("a"), sess("b")
+	for _, s := range []*Session{a, b} {
+		if err := r.Register(s, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 登出立即删除，断开的保留到超时
+	r.Unregister(a, true)
+	r.Unregister(b, false)
+	if _, ok := r.users["a"]; ok {
+		t.Fatal("user state kept after logout")
+	}
+	r.sweep(time.Now().Add(time.Minute * 2))
+	if _, ok := r.users["b"]; !ok {
+		t.Fatal("user state evicted before ttl")
+	}
+	r.sweep(time.Now().Add(time.Minute * 4))
+	if _, ok := r.users["b"]; ok {
+		t.Fatal("user state kept after ttl")
+	}
+}
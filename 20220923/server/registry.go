@@ -0,0 +1,241 @@
+package server
+
+import (
+	"20220923/internal/retransmit"
+	"20220923/internal/transfer"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DuplicatePolicy 同一用户重复登录时的处理策略
+type DuplicatePolicy int
+
+const (
+	DuplicateReject   DuplicatePolicy = iota // 拒绝新的登录，回复 100
+	DuplicateTakeover                        // 断开旧的会话，接受新的登录
+)
+
+// ParseDuplicatePolicy 解析配置中的策略名称
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch s {
+	case "", "reject":
+		return DuplicateReject, nil
+	case "takeover":
+		return DuplicateTakeover, nil
+	default:
+		return 0, fmt.Errorf("unknown duplicate login policy %q", s)
+	}
+}
+
+var errUserConnected = errors.New("user already connected")
+
+// takeoverTimeout 接管时等待旧会话退出的最长时间
+const takeoverTimeout = time.Second * 5
+
+// defaultResumeTTL 会话断开后保留用户状态的默认时长
+const defaultResumeTTL = time.Minute * 10
+
+// ErrNotConnected Kick 的用户没有在线的会话
+var ErrNotConnected = errors.New("server: user not connected")
+
+// registry 服务端的会话注册表，以用户名为 key，保证每个用户同时只有一个会话
+type registry struct {
+	mu             sync.RWMutex
+	policy         DuplicatePolicy
+	retransmitSize int
+	transferLimits transfer.Limits
+	resumeTTL      time.Duration
+	sessions       map[string]*Session
+	users          map[string]*userState `comment:"会话断开后保留的用户状态，用于断线续传。登出或断开超过 resumeTTL 后删除"`
+	lastSweep      time.Time
+	log            *zap.SugaredLogger
+
+	count int64 // 在线会话数，atomic 读写，用于指标
+}
+
+// userState 用户在两次会话之间保留的状态
+type userState struct {
+	nextSeq uint32             // 下一条业务消息的序号
+	ackSeq  uint32             // 已处理的客户端业务消息的最大序号
+	unacked *retransmit.Buffer // 已发送未确认的业务数据包
+
+	transfers *transfer.Assembler // 未完成的分片传输，客户端续传后继续接收
+
+	disconnected time.Time // 最近一次会话断开的时间，在线时为零值
+}
+
+func newRegistry(policy DuplicatePolicy, retransmitSize int, transferLimits transfer.Limits, resumeTTL time.Duration, log *zap.SugaredLogger) *registry {
+	if resumeTTL <= 0 {
+		resumeTTL = defaultResumeTTL
+	}
+	return &registry{
+		policy:         policy,
+		retransmitSize: retransmitSize,
+		transferLimits: transferLimits,
+		resumeTTL:      resumeTTL,
+		sessions:       make(map[string]*Session),
+		users:          make(map[string]*userState),
+		log:            log,
+	}
+}
+
+// Register 登记一个新登录的会话。若该用户已在线，按策略拒绝(返回 errUserConnected)或踢掉旧会话。
+// seq 为客户端希望收到的下一条消息的序号，[seq, next) 之间未确认的消息放入 s.resend 重发；seq 为 0 表示不续传，丢弃未确认的消息
+func (r *registry) Register(s *Session, seq uint32) error {
+	r.mu.Lock()
+	for {
+		old, ok := r.sessions[s.username]
+		if !ok {
+			break
+		}
+		if r.policy == DuplicateReject {
+			r.mu.Unlock()
+			return errUserConnected
+		}
+		// 旧会话的写 goroutine 还在分配序号，先断开并等它注销(保存序号)之后再接管，否则新旧会话会使用相同的序号
+		r.mu.Unlock()
+		r.log.Warnf("session taken over. username=[%s], old_addr=[%s], new_addr=[%s]", s.username, old.RemoteAddr().String(), s.RemoteAddr().String())
+		old.disconnect()
+		select {
+		case <-old.done:
+		case <-time.After(takeoverTimeout):
+			r.log.Errorf("takeover failed, old session did not stop. username=[%s], old_addr=[%s]", s.username, old.RemoteAddr().String())
+			return errUserConnected
+		}
+		r.mu.Lock()
+	}
+	r.sweep(time.Now())
+	r.sessions[s.username] = s
+	atomic.AddInt64(&r.count, 1)
+	st, found := r.users[s.username]
+	if !found {
+		st = &userState{
+			unacked:   retransmit.New(r.retransmitSize),
+			transfers: transfer.NewAssembler(r.transferLimits),
+		}
+		r.users[s.username] = st
+	}
+	st.disconnected = time.Time{}
+	// 只有默认通道续传
+	def := s.defaultChannel()
+	next, ack := st.nextSeq, st.ackSeq
+	if next == 0 {
+		next = 1
+	}
+	def.unacked = st.unacked
+	s.transfers = st.transfers
+	if seq == 0 {
+		st.unacked.Reset()
+		st.transfers.Reset()
+	} else {
+		// 客户端已处理 seq 之前的消息
+		st.unacked.Ack(seq - 1)
+		if seq < next {
+			if first := st.unacked.First(); first == 0 || first > seq {
+				// 重发缓冲区已满时丢弃过未确认的消息，无法补发全部的 [seq, next)
+				r.log.Warnf("cannot resume. username=[%s], requested_seq=[%d], first_unacked_seq=[%d], next_seq=[%d]", s.username, seq, first, next)
+			}
+			s.resend = st.unacked.Since(seq)
+		}
+	}
+	if seq > next {
+		next = seq
+	}
+	atomic.StoreUint32(&def.nextSeq, next)
+	atomic.StoreUint32(&def.ackSeq, ack)
+	r.mu.Unlock()
+	return nil
+}
+
+// Unregister 注销会话。会话被接管后，旧会话退出时不能把新会话删掉。
+// logout 为 true 表示客户端主动登出，不会再续传，立即删除用户状态
+func (r *registry) Unregister(s *Session, logout bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[s.username] != s {
+		return
+	}
+	delete(r.sessions, s.username)
+	atomic.AddInt64(&r.count, -1)
+	st := r.users[s.username]
+	if logout {
+		st.transfers.Reset()
+		delete(r.users, s.username)
+		return
+	}
+	def := s.defaultChannel()
+	st.nextSeq = atomic.LoadUint32(&def.nextSeq)
+	st.ackSeq = atomic.LoadUint32(&def.ackSeq)
+	st.disconnected = time.Now()
+}
+
+// sweep 删除断开超过 resumeTTL 的用户状态，释放重发缓冲区和未完成的分片传输，避免 map 随用户数无限增长
+func (r *registry) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+	r.lastSweep = now
+	for name, st := range r.users {
+		if _, online := r.sessions[name]; online || st.disconnected.IsZero() {
+			continue
+		}
+		if now.Sub(st.disconnected) > r.resumeTTL {
+			st.transfers.Reset()
+			delete(r.users, name)
+		}
+	}
+}
+
+// Len 在线会话数，不持有锁
+func (r *registry) Len() int {
+	return int(atomic.LoadInt64(&r.count))
+}
+
+// Get 查找某个用户的会话
+func (r *registry) Get(username string) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[username]
+	return s, ok
+}
+
+// all 所有在线会话的副本，广播时不持有锁
+func (r *registry) all() []*Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ss := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+// List 列出所有在线会话，按登录时间排序
+func (r *registry) List() []SessionInfo {
+	r.mu.RLock()
+	infos := make([]SessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		infos = append(infos, s.Info())
+	}
+	r.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LoginTime.Before(infos[j].LoginTime)
+	})
+	return infos
+}
+
+// Kick 强制断开某个用户的会话
+func (r *registry) Kick(username string) error {
+	s, ok := r.Get(username)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotConnected, username)
+	}
+	r.log.Warnf("session kicked. username=[%s], client_addr=[%s]", username, s.RemoteAddr().String())
+	s.disconnect()
+	return nil
+}
@@ -1,99 +1,539 @@
-package main
+package server
 
 import (
+	"20220923/internal/acl"
 	"20220923/internal/enum"
-	_ "20220923/internal/log"
+	"20220923/internal/heartbeat"
+	"20220923/internal/metrics"
 	"20220923/internal/model"
+	"20220923/internal/multicast"
 	"20220923/internal/packet"
+	"20220923/internal/transfer"
+	"20220923/internal/typebase"
 	"context"
 	"errors"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"io"
 	"net"
-	"os"
-	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func main() {
-	server := newTCPServer()
-	if err := server.Start(); err != nil {
-		panic(err)
+// ErrServerClosed Shutdown 之后 Serve 返回的错误
+var ErrServerClosed = errors.New("server: server closed")
+
+// errLogout 客户端主动登出，用于结束会话的各 goroutine
+var errLogout = errors.New("client logout")
+
+// errEndOfSession 服务端已发送 EndOfSession，用于结束会话的各 goroutine
+var errEndOfSession = errors.New("end of session")
+
+const (
+	defaultNetwork           = "tcp"
+	defaultAddr              = "127.0.0.1:30001"
+	defaultAckInterval       = time.Second
+	defaultRetransmitSize    = 4096
+	defaultHeartbeatInterval = time.Second * 5
+	defaultHeartbeatMin      = time.Second
+	defaultHeartbeatMax      = time.Minute
+)
+
+// Server 服务端，负责登录、心跳等协议处理，业务消息交给 Mux。
+// 默认监听 TCP，可以同时监听多个地址(IPv4、IPv6)，也可以监听 Unix 域套接字或使用任意 net.Listener，见 WithAddr、WithNetwork、WithListener、ServeConn
+type Server struct {
+	network            string
+	addrs              []string
+	auth               Authenticator
+	mux                *Mux
+	acl                *acl.ACL
+	policy             DuplicatePolicy
+	heartbeatInterval  time.Duration
+	heartbeatMaxMissed int
+	heartbeatMin       time.Duration
+	heartbeatMax       time.Duration
+	hooks              Hooks
+	limits             Limits
+	queue              QueueConfig
+	ackInterval        time.Duration
+	retransmitSize     int
+	resumeTTL          time.Duration
+	channels           []ChannelConfig
+	transferLimits     transfer.Limits
+	publishers         map[string]*multicast.Publisher
+	socket             packet.SocketOptions
+	metricsRegistry    *metrics.Registry
+	log                *zap.SugaredLogger
+
+	mu       sync.Mutex
+	lis      []net.Listener
+	conns    map[net.Conn]*Session `comment:"所有未关闭的连接，未登录的连接对应 nil"`
+	closed   bool
+	serving  bool `comment:"Serve 正在接受连接"`
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	registry *registry
+	guard    *guard
+	topics   *topics
+	metrics  *serverMetrics
+
+	queueDepth int64 // 所有会话的发送队列中的数据包个数，atomic 读写
+}
+
+func New(opts ...Option) *Server {
+	s := &Server{
+		network:            defaultNetwork,
+		heartbeatInterval:  defaultHeartbeatInterval,
+		heartbeatMaxMissed: heartbeat.DefaultMaxMissed,
+		heartbeatMin:       defaultHeartbeatMin,
+		heartbeatMax:       defaultHeartbeatMax,
+		conns:              make(map[net.Conn]*Session),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.log == nil {
+		s.log = zap.S()
+	}
+	if s.limits.LoginTimeout <= 0 {
+		s.limits.LoginTimeout = defaultLoginTimeout
+	}
+	s.guard = newGuard(s.limits)
+	if s.queue.Size <= 0 {
+		s.queue.Size = defaultQueueSize
+	}
+	if s.queue.Timeout <= 0 {
+		s.queue.Timeout = defaultQueueTimeout
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if s.ackInterval <= 0 {
+		s.ackInterval = defaultAckInterval
+	}
+	if s.retransmitSize == 0 {
+		s.retransmitSize = defaultRetransmitSize
+	}
+	s.channels = sortChannels(s.channels)
+	if len(s.addrs) == 0 {
+		s.addrs = []string{defaultAddr}
+	}
+	if s.transferLimits.Budget == nil {
+		// 所有用户的分片传输共用 MaxMemory
+		s.transferLimits.Budget = transfer.NewBudget(s.transferLimits.MaxMemory)
+	}
+	s.registry = newRegistry(s.policy, s.retransmitSize, s.transferLimits, s.resumeTTL, s.log)
+	s.metrics = newServerMetrics(s)
+	s.topics = newTopics()
+	return s
+}
+
+// Listen 监听所有地址，任一地址监听失败(如端口被占用、IP 不属于本机)时关闭已监听的地址并返回该错误。
+// Serve 会自动调用，提前调用可以在 Serve 之前发现监听错误、拿到实际监听的地址
+func (s *Server) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	if len(s.lis) > 0 {
+		return nil
+	}
+	// TCP 如果未指定 IP，则监听所有地址(IPv4 和 IPv6)；如果未指定 Port(默认 0)，则随机选一个端口监听。
+	// Unix 域套接字的 addr 为文件路径，监听关闭时文件会被删除
+	lis := make([]net.Listener, 0, len(s.addrs))
+	for _, addr := range s.addrs {
+		l, err := net.Listen(listenNetwork(s.network, addr), addr)
+		if err != nil {
+			for _, l := range lis {
+				_ = l.Close()
+			}
+			return err
+		}
+		lis = append(lis, l)
+	}
+	s.lis = lis
+	return nil
+}
+
+// listenNetwork 地址为 IPv4 或 IPv6 字面量时只监听对应的协议族，
+// 这样 0.0.0.0:30001 和 [::]:30001 可以同时监听，否则后者是双栈的，与前者端口冲突
+func listenNetwork(network, addr string) string {
+	if network != "tcp" {
+		return network
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return network
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return network
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// Addr 实际监听的第一个地址，未监听时返回 nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.lis) == 0 {
+		return nil
+	}
+	return s.lis[0].Addr()
+}
+
+// Addrs 实际监听的所有地址，顺序与 WithAddr 相同
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, 0, len(s.lis))
+	for _, l := range s.lis {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// Serve 接受连接直到 ctx 被取消或调用 Shutdown，返回 ErrServerClosed。
+// ctx 取消时与 Shutdown 一样通知会话结束，会话写完待发送的消息后断开；需要限定等待时间时调用 Shutdown
+func (s *Server) Serve(ctx context.Context) error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	for _, addr := range s.Addrs() {
+		s.log.Infof("listening on %s", addr)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.endAll(enum.EndOfSessionShutdown)
+			s.wg.Wait()
+			s.closeAll()
+		case <-stop:
+		}
+	}()
+	s.mu.Lock()
+	lis := s.lis
+	s.serving = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.serving = false
+		s.mu.Unlock()
+	}()
+	// 每个监听一个 goroutine，任一监听出错时关闭其它监听
+	errs := make(chan error, len(lis))
+	for _, l := range lis {
+		go func(l net.Listener) { errs <- s.accept(l) }(l)
+	}
+	err := <-errs
+	for _, l := range lis {
+		_ = l.Close()
+	}
+	for i := 1; i < len(lis); i++ {
+		<-errs
+	}
+	return err
+}
+
+// accept 接受 l 上的连接直到出错
+func (s *Server) accept(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if err = s.ServeConn(conn); err != nil {
+			return err
+		}
 	}
+}
 
-	shutdown := make(chan os.Signal, 1)
-	// 监听 os.Interrupt, os.Kill 这两种信号，一但收到信号，则将信号写入 shutdown 中
-	signal.Notify(shutdown, os.Interrupt, os.Kill)
-	<-shutdown
+// ServeConn 处理一个已建立的连接(如 net.Pipe 的一端)，登录及之后的处理在新的 goroutine 中进行。
+// 服务端已关闭时关闭 conn 并返回 ErrServerClosed
+func (s *Server) ServeConn(conn net.Conn) error {
+	if !s.track(conn) {
+		_ = conn.Close()
+		return ErrServerClosed
+	}
+	s.metrics.accepted.Inc()
+	if s.hooks.OnConnect != nil {
+		if err := s.hooks.OnConnect(conn); err != nil {
+			s.log.Warnf("connection rejected. client_addr=[%s], reason=[%v]", conn.RemoteAddr().String(), err)
+			go s.reject(conn, enum.SessionStatusInvalid)
+			return nil
+		}
+	}
+	// 本机连接(Unix 域套接字、内存连接)没有 IP，只有 ACL 开启 TrustLocal 时才不校验全局规则
+	ip := acl.AddrIP(conn.RemoteAddr())
+	if err := s.acl.Accept(ip); err != nil {
+		s.log.Warnf("connection rejected. client_addr=[%s], reason=[%v]", conn.RemoteAddr().String(), err)
+		go s.reject(conn, enum.SessionStatusInvalid)
+		return nil
+	}
+	// 网关代替多个客户端连接，按转发的客户端 IP 在登录时限制
+	guardIP := ip
+	if s.acl.Proxy(ip) {
+		guardIP = nil
+	}
+	if status, err := s.guard.accept(guardIP); err != nil {
+		s.log.Warnf("connection rejected. client_addr=[%s], reason=[%v]", conn.RemoteAddr().String(), err)
+		go s.reject(conn, status)
+		return nil
+	}
+	go s.handler(conn)
+	return nil
+}
 
-	_ = server.Stop()
+// Ready Serve 正在接受连接且没有关闭，用于就绪检查
+func (s *Server) Ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.serving && !s.closed
 }
 
-func handler(conn *net.TCPConn) {
+// Shutdown 优雅关闭：停止接受新连接，断开未登录的连接，通知所有会话结束。
+// 会话写完待发送的消息后发送 EndOfSession 并断开，ctx 超时后强制断开剩余的连接并返回 ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.endAll(enum.EndOfSessionShutdown)
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.closeAll()
+		return nil
+	case <-ctx.Done():
+		s.log.Warnf("shutdown deadline exceeded, force closing %d connections", s.connCount())
+		s.closeAll()
+		return ctx.Err()
+	}
+}
+
+// endAll 关闭监听，断开未登录的连接，通知已登录的会话结束
+func (s *Server) endAll(reason uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, l := range s.lis {
+		_ = l.Close()
+	}
+	for conn, sess := range s.conns {
+		if sess == nil {
+			_ = conn.Close()
+			continue
+		}
+		sess.end(reason)
+	}
+}
+
+// closeAll 关闭监听和所有连接，不等待待发送的消息
+func (s *Server) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cancel()
+	for _, l := range s.lis {
+		_ = l.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+func (s *Server) connCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// track 记录新连接，服务端已关闭时返回 false
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = nil
+	s.wg.Add(1)
+	return true
+}
+
+// bind 登录成功后关联连接和会话，服务端已关闭时返回 false
+func (s *Server) bind(conn net.Conn, sess *Session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = sess
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// Sessions 列出所有在线会话
+func (s *Server) Sessions() []SessionInfo {
+	return s.registry.List()
+}
+
+// Kick 强制断开某个用户的会话，用户不在线时返回 ErrNotConnected
+func (s *Server) Kick(username string) error {
+	return s.registry.Kick(username)
+}
+
+func (srv *Server) handler(conn net.Conn) {
+	defer srv.wg.Done()
+	defer srv.untrack(conn)
 	// 对于服务端来说，remote 表示客户端地址，local 表示服务端地址
-	zap.S().Debugf("accepted. client_addr=[%s], server_adrr=[%s]", conn.RemoteAddr().(*net.TCPAddr).IP.To4().String(), conn.LocalAddr().(*net.TCPAddr).IP.To4().String())
+	srv.log.Debugf("accepted. network=[%s], client_addr=[%s], server_addr=[%s]", conn.LocalAddr().Network(), conn.RemoteAddr().String(), conn.LocalAddr().String())
+	// 登录结束后不再计入未登录连接，包括下面设置套接字选项失败的情况
+	ip := acl.AddrIP(conn.RemoteAddr())
+	pending := true
+	loginDone := func() {
+		if pending {
+			pending = false
+			srv.guard.loginDone()
+		}
+	}
+	defer loginDone()
 	// 包装
-	s := packet.NewSession(conn)
+	s, err := packet.NewSessionWith(conn, srv.socket)
+	if err != nil {
+		srv.log.Warnf("set socket options failed. client_addr=[%s], err=[%v]", conn.RemoteAddr().String(), err)
+		_ = conn.Close()
+		return
+	}
+	s.SetMetrics(srv.metrics.packets)
 	// 错误恢复
 	defer func() {
 		if exp := recover(); exp != nil {
-			zap.S().Errorf("[recovered] panic: %v\n", exp)
+			srv.log.Errorf("[recovered] panic: %v\n", exp)
 		}
 		_ = s.Close()
-		zap.S().Warn("disconnect with client")
+		srv.log.Warn("disconnect with client")
 	}()
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(srv.ctx)
 	defer cancel()
 
-	// 登录请求
-	loginPkt, err := s.ReadPacket(ctx)
+	// 登录请求，必须在 LoginTimeout 内完成
+	loginCtx, loginCancel := context.WithTimeout(ctx, srv.limits.LoginTimeout)
+	loginPkt, err := s.ReadPacket(loginCtx)
+	loginCancel()
+	if errors.Is(err, context.DeadlineExceeded) {
+		srv.log.Warnf("login rejected. client_addr=[%s], reason=[login timeout after %s]", conn.RemoteAddr().String(), srv.limits.LoginTimeout)
+		wctx, wcancel := context.WithTimeout(ctx, time.Second*5)
+		defer wcancel()
+		srv.loginRejected(wctx, s, enum.SessionStatusLoginTimeout)
+		return
+	}
 	if err != nil {
-		panic(err)
+		srv.log.Warnf("read login failed. client_addr=[%s], err=[%v]", conn.RemoteAddr().String(), err)
+		return
 	}
 	loginMsg, err := loginPkt.ReadMessage()
 	if err != nil {
-		panic(err)
+		srv.log.Warnf("decode login failed. client_addr=[%s], err=[%v]", conn.RemoteAddr().String(), err)
+		return
 	}
-	loginResp := model.NewLoginResponse()
-	if loginMsg.Type() != enum.MsgTypeLogin {
-		loginResp.SessionStatus = 5
-		loginRespPkt := new(packet.Buffer)
-		err = loginRespPkt.WriteMessage(loginResp)
-		if err != nil {
-			panic(err)
+	if fwd, ok := loginMsg.(*model.ForwardedFor); ok {
+		if clientIP := fwd.ClientIP(); clientIP != nil && srv.acl.Proxy(ip) {
+			// 之后的 IP 限制、ACL 和失败锁定都针对客户端的 IP
+			ip = clientIP
+			if status, err := srv.guard.forwarded(ip); err != nil {
+				srv.log.Warnf("login rejected. client_addr=[%s], client_ip=[%s], reason=[%v]", conn.RemoteAddr().String(), ip, err)
+				srv.loginRejected(ctx, s, status)
+				return
+			}
+		} else {
+			srv.log.Warnf("forwarded ip ignored, not from a trusted proxy. client_addr=[%s], client_ip=[%s]", conn.RemoteAddr().String(), fwd.ClientIP())
 		}
-		err = s.WritePacket(ctx, loginRespPkt)
-		if err != nil {
-			panic(err)
+		if loginMsg, err = loginPkt.ReadMessage(); err != nil {
+			srv.log.Warnf("decode login failed. client_addr=[%s], err=[%v]", conn.RemoteAddr().String(), err)
+			return
 		}
+	}
+	if loginMsg.Type() != enum.MsgTypeLogin {
+		srv.log.Warnf("login rejected. client_addr=[%s], reason=[expected login, got msg_type %d]", conn.RemoteAddr().String(), loginMsg.Type())
+		srv.loginRejected(ctx, s, enum.SessionStatusInvalid)
 		return
 	}
 	login := loginMsg.(*model.Login)
 	uname := login.Username.String()
 	passw := login.Password.String()
-	if uname != serverUsername || passw != serverPassword {
-		loginResp.SessionStatus = 5
-		loginRespPkt := new(packet.Buffer)
-		err = loginRespPkt.WriteMessage(loginResp)
-		err = s.WritePacket(ctx, loginRespPkt)
-		if err != nil {
-			panic(err)
-		}
+	if srv.auth == nil || !srv.auth.Authenticate(uname, passw) {
+		srv.log.Warnf("login rejected. client_addr=[%s], username=[%s], reason=[invalid username or password]", conn.RemoteAddr().String(), uname)
+		srv.loginFailed(conn, ip)
+		srv.loginRejected(ctx, s, enum.SessionStatusInvalid)
+		return
+	}
+	if err = srv.acl.Login(uname, ip); err != nil {
+		srv.log.Warnf("login rejected. client_addr=[%s], username=[%s], reason=[%v]", conn.RemoteAddr().String(), uname, err)
+		// 与密码错误一样计入失败次数，避免借此探测账号
+		srv.loginFailed(conn, ip)
+		srv.loginRejected(ctx, s, enum.SessionStatusInvalid)
+		return
+	}
+	sess := newSession(s, uname, cancel, srv.queue, srv.channels, srv.log)
+	sess.depth = &srv.queueDepth
+	// 最后执行，此时已注销，接管的新会话可以读取保存的序号
+	defer close(sess.done)
+	defer sess.discard()
+	if err = srv.registry.Register(sess, login.SeqNum); err != nil {
+		srv.log.Warnf("login rejected. client_addr=[%s], username=[%s], reason=[%v]", conn.RemoteAddr().String(), uname, err)
+		srv.loginRejected(ctx, s, enum.SessionStatusAlreadyConnected)
 		return
-	} else {
-		loginResp.SessionStatus = 0
-		loginRespPkt := new(packet.Buffer)
-		err = loginRespPkt.WriteMessage(loginResp)
-		err = s.WritePacket(ctx, loginRespPkt)
-		if err != nil {
-			panic(err)
-		}
+	}
+	var logout bool
+	defer func() { srv.registry.Unregister(sess, logout) }()
+	defer srv.topics.unsubscribeAll(sess)
+	if !srv.bind(conn, sess) {
+		srv.log.Warnf("login rejected. client_addr=[%s], username=[%s], reason=[server closed]", conn.RemoteAddr().String(), uname)
+		return
+	}
+	// 协商心跳间隔
+	interval := heartbeat.Negotiate(time.Duration(login.HeartBtInt)*time.Millisecond, srv.heartbeatInterval, srv.heartbeatMin, srv.heartbeatMax)
+	hb := heartbeat.New(interval, srv.heartbeatMaxMissed)
+	resp := model.NewLoginResponse()
+	resp.SessionStatus = enum.SessionStatusActive
+	def := sess.defaultChannel()
+	resp.SeqNum = def.nextSeq
+	resp.HeartBtInt = uint32(interval.Milliseconds())
+	resp.AckSeqNum = def.ackSeq
+	resp.Features = enum.FeatureHeartBeatEcho
+	if err = writeMessage(ctx, s, resp); err != nil {
+		srv.log.Warnf("write login response failed. client_addr=[%s], username=[%s], err=[%v]", conn.RemoteAddr().String(), uname, err)
+		return
+	}
+	srv.metrics.logins.With(strconv.Itoa(enum.SessionStatusActive)).Inc()
+	srv.log.Infof("login. client_addr=[%s], username=[%s], next_seq=[%d], ack_seq=[%d], heartbeat=[%s]", conn.RemoteAddr().String(), uname, def.nextSeq, def.ackSeq, interval)
+	srv.guard.loginSucceeded(ip)
+	loginDone()
+	if srv.hooks.OnLogin != nil {
+		srv.hooks.OnLogin(sess)
 	}
 	// errgroup 是 waitgroup 的一个包装，同样实现了一个 goroutine 等待多个 goroutine，同时可以返回 error
 	// errgroup 中自动创建了 context.WithCancel。当任一个 eg.Go 中 return 了 error，会执行 ctx 的 cancel，return nil 则不不会执行 cancel，但他们都会调用内部的 wg.Done()
 	eg, ctx := errgroup.WithContext(ctx)
-	ch := make(chan *packet.Buffer)
-	heart := make(chan struct{})
 
 	// 读取客户端消息
 	eg.Go(func() error {
@@ -102,61 +542,90 @@ func handler(conn *net.TCPConn) {
 			if err != nil {
 				return err
 			}
-			msg, err := pkt.ReadMessage()
-			if err != nil {
-				return err
+			// 收到任何消息都说明客户端存活
+			hb.Beat()
+			ch, ok := sess.byID[pkt.Channel]
+			if !ok {
+				srv.log.Warnf("unknown channel, packet dropped. username=[%s], channel=[%d]", uname, pkt.Channel)
+				continue
 			}
-			switch msg.Type() {
-			case enum.MsgTypeLogin:
-				loginResp = model.NewLoginResponse()
-				loginResp.SessionStatus = 100
-				p := new(packet.Buffer)
-				_ = p.WriteMessage(loginResp)
-				ch <- p
-			case enum.MsgTypeHeartBeat:
-				// 写入一个任意值
-				heart <- struct{}{}
-			case enum.MsgTypeClientDemo:
-				// 响应数据
-				m := model.NewServerDemo()
-				m.Addr.Set([]byte("127.0.0.1"))
-				m.Port = serverPort
-				m.Remark.Set([]byte("server response: ok"))
-				p := new(packet.Buffer)
-				err = p.WriteMessage(m)
+			// 客户端断线重连后会重发未确认的业务消息，其中可能有已经处理过的
+			last := atomic.LoadUint32(&ch.ackSeq)
+			if pkt.SeqNum != 0 && pkt.SeqNum <= last {
+				srv.log.Debugf("duplicate message dropped. username=[%s], channel=[%d], seq=[%d], ack_seq=[%d]", uname, ch.ID, pkt.SeqNum, last)
+				continue
+			}
+			if pkt.SeqNum > last+1 && last > 0 {
+				srv.log.Warnf("sequence gap. username=[%s], channel=[%d], expected_seq=[%d], received_seq=[%d]", uname, ch.ID, last+1, pkt.SeqNum)
+			}
+			mctx := withChannel(ctx, ch.ID)
+			for {
+				msg, err := pkt.ReadMessage()
+				if errors.Is(err, io.EOF) {
+					break
+				}
 				if err != nil {
 					return err
 				}
-				ch <- p
+				if m, ok := msg.(*model.HeartBeatEcho); ok {
+					// 客户端支持 HeartBeatEcho，之后也向它发送
+					atomic.StoreInt32(&sess.echo, 1)
+					if cs, ok := s.ObserveEcho(m, pkt); ok {
+						srv.log.Debugf("clock sample. username=[%s], rtt=[%s], offset=[%s]", uname, cs.RTT, cs.Offset)
+					}
+				}
+				if err = srv.serveMessage(mctx, sess, msg); err != nil {
+					return err
+				}
+			}
+			// 业务消息处理完之后才确认
+			if pkt.SeqNum != 0 && pkt.MsgCount > 0 {
+				atomic.StoreUint32(&ch.ackSeq, pkt.SeqNum+uint32(pkt.MsgCount)-1)
 			}
 		}
 	})
 
 	// 维持心跳
 	eg.Go(func() error {
-		// 心跳间隔
-		ticker := time.NewTicker(time.Second * 5)
-		// 大于 3 倍心跳间隔
-		timer := time.NewTimer(time.Second * 17)
-		m := model.NewHeartBeat()
+		plain, echo := model.NewHeartBeat(), model.NewHeartBeatEcho()
+		err := hb.Run(ctx, func() error {
+			if atomic.LoadInt32(&sess.echo) == 0 {
+				return sess.writeControl(ctx, plain)
+			}
+			s.Echo(echo)
+			return sess.writeControl(ctx, echo)
+		})
+		if errors.Is(err, heartbeat.ErrTimeout) {
+			srv.metrics.heartbeatTimeouts.Inc()
+			return errors.New("client heart timeout")
+		}
+		return err
+	})
+
+	// 定时确认各通道已处理的客户端消息
+	eg.Go(func() error {
+		ticker := time.NewTicker(srv.ackInterval)
+		defer ticker.Stop()
+		acked := make(map[uint8]uint32, len(sess.chans))
+		for _, ch := range sess.chans {
+			acked[ch.ID] = atomic.LoadUint32(&ch.ackSeq)
+		}
 		for {
 			select {
 			case <-ticker.C:
-				p := new(packet.Buffer)
-				_ = p.WriteMessage(m)
-				ch <- p
-			case <-heart:
-				zap.S().Debug("receive client heartBeat")
-				// 重置心跳超时
-				if !timer.Stop() {
-					select {
-					case <-timer.C: // 确保定时器中的 channel 被排空
-					default:
+				for _, ch := range sess.chans {
+					seq := atomic.LoadUint32(&ch.ackSeq)
+					if seq == acked[ch.ID] {
+						continue
 					}
+					m := model.NewAck()
+					m.SeqNum = seq
+					m.Channel = ch.ID
+					if err := sess.writeControl(ctx, m); err != nil {
+						return err
+					}
+					acked[ch.ID] = seq
 				}
-				timer.Reset(time.Second * 17)
-			case <-timer.C:
-				return errors.New("client heart timeout")
 			case <-ctx.Done():
 				return nil
 			}
@@ -165,57 +634,279 @@ func handler(conn *net.TCPConn) {
 
 	// 写回客户端消息
 	eg.Go(func() error {
+		// 先重发客户端断线前未确认的消息
+		for _, p := range sess.resend {
+			n := p.NumMessages()
+			if err := s.WritePacket(ctx, p); err != nil {
+				return err
+			}
+			atomic.AddUint64(&sess.msgOut, uint64(n))
+		}
+		if len(sess.resend) > 0 {
+			srv.log.Infof("retransmitted. username=[%s], packets=[%d]", uname, len(sess.resend))
+		}
+		sess.resend = nil
+		writeOut := func(ch *channel, p *packet.Buffer) error {
+			// 业务消息在各自的通道内按顺序分配序号，数据包头中的序号为包内第一条消息的序号。确认之前保存在重发缓冲区中
+			n := p.NumMessages()
+			shared := p.Share()
+			seq := atomic.LoadUint32(&ch.nextSeq)
+			if ch.unacked.Add(seq, n, shared) {
+				srv.log.Debugf("retransmit buffer full, oldest packet dropped. username=[%s], channel=[%d]", uname, ch.ID)
+			}
+			p = shared.Packet()
+			p.SeqNum = seq
+			p.Channel = ch.ID
+			if err := s.WritePacket(ctx, p); err != nil {
+				return err
+			}
+			atomic.AddUint32(&ch.nextSeq, uint32(n))
+			atomic.AddUint64(&sess.msgOut, uint64(n))
+			return nil
+		}
 		for {
+			// 协议消息优先，避免心跳排在大量业务消息之后
 			select {
-			case p := <-ch:
-				err = s.WritePacket(ctx, p)
-				if err != nil {
+			case p := <-sess.ctrl:
+				if err := s.WritePacket(ctx, p); err != nil {
 					return err
 				}
+				continue
+			default:
+			}
+			// 其次按通道的优先级，跳过流量控制窗口已满的通道
+			if ch, p := sess.next(false); p != nil {
+				if err := writeOut(ch, p); err != nil {
+					return err
+				}
+				continue
+			}
+			select {
+			case p := <-sess.ctrl:
+				if err := s.WritePacket(ctx, p); err != nil {
+					return err
+				}
+			case <-sess.notify:
+			case reason := <-sess.ending:
+				// 写完已提交的消息后再发送 EndOfSession，不再等待流量控制窗口
+				for drained := false; !drained; {
+					select {
+					case p := <-sess.ctrl:
+						if err := s.WritePacket(ctx, p); err != nil {
+							return err
+						}
+						continue
+					default:
+					}
+					ch, p := sess.next(true)
+					if p == nil {
+						drained = true
+						continue
+					}
+					if err := writeOut(ch, p); err != nil {
+						return err
+					}
+				}
+				m := model.NewEndOfSession()
+				m.Reason = reason
+				if err := writeMessage(ctx, s, m); err != nil {
+					return err
+				}
+				srv.log.Infof("end of session. username=[%s], reason=[%d]", uname, reason)
+				return errEndOfSession
 			case <-ctx.Done():
 				return nil
 			}
 		}
 	})
 
-	if err := eg.Wait(); err != nil {
-		panic(err)
+	err = eg.Wait()
+	logout = errors.Is(err, errLogout)
+	if errors.Is(err, errLogout) || errors.Is(err, errEndOfSession) {
+		err = nil
+	}
+	if err != nil {
+		srv.log.Warnf("session closed. username=[%s], reason=[%v]", uname, err)
+	}
+	info := sess.Info()
+	srv.log.Infof("session latency. username=[%s], latency=[%s], rtt=[%s], clock_offset=[%s]", uname, info.Latency, info.RTT, info.ClockOffset)
+	if srv.hooks.OnDisconnect != nil {
+		srv.hooks.OnDisconnect(sess, err)
+	}
+}
+
+// serveMessage 处理客户端的一个消息，协议消息由框架处理，业务消息交给 Mux
+func (srv *Server) serveMessage(ctx context.Context, sess *Session, msg model.Message) error {
+	uname := sess.username
+	atomic.AddUint64(&sess.msgIn, 1)
+	if srv.hooks.OnMessage != nil {
+		srv.hooks.OnMessage(sess, msg)
+	}
+	switch msg.Type() {
+	case enum.MsgTypeLogin:
+		loginResp := model.NewLoginResponse()
+		loginResp.SessionStatus = enum.SessionStatusAlreadyConnected
+		if err := sess.writeControl(ctx, loginResp); err != nil {
+			return err
+		}
+	case enum.MsgTypeLogout:
+		srv.log.Infof("logout. username=[%s]", uname)
+		return errLogout
+	case enum.MsgTypeSubscribe:
+		topic := msg.(*model.Subscribe).Topic.String()
+		if srv.hooks.OnSubscribe != nil {
+			if err := srv.hooks.OnSubscribe(sess, topic); err != nil {
+				srv.log.Warnf("subscribe rejected. username=[%s], topic=[%s], reason=[%v]", uname, topic, err)
+				return nil
+			}
+		}
+		srv.topics.subscribe(topic, sess, ChannelFromContext(ctx))
+		srv.log.Debugf("subscribe. username=[%s], topic=[%s]", uname, topic)
+	case enum.MsgTypeUnsubscribe:
+		topic := msg.(*model.Unsubscribe).Topic.String()
+		srv.topics.unsubscribe(topic, sess)
+		srv.log.Debugf("unsubscribe. username=[%s], topic=[%s]", uname, topic)
+	case enum.MsgTypeAck:
+		ack := msg.(*model.Ack)
+		if ch, ok := sess.byID[ack.Channel]; ok {
+			ch.unacked.Ack(ack.SeqNum)
+			// 流量控制窗口可能已打开
+			sess.wakeup()
+		}
+	case enum.MsgTypeTransferStart, enum.MsgTypeTransferChunk, enum.MsgTypeTransferEnd, enum.MsgTypeTransferCancel:
+		if m, ok := msg.(*model.TransferCancel); ok && m.Origin == enum.TransferOriginReceiver {
+			// 客户端拒绝了服务端发出的传输
+			srv.log.Warnf("transfer rejected by client. username=[%s], transfer_id=[%d], reason=[%d], active=[%t]", uname, m.TransferID, m.Reason, sess.senders.Cancelled(m))
+			return nil
+		}
+		t, err := sess.transfers.Handle(msg)
+		var ce *transfer.CancelError
+		if errors.As(err, &ce) {
+			srv.log.Warnf("transfer cancelled. username=[%s], transfer_id=[%d], reason=[%d], err=[%v]", uname, ce.ID, ce.Reason, ce.Err)
+			if err = sess.writeControl(ctx, ce.Cancel()); err != nil {
+				return err
+			}
+		}
+		if t == nil {
+			return nil
+		}
+		srv.log.Debugf("transfer received. username=[%s], transfer_id=[%d], name=[%s], size=[%d]", uname, t.ID, t.Name, len(t.Data))
+		if srv.hooks.OnTransfer != nil {
+			srv.hooks.OnTransfer(sess, t)
+		}
+	case enum.MsgTypeRetransmitRequest:
+		return srv.retransmit(ctx, sess, msg.(*model.RetransmitRequest))
+	case enum.MsgTypeHeartBeat, enum.MsgTypeHeartBeatEcho:
+		srv.log.Debug("receive client heartBeat")
+		atomic.StoreInt64(&sess.lastHeartbeat, time.Now().UnixMilli())
+	default:
+		if srv.mux == nil {
+			return nil
+		}
+		return srv.mux.ServeMessage(ctx, sess, msg)
+	}
+	return nil
+}
+
+// reject 直接回复登录失败并关闭连接，不再等待客户端的登录请求
+func (srv *Server) reject(conn net.Conn, status uint8) {
+	defer srv.wg.Done()
+	defer srv.untrack(conn)
+	srv.metrics.rejected.With(strconv.Itoa(int(status))).Inc()
+	s := packet.NewSession(conn)
+	s.SetMetrics(srv.metrics.packets)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := writeLoginResponse(ctx, s, status); err != nil {
+		srv.log.Warnf("write login response failed. client_addr=[%s], err=[%v]", conn.RemoteAddr().String(), err)
+	}
+}
+
+// loginFailed 记录一次登录失败，连续失败达到次数后锁定来源 IP
+func (srv *Server) loginFailed(conn net.Conn, ip net.IP) {
+	if srv.guard.loginFailed(ip) {
+		srv.log.Warnf("ip locked after repeated login failures. client_addr=[%s], client_ip=[%s], lockout=[%s]", conn.RemoteAddr().String(), ip, srv.limits.LockoutPeriod)
+	}
+}
+
+// loginRejected 回复登录失败，并按状态统计。之后连接即被关闭，写失败时只记录日志
+func (srv *Server) loginRejected(ctx context.Context, s *packet.Session, status uint8) {
+	srv.metrics.logins.With(strconv.Itoa(int(status))).Inc()
+	if err := writeLoginResponse(ctx, s, status); err != nil {
+		srv.log.Warnf("write login response failed. client_addr=[%s], status=[%d], err=[%v]", s.RemoteAddr().String(), status, err)
 	}
 }
 
-type TCPServer struct {
-	lis *net.TCPListener
+// writeLoginResponse 回复登录失败
+func writeLoginResponse(ctx context.Context, s *packet.Session, status uint8) error {
+	resp := model.NewLoginResponse()
+	resp.SessionStatus = status
+	return writeMessage(ctx, s, resp)
+}
 
-	userName string
-	password string
+// writeMessage 直接写出一个消息，用于会话建立之前
+func writeMessage(ctx context.Context, s *packet.Session, m model.Message) error {
+	p := new(packet.Buffer)
+	if err := p.WriteMessage(m); err != nil {
+		return err
+	}
+	return s.WritePacket(ctx, p)
 }
 
+// 补发组播消息的限制
 const (
-	serverUsername = "mayee"
-	serverPassword = "mayee"
-	serverPort     = 30001
+	// 单个请求最多补发的消息条数，超出部分由客户端再次请求
+	maxRetransmitCount = 4096
+	// 每个会话每秒的补发请求数和突发数
+	retransmitRate  = 10
+	retransmitBurst = 20
 )
 
-func newTCPServer() *TCPServer {
-	// 如果未指定 IP，则自动选择本地一个可用的 unicast and anycast 地址监听；如果未指定 Port(默认 0)，则随机选一个端口监听
-	lis, _ := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: serverPort})
-	return &TCPServer{
-		lis:      lis,
-		userName: serverUsername,
-		password: serverPassword,
+// retransmit 通过 TCP 会话补发 UDP 组播中丢失的消息，每个数据报一个 RetransmitResponse。
+// 补发在单独的 goroutine 中进行，每个会话同时只有一个；超出频率限制或正在补发时忽略请求，客户端会再次请求
+func (srv *Server) retransmit(ctx context.Context, sess *Session, req *model.RetransmitRequest) error {
+	name := req.Session.String()
+	srv.log.Debugf("retransmit request. username=[%s], session=[%s], seq=[%d], count=[%d]", sess.username, name, req.SeqNum, req.Count)
+	if !sess.retransmits.Allow() || !atomic.CompareAndSwapInt32(&sess.retransmitting, 0, 1) {
+		srv.log.Warnf("retransmit request ignored. username=[%s], session=[%s], seq=[%d], count=[%d]", sess.username, name, req.SeqNum, req.Count)
+		return nil
+	}
+	count := req.Count
+	if count > maxRetransmitCount {
+		count = maxRetransmitCount
 	}
+	go func() {
+		defer atomic.StoreInt32(&sess.retransmitting, 0)
+		srv.replay(ctx, sess, req.Session, req.SeqNum, count)
+	}()
+	return nil
 }
 
-func (s *TCPServer) Start() error {
-	for {
-		conn, err := s.lis.AcceptTCP()
-		if err != nil {
-			return err
+func (srv *Server) replay(ctx context.Context, sess *Session, session typebase.ByteArrayL12, seq uint64, count uint32) {
+	name := session.String()
+	pub, ok := srv.publishers[name]
+	if !ok {
+		resp := model.NewRetransmitResponse()
+		resp.Session = session
+		resp.SeqNum = seq
+		resp.Count = count
+		resp.Status = enum.RetransmitStatusUnknownSession
+		_ = sess.writeControl(ctx, resp)
+		return
+	}
+	err := pub.Replay(seq, count, func(seq uint64, count uint32, ms []model.Message) error {
+		resp := model.NewRetransmitResponse()
+		resp.Session = session
+		resp.SeqNum = seq
+		resp.Count = count
+		if ms == nil {
+			resp.Status = enum.RetransmitStatusUnavailable
+			srv.log.Warnf("retransmit unavailable. username=[%s], session=[%s], seq=[%d], count=[%d]", sess.username, name, seq, count)
 		}
-		go handler(conn)
+		return sess.writeControl(ctx, append([]model.Message{resp}, ms...)...)
+	})
+	if err != nil && ctx.Err() == nil {
+		srv.log.Warnf("retransmit failed. username=[%s], session=[%s], err=[%v]", sess.username, name, err)
 	}
 }
-
-func (s *TCPServer) Stop() error {
-	return s.lis.Close()
-}
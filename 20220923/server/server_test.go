@@ -1,11 +1,24 @@
-package main
+package server
 
 import (
+	"20220923/internal/acl"
+	"20220923/internal/enum"
+	"20220923/internal/metrics"
+	"20220923/internal/model"
+	"20220923/internal/packet"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/sync/errgroup"
+	"math"
 	"math/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -87,3 +100,823 @@ func TestTimeout(t *testing.T) {
 		}
 	}
 }
+
+// login 发起连接并登录，返回登录响应状态
+func login(t *testing.T, addr net.Addr, username, password string) (*packet.Session, uint8) {
+	t.Helper()
+	s, resp := resume(t, addr, username, password, 0)
+	return s, resp.SessionStatus
+}
+
+// resume 登录并从 seq 续传
+func resume(t *testing.T, addr net.Addr, username, password string, seq uint32) (*packet.Session, *model.LoginResponse) {
+	t.Helper()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resumeConn(t, conn, username, password, seq)
+}
+
+// resumeConn 在已建立的连接上登录
+func resumeConn(t *testing.T, conn net.Conn, username, password string, seq uint32) (*packet.Session, *model.LoginResponse) {
+	t.Helper()
+	s := packet.NewSession(conn)
+	m := model.NewLogin()
+	m.Username.Set([]byte(username))
+	m.Password.Set([]byte(password))
+	m.SeqNum = seq
+	p := new(packet.Buffer)
+	_ = p.WriteMessage(m)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	err := s.WritePacket(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err = s.ReadPacket(ctx); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, resp.(*model.LoginResponse)
+}
+
+func TestServe(t *testing.T) {
+	mux := NewMux()
+	mux.Handle(enum.MsgTypeClientDemo, func(ctx context.Context, s *Session, _ model.Message) error {
+		return s.Write(ctx, model.NewServerDemo())
+	})
+	logins := make(chan string, 1)
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee"})),
+		WithHandler(mux),
+		WithHooks(Hooks{OnLogin: func(s *Session) { logins <- s.Username() }}),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+
+	if _, status := login(t, srv.Addr(), "mayee", "wrong"); status != enum.SessionStatusInvalid {
+		t.Fatalf("wrong password: status = %d", status)
+	}
+	s, status := login(t, srv.Addr(), "mayee", "mayee")
+	if status != enum.SessionStatusActive {
+		t.Fatalf("login: status = %d", status)
+	}
+	defer s.Close()
+	if u := <-logins; u != "mayee" {
+		t.Fatalf("OnLogin username = %s", u)
+	}
+	if _, status = login(t, srv.Addr(), "mayee", "mayee"); status != enum.SessionStatusAlreadyConnected {
+		t.Fatalf("duplicate login: status = %d", status)
+	}
+	if n := len(srv.Sessions()); n != 1 {
+		t.Fatalf("sessions = %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	p := new(packet.Buffer)
+	_ = p.WriteMessage(model.NewClientDemo())
+	if err := s.WritePacket(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := s.ReadPacket(ctx); err != nil {
+		t.Fatal(err)
+	} else if m, _ := p.ReadMessage(); m == nil || m.Type() != enum.MsgTypeServerDemo {
+		t.Fatalf("response = %v", m)
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve = %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	mux := NewMux()
+	mux.Handle(enum.MsgTypeClientDemo, func(ctx context.Context, s *Session, _ model.Message) error {
+		return s.Write(ctx, model.NewServerDemo())
+	})
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee"})),
+		WithHandler(mux),
+		WithMetrics(reg),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+
+	if _, status := login(t, srv.Addr(), "mayee", "wrong"); status != enum.SessionStatusInvalid {
+		t.Fatalf("wrong password: status = %d", status)
+	}
+	s, status := login(t, srv.Addr(), "mayee", "mayee")
+	if status != enum.SessionStatusActive {
+		t.Fatalf("login: status = %d", status)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	p := new(packet.Buffer)
+	_ = p.WriteMessage(model.NewClientDemo())
+	p.SeqNum = 1
+	if err := s.WritePacket(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if p, err := s.ReadPacket(ctx); err != nil {
+			t.Fatal(err)
+		} else if m, _ := p.ReadMessage(); m != nil && m.Type() == enum.MsgTypeServerDemo {
+			break
+		}
+	}
+
+	var out bytes.Buffer
+	if err := reg.WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"server_connections_accepted_total 2",
+		`server_logins_total{status="0"} 1`,
+		`server_logins_total{status="5"} 1`,
+		`server_messages_total{direction="in",msg_type="99"} 1`,
+		`server_messages_total{direction="out",msg_type="100"} 1`,
+		`server_messages_total{direction="out",msg_type="102"} 2`,
+		"server_sessions 1",
+		"server_queue_depth 0",
+		"server_decode_errors_total 0",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	addrs := []string{"127.0.0.1:0"}
+	if l, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		_ = l.Close()
+		addrs = append(addrs, "[::1]:0")
+	}
+	srv := New(
+		WithAddr(addrs...),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee", "sean": "sean"})),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+
+	users := []string{"mayee", "sean"}
+	for i, addr := range srv.Addrs() {
+		s, status := login(t, addr, users[i], users[i])
+		if status != enum.SessionStatusActive {
+			t.Fatalf("login on %s: status = %d", addr, status)
+		}
+		defer s.Close()
+	}
+	for _, info := range srv.Sessions() {
+		host, _, err := net.SplitHostPort(info.RemoteAddr)
+		if err != nil || net.ParseIP(host) == nil {
+			t.Fatalf("session remote addr = %s", info.RemoteAddr)
+		}
+	}
+
+	// 任一地址监听失败时返回错误，已监听的地址被关闭
+	busy := srv.Addr().String()
+	srv2 := New(WithAddr("127.0.0.1:0", busy))
+	if err := srv2.Listen(); err == nil {
+		t.Fatalf("listen on %s: no error", busy)
+	}
+	if n := len(srv2.Addrs()); n != 0 {
+		t.Fatalf("listeners after bind error = %d", n)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	// 本机连接没有 IP，默认与其他连接一样校验全局白名单
+	a, err := acl.New(acl.Config{Rule: acl.Rule{Allow: []string{"10.0.0.0/8"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(
+		WithNetwork("unix"),
+		WithAddr(filepath.Join(t.TempDir(), "server.sock")),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee"})),
+		WithACL(a),
+	)
+	if err = srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+	if srv.Addr().Network() != "unix" {
+		t.Fatalf("network = %s", srv.Addr().Network())
+	}
+	if _, status := login(t, srv.Addr(), "mayee", "mayee"); status != enum.SessionStatusInvalid {
+		t.Fatalf("unix login without trust_local: status = %d", status)
+	}
+
+	// TrustLocal 时不校验全局规则，用户规则仍然生效
+	a, err = acl.New(acl.Config{
+		Rule:       acl.Rule{Allow: []string{"10.0.0.0/8"}},
+		Users:      []acl.UserRule{{Username: "ip", Rule: acl.Rule{Allow: []string{"10.0.0.1"}}}},
+		TrustLocal: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = New(
+		WithNetwork("unix"),
+		WithAddr(filepath.Join(t.TempDir(), "server.sock")),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee", "sean": "sean", "ip": "ip"})),
+		WithACL(a),
+	)
+	if err = srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+	s, status := login(t, srv.Addr(), "mayee", "mayee")
+	if status != enum.SessionStatusActive {
+		t.Fatalf("unix login: status = %d", status)
+	}
+	defer s.Close()
+	if _, status = login(t, srv.Addr(), "ip", "ip"); status != enum.SessionStatusInvalid {
+		t.Fatalf("unix login with user rule: status = %d", status)
+	}
+
+	// 内存连接直接交给 ServeConn
+	server, client := net.Pipe()
+	if err = srv.ServeConn(server); err != nil {
+		t.Fatal(err)
+	}
+	s, resp := resumeConn(t, client, "sean", "sean", 0)
+	if resp.SessionStatus != enum.SessionStatusActive {
+		t.Fatalf("pipe login: status = %d", resp.SessionStatus)
+	}
+	defer s.Close()
+	if n := len(srv.Sessions()); n != 2 {
+		t.Fatalf("sessions = %d", n)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee"})),
+		WithLimits(Limits{
+			LoginTimeout:  time.Millisecond * 50,
+			MaxFailures:   2,
+			FailureWindow: time.Minute,
+			LockoutPeriod: time.Minute,
+		}),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+
+	// 连接后不发送登录请求
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	p, err := packet.NewSession(conn).ReadPacket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := p.ReadMessage(); m.(*model.LoginResponse).SessionStatus != enum.SessionStatusLoginTimeout {
+		t.Fatalf("login timeout: response = %v", m)
+	}
+
+	// 连续失败后锁定，正确的密码也会被拒绝
+	for i := 0; i < 2; i++ {
+		if _, status := login(t, srv.Addr(), "mayee", "wrong"); status != enum.SessionStatusInvalid {
+			t.Fatalf("wrong password: status = %d", status)
+		}
+	}
+	if _, status := login(t, srv.Addr(), "mayee", "mayee"); status != enum.SessionStatusLocked {
+		t.Fatalf("after lockout: status = %d", status)
+	}
+
+	// 被 ACL 拒绝的登录同样计入失败次数
+	a, err := acl.New(acl.Config{Users: []acl.UserRule{{Username: "mayee", Rule: acl.Rule{Allow: []string{"10.0.0.1"}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee", "other": "other"})),
+		WithACL(a),
+		WithLimits(Limits{MaxFailures: 2, FailureWindow: time.Minute, LockoutPeriod: time.Minute}),
+	)
+	if err = srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+	for i := 0; i < 2; i++ {
+		if _, status := login(t, srv.Addr(), "mayee", "mayee"); status != enum.SessionStatusInvalid {
+			t.Fatalf("acl denied: status = %d", status)
+		}
+	}
+	if _, status := login(t, srv.Addr(), "other", "other"); status != enum.SessionStatusLocked {
+		t.Fatalf("after acl lockout: status = %d", status)
+	}
+}
+
+func TestSocketError(t *testing.T) {
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee"})),
+		WithSocket(packet.SocketOptions{ReadBuffer: 1 << 16}),
+		WithLimits(Limits{MaxPending: 1}),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+
+	// 已关闭的连接设置套接字选项失败，不应占用未登录连接的名额
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if err = srv.ServeConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 3)
+	for {
+		s, status := login(t, srv.Addr(), "mayee", "mayee")
+		_ = s.Close()
+		if status == enum.SessionStatusActive {
+			break
+		}
+		if status != enum.SessionStatusBusy || time.Now().After(deadline) {
+			t.Fatalf("login after socket error: status = %d", status)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	a, err := acl.New(acl.Config{
+		Users:   []acl.UserRule{{Username: "mayee", Rule: acl.Rule{Allow: []string{"10.0.0.0/8"}}}},
+		Proxies: []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee", "other": "other"})),
+		WithACL(a),
+		WithLimits(Limits{MaxFailures: 1, FailureWindow: time.Minute, LockoutPeriod: time.Minute}),
+	)
+	if err = srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+
+	// 网关在 Login 之前转发客户端的 IP
+	forwarded := func(ip, username, password string) uint8 {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		s := packet.NewSession(conn)
+		fwd := model.NewForwardedFor()
+		fwd.SetIP(net.ParseIP(ip))
+		m := model.NewLogin()
+		m.Username.Set([]byte(username))
+		m.Password.Set([]byte(password))
+		p := new(packet.Buffer)
+		_ = p.WriteMessage(fwd)
+		_ = p.WriteMessage(m)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		if err = s.WritePacket(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		if p, err = s.ReadPacket(ctx); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := p.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.(*model.LoginResponse).SessionStatus
+	}
+	// 用户规则按转发的 IP 校验
+	if status := forwarded("10.1.2.3", "mayee", "mayee"); status != enum.SessionStatusActive {
+		t.Fatalf("forwarded login: status = %d", status)
+	}
+	if _, status := login(t, srv.Addr(), "mayee", "mayee"); status != enum.SessionStatusInvalid {
+		t.Fatalf("gateway ip: status = %d", status)
+	}
+	// 失败锁定的是客户端的 IP，不影响网关的其他客户端
+	if status := forwarded("10.9.9.9", "other", "wrong"); status != enum.SessionStatusInvalid {
+		t.Fatalf("wrong password: status = %d", status)
+	}
+	if status := forwarded("10.9.9.9", "other", "other"); status != enum.SessionStatusLocked {
+		t.Fatalf("forwarded lockout: status = %d", status)
+	}
+	if status := forwarded("10.9.9.8", "other", "other"); status != enum.SessionStatusActive {
+		t.Fatalf("other client: status = %d", status)
+	}
+}
+
+func TestRetransmit(t *testing.T) {
+	mux := NewMux()
+	var handled int32
+	mux.Handle(enum.MsgTypeClientDemo, func(ctx context.Context, s *Session, _ model.Message) error {
+		atomic.AddInt32(&handled, 1)
+		return s.Write(ctx, model.NewServerDemo())
+	})
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee"})),
+		WithHandler(mux),
+		WithAck(time.Millisecond*10, 0),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// 读出下一个业务数据包，跳过心跳和 Ack
+	next := func(s *packet.Session) *packet.Buffer {
+		t.Helper()
+		for {
+			p, err := s.ReadPacket(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.SeqNum != 0 {
+				return p
+			}
+		}
+	}
+	send := func(s *packet.Session, seq uint32) {
+		t.Helper()
+		p := new(packet.Buffer)
+		_ = p.WriteMessage(model.NewClientDemo())
+		p.SeqNum = seq
+		if err := s.WritePacket(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, resp := resume(t, srv.Addr(), "mayee", "mayee", 0)
+	if resp.SessionStatus != enum.SessionStatusActive || resp.AckSeqNum != 0 {
+		t.Fatalf("login: %+v", resp)
+	}
+	send(s, 1)
+	send(s, 2)
+	// 重复的请求不会被处理
+	send(s, 2)
+	send(s, 3)
+	for i := uint32(1); i <= 3; i++ {
+		if p := next(s); p.SeqNum != i {
+			t.Fatalf("SeqNum = %d, want %d", p.SeqNum, i)
+		}
+	}
+	if n := atomic.LoadInt32(&handled); n != 3 {
+		t.Fatalf("handled %d requests, want 3", n)
+	}
+	// 不确认就断开，等待服务端注销会话
+	_ = s.Close()
+	for len(srv.Sessions()) != 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("session not unregistered")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+
+	// 只处理了序号 1，服务端应从序号 2 重发，并告知已处理的客户端消息
+	s, resp = resume(t, srv.Addr(), "mayee", "mayee", 2)
+	defer s.Close()
+	if resp.SeqNum != 4 || resp.AckSeqNum != 3 {
+		t.Fatalf("resume: %+v", resp)
+	}
+	for i := uint32(2); i <= 3; i++ {
+		if p := next(s); p.SeqNum != i {
+			t.Fatalf("retransmitted SeqNum = %d, want %d", p.SeqNum, i)
+		}
+	}
+	send(s, 4)
+	if p := next(s); p.SeqNum != 4 {
+		t.Fatalf("SeqNum = %d, want 4", p.SeqNum)
+	}
+}
+
+func TestRetransmitLimits(t *testing.T) {
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee"})),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	s, _ := resume(t, srv.Addr(), "mayee", "mayee", 0)
+	defer s.Close()
+	for i := 0; i < retransmitBurst*2; i++ {
+		req := model.NewRetransmitRequest()
+		req.Session.Set([]byte("DEMO"))
+		req.SeqNum = 1
+		req.Count = math.MaxUint32
+		p := new(packet.Buffer)
+		_ = p.WriteMessage(req)
+		if err := s.WritePacket(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 超出频率限制的请求被忽略，补发的条数不超过上限
+	var n int
+	rctx, rcancel := context.WithTimeout(ctx, time.Millisecond*300)
+	defer rcancel()
+	for {
+		p, err := s.ReadPacket(rctx)
+		if err != nil {
+			break
+		}
+		m, err := p.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, ok := m.(*model.RetransmitResponse); ok {
+			n++
+			if resp.Status != enum.RetransmitStatusUnknownSession || resp.Count != maxRetransmitCount {
+				t.Fatalf("response = %+v", resp)
+			}
+		}
+	}
+	if n == 0 || n > retransmitBurst+1 {
+		t.Fatalf("%d responses for %d requests", n, retransmitBurst*2)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	mux := NewMux()
+	mux.Handle(enum.MsgTypeClientDemo, func(ctx context.Context, s *Session, _ model.Message) error {
+		return s.Write(ctx, model.NewServerDemo())
+	})
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee"})),
+		WithHandler(mux),
+		WithChannels(ChannelConfig{ID: 1, Name: "market", Priority: 10, Window: 2}),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	next := func(s *packet.Session) *packet.Buffer {
+		t.Helper()
+		for {
+			p, err := s.ReadPacket(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.SeqNum != 0 {
+				return p
+			}
+		}
+	}
+	send := func(s *packet.Session, ch uint8, m model.Message) {
+		t.Helper()
+		p := new(packet.Buffer)
+		_ = p.WriteMessage(m)
+		p.SeqNum = 1
+		p.Channel = ch
+		if err := s.WritePacket(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, status := login(t, srv.Addr(), "mayee", "mayee")
+	if status != enum.SessionStatusActive {
+		t.Fatalf("login: status = %d", status)
+	}
+	defer s.Close()
+	// 未配置的通道被丢弃，响应写回请求所在的通道，各通道的序号独立
+	send(s, 7, model.NewClientDemo())
+	send(s, 1, model.NewClientDemo())
+	send(s, 0, model.NewClientDemo())
+	for _, ch := range []uint8{1, 0} {
+		if p := next(s); p.Channel != ch || p.SeqNum != 1 {
+			t.Fatalf("response channel = %d, SeqNum = %d, want channel %d", p.Channel, p.SeqNum, ch)
+		}
+	}
+
+	// 通道 1 的窗口为 2，未确认时只能再写出一个数据包，不影响通道 0
+	sess, _ := srv.registry.Get("mayee")
+	for i := 0; i < 3; i++ {
+		if err := sess.WriteChannel(ctx, 1, model.NewServerDemo()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sess.WriteChannel(ctx, 0, model.NewServerDemo()); err != nil {
+		t.Fatal(err)
+	}
+	got := map[uint8]uint32{}
+	for i := 0; i < 2; i++ {
+		p := next(s)
+		got[p.Channel] = p.SeqNum
+	}
+	if got[0] != 2 || got[1] != 2 {
+		t.Fatalf("before ack: %v", got)
+	}
+	if info := sess.Info(); info.Channels[0].ID != 1 || info.Channels[0].QueueLen != 2 || info.Channels[0].Unacked != 2 {
+		t.Fatalf("channel info: %+v", info.Channels)
+	}
+	// Ack 是协议消息，不分配序号
+	ack := model.NewAck()
+	ack.SeqNum = 2
+	ack.Channel = 1
+	p := new(packet.Buffer)
+	_ = p.WriteMessage(ack)
+	if err := s.WritePacket(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(3); i <= 4; i++ {
+		if p := next(s); p.Channel != 1 || p.SeqNum != i {
+			t.Fatalf("after ack: channel = %d, SeqNum = %d, want %d", p.Channel, p.SeqNum, i)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var handled int
+	h := RateLimit(0, 2)(func(context.Context, *Session, model.Message) error {
+		handled++
+		return nil
+	})
+	sess := func(username string) *Session {
+		return &Session{username: username, log: zap.NewNop().Sugar()}
+	}
+	a, b := sess("a"), sess("b")
+	for i := 0; i < 5; i++ {
+		_ = h(context.Background(), a, model.NewClientDemo())
+	}
+	if handled != 2 {
+		t.Fatalf("user a handled %d messages, want 2", handled)
+	}
+	// 其它用户不受影响，同一用户重连后不重置
+	_ = h(context.Background(), b, model.NewClientDemo())
+	_ = h(context.Background(), sess("a"), model.NewClientDemo())
+	if handled != 3 {
+		t.Fatalf("handled %d messages, want 3", handled)
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	var first int32
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee"})),
+		WithDuplicatePolicy(DuplicateTakeover),
+		WithHooks(Hooks{OnLogin: func(s *Session) {
+			if !atomic.CompareAndSwapInt32(&first, 0, 1) {
+				return
+			}
+			// 旧会话在被接管时仍在不断写出业务消息
+			go func() {
+				for {
+					if err := s.Write(context.Background(), model.NewServerDemo()); err != nil {
+						return
+					}
+				}
+			}()
+		}}),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+
+	old, status := login(t, srv.Addr(), "mayee", "mayee")
+	if status != enum.SessionStatusActive {
+		t.Fatalf("first login: status = %d", status)
+	}
+	// 旧连接收到的最大序号
+	var maxSeq uint32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			p, err := old.ReadPacket(context.Background())
+			if err != nil {
+				return
+			}
+			if end := p.SeqNum + uint32(p.MsgCount) - 1; p.SeqNum != 0 && end > maxSeq {
+				maxSeq = end
+			}
+		}
+	}()
+	time.Sleep(time.Millisecond * 20)
+
+	_, resp := resume(t, srv.Addr(), "mayee", "mayee", 0)
+	if resp.SessionStatus != enum.SessionStatusActive {
+		t.Fatalf("takeover: status = %d", resp.SessionStatus)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatal("old session not disconnected")
+	}
+	if resp.SeqNum <= maxSeq {
+		t.Fatalf("takeover: next_seq = %d, old session already used %d", resp.SeqNum, maxSeq)
+	}
+}
+
+func TestLoginError(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithAuthenticator(StaticUsers(map[string]string{"mayee": "mayee"})),
+		WithLogger(zap.New(core).Sugar()),
+	)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(context.Background()) }()
+	defer srv.Shutdown(context.Background())
+
+	// 登录之前断开，以及无法解码的登录消息
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	conn, err = net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := new(packet.Buffer)
+	_ = p.WriteMessage(&model.MetaMessage{MsgSize: 4, MsgType: 999})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if err = packet.NewSession(conn).WritePacket(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	for logs.FilterMessageSnippet("decode login failed").Len() == 0 || logs.FilterMessageSnippet("read login failed").Len() == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("logs = %v", logs.All())
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	// 普通的客户端错误不是 panic
+	if n := logs.FilterMessageSnippet("panic").Len(); n != 0 {
+		t.Fatalf("%d panics logged", n)
+	}
+}
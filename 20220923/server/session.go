@@ -0,0 +1,247 @@
+package server
+
+import (
+	"20220923/internal/metrics"
+	"20220923/internal/model"
+	"20220923/internal/packet"
+	"20220923/internal/transfer"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session 已登录的客户端会话
+type Session struct {
+	*packet.Session
+
+	username    string
+	loginTime   time.Time
+	cancel      context.CancelFunc
+	queue       QueueConfig
+	chans       []*channel          `comment:"逻辑通道，按优先级排序"`
+	byID        map[uint8]*channel  `comment:"逻辑通道，创建后只读"`
+	notify      chan struct{}       `comment:"有业务数据包入队或流量控制窗口打开时通知写 goroutine"`
+	ctrl        chan *packet.Buffer `comment:"待写回客户端的协议数据包(心跳、登录响应等)，不分配序号"`
+	ending      chan uint8          `comment:"结束会话的原因，写完待发送的消息后发送 EndOfSession 并断开"`
+	done        chan struct{}       `comment:"会话的所有 goroutine 退出并注销之后关闭"`
+	resend      []*packet.Buffer    `comment:"登录后需要重发的默认通道的数据包"`
+	transfers   *transfer.Assembler `comment:"重组客户端的分片传输，属于用户，断线后保留"`
+	senders     *transfer.Senders   `comment:"发给客户端的分片传输，客户端取消时中止"`
+	retransmits *rate.Limiter       `comment:"组播补发请求的频率限制"`
+	depth       *int64              `comment:"发送队列中的数据包个数，atomic 读写，由 Server 指向所有会话共用的计数"`
+	qmu         sync.RWMutex        `comment:"入队时持有读锁，discard 持有写锁，保证关闭之后没有数据包入队"`
+	closed      bool                `comment:"发送队列已关闭，由 qmu 保护"`
+	log         *zap.SugaredLogger
+
+	// 以下字段使用 atomic 读写
+	msgIn          uint64
+	msgOut         uint64
+	dropped        uint64 // 因发送队列已满而未发送的数据包个数
+	lastHeartbeat  int64  // 最近一次收到心跳的时间(毫秒级时间戳)
+	retransmitting int32  // 为 1 时正在补发组播消息
+	echo           int32  // 为 1 时客户端支持 HeartBeatEcho
+}
+
+// SessionInfo 会话的快照，用于列出在线会话
+type SessionInfo struct {
+	Username      string
+	RemoteAddr    string
+	LoginTime     time.Time
+	LastHeartbeat time.Time
+	MsgIn         uint64
+	MsgOut        uint64
+	NextSeq       uint32 `comment:"默认通道下一条业务消息的序号"`
+	QueueLen      int    `comment:"所有通道的发送队列中等待写出的数据包个数"`
+	QueueCap      int    `comment:"每个通道的发送队列的长度"`
+	Dropped       uint64 `comment:"因发送队列已满而未发送的数据包个数"`
+	Unacked       int    `comment:"所有通道已发送未确认的数据包个数"`
+	AckSeq        uint32 `comment:"默认通道已处理的客户端业务消息的最大序号"`
+	Channels      []ChannelInfo
+
+	Latency     metrics.HistogramSnapshot `comment:"客户端数据包的单向延迟分布，包含时钟偏差"`
+	RTT         time.Duration             `comment:"心跳的往返时间，未测量时为 0"`
+	ClockOffset time.Duration             `comment:"客户端时钟减去服务端时钟，未测量时为 0"`
+}
+
+// newSession channels 须经过 sortChannels 处理
+func newSession(s *packet.Session, username string, cancel context.CancelFunc, queue QueueConfig, channels []ChannelConfig, log *zap.SugaredLogger) *Session {
+	now := time.Now()
+	sess := &Session{
+		Session:       s,
+		username:      username,
+		loginTime:     now,
+		cancel:        cancel,
+		log:           log,
+		queue:         queue,
+		byID:          make(map[uint8]*channel, len(channels)),
+		notify:        make(chan struct{}, 1),
+		ctrl:          make(chan *packet.Buffer, ctrlQueueSize),
+		ending:        make(chan uint8, 1),
+		done:          make(chan struct{}),
+		senders:       transfer.NewSenders(),
+		retransmits:   rate.NewLimiter(retransmitRate, retransmitBurst),
+		depth:         new(int64),
+		lastHeartbeat: now.UnixMilli(),
+	}
+	for _, cfg := range channels {
+		c := newChannel(cfg, queue.Size)
+		sess.chans = append(sess.chans, c)
+		sess.byID[cfg.ID] = c
+	}
+	return sess
+}
+
+func (s *Session) Username() string {
+	return s.username
+}
+
+func (s *Session) LoginTime() time.Time {
+	return s.loginTime
+}
+
+// Logger 服务端的日志
+func (s *Session) Logger() *zap.SugaredLogger {
+	return s.log
+}
+
+// Info 返回会话当前的统计信息
+func (s *Session) Info() SessionInfo {
+	def := s.defaultChannel()
+	info := SessionInfo{
+		Username:      s.username,
+		RemoteAddr:    s.RemoteAddr().String(),
+		LoginTime:     s.loginTime,
+		LastHeartbeat: time.UnixMilli(atomic.LoadInt64(&s.lastHeartbeat)),
+		MsgIn:         atomic.LoadUint64(&s.msgIn),
+		MsgOut:        atomic.LoadUint64(&s.msgOut),
+		NextSeq:       atomic.LoadUint32(&def.nextSeq),
+		QueueCap:      s.queue.Size,
+		Dropped:       atomic.LoadUint64(&s.dropped),
+		AckSeq:        atomic.LoadUint32(&def.ackSeq),
+		Latency:       s.Latency(),
+	}
+	if cs, ok := s.Clock(); ok {
+		info.RTT = cs.RTT
+		info.ClockOffset = cs.Offset
+	}
+	for _, c := range s.chans {
+		ci := c.info()
+		info.QueueLen += ci.QueueLen
+		info.Unacked += ci.Unacked
+		info.Channels = append(info.Channels, ci)
+	}
+	return info
+}
+
+// Write 回复业务消息给客户端，多个消息会打包在同一个数据包中。
+// 写到 ctx 中的逻辑通道(即请求所在的通道)，没有时写到默认通道。
+// 发送队列已满时按 OverflowPolicy 处理，可能返回 ErrQueueFull 或 ErrSlowConsumer
+func (s *Session) Write(ctx context.Context, ms ...model.Message) error {
+	return s.WriteChannel(ctx, ChannelFromContext(ctx), ms...)
+}
+
+// WriteChannel 回复业务消息到指定的逻辑通道，通道未配置时返回 ErrUnknownChannel
+func (s *Session) WriteChannel(ctx context.Context, id uint8, ms ...model.Message) error {
+	c, ok := s.byID[id]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownChannel, id)
+	}
+	p, err := pack(ms...)
+	if err != nil {
+		return err
+	}
+	p.Channel = id
+	return s.enqueue(ctx, c, p)
+}
+
+// SendTransfer 把超过一个数据包大小的数据拆分为分片发送给客户端，写到 ctx 中的逻辑通道。
+// 分片不按 OverflowPolicy 丢弃，发送队列已满时阻塞等待，超过 QueueConfig.Timeout 时整个传输失败。
+// 失败或 ctx 结束时通知客户端取消，客户端取消时返回 *transfer.CancelError
+func (s *Session) SendTransfer(ctx context.Context, name string, data []byte) error {
+	c, ok := s.byID[ChannelFromContext(ctx)]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownChannel, ChannelFromContext(ctx))
+	}
+	return s.senders.Send(ctx, name, data, func(ctx context.Context, m model.Message) error {
+		p, err := pack(m)
+		if err != nil {
+			return err
+		}
+		p.Channel = c.ID
+		return s.enqueueBulk(ctx, c, p)
+	})
+}
+
+func (s *Session) defaultChannel() *channel {
+	return s.byID[0]
+}
+
+// wakeup 通知写 goroutine 有数据包可以写出
+func (s *Session) wakeup() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next 按优先级取出下一个可以写出的业务数据包，force 为 true 时忽略流量控制
+func (s *Session) next(force bool) (*channel, *packet.Buffer) {
+	for _, c := range s.chans {
+		if !force && !c.open() {
+			continue
+		}
+		// out 和 bulk 都有数据包时随机选择，分片传输不会被业务消息饿死
+		select {
+		case p := <-c.out:
+			atomic.AddInt64(s.depth, -1)
+			return c, p
+		case p := <-c.bulk:
+			atomic.AddInt64(s.depth, -1)
+			return c, p
+		default:
+		}
+	}
+	return nil, nil
+}
+
+// writeControl 回复协议消息，不占用业务消息的序号，写出时优先于业务消息
+func (s *Session) writeControl(ctx context.Context, ms ...model.Message) error {
+	p, err := pack(ms...)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.ctrl <- p:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func pack(ms ...model.Message) (*packet.Buffer, error) {
+	p := new(packet.Buffer)
+	for _, m := range ms {
+		if err := p.WriteMessage(m); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// end 通知会话结束，只有第一次调用生效
+func (s *Session) end(reason uint8) {
+	select {
+	case s.ending <- reason:
+	default:
+	}
+}
+
+// disconnect 强制断开会话。先取消 ctx 通知各 goroutine 退出，再关闭连接使阻塞中的读写立即返回
+func (s *Session) disconnect() {
+	s.cancel()
+	_ = s.Conn.Close()
+}